@@ -0,0 +1,97 @@
+/*
+Copyright 2014 Helix Digital
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Deleter is implemented by Uploaders that can also remove what they
+// have uploaded
+type Deleter interface {
+	Delete(string) error
+}
+
+// ErrJobFinished is returned by CancelJob when the job has already stopped
+var ErrJobFinished = errors.New("Job has already finished")
+
+// The cancel channels of the jobs that are still running, by jobid.
+// A job is asked to stop by closing its channel.
+var cancels = make(map[int]chan struct{})
+var cancels_lock sync.Mutex
+
+// CancelJob asks the job with the given jobid to stop. The job stops
+// at the end of the stage it is in, removes anything it has already
+// uploaded and records its status as "Cancelled".
+func CancelJob(jobid int) error {
+	job, ok := jobstore.GetJob(jobid)
+	if !ok {
+		return fmt.Errorf("No job found with id %d", jobid)
+	}
+	if job.Finished() {
+		return ErrJobFinished
+	}
+	cancels_lock.Lock()
+	defer cancels_lock.Unlock()
+	cancel, ok := cancels[jobid]
+	if !ok {
+		return ErrJobFinished
+	}
+	select {
+	case <-cancel:
+	default:
+		close(cancel)
+	}
+	return nil
+}
+
+// Registers a running job so that it can be cancelled
+func cancellable(jobid int) <-chan struct{} {
+	cancels_lock.Lock()
+	defer cancels_lock.Unlock()
+	cancel := make(chan struct{})
+	cancels[jobid] = cancel
+	return cancel
+}
+
+// Unregisters a job once it has stopped running
+func forgetCancel(jobid int) {
+	cancels_lock.Lock()
+	defer cancels_lock.Unlock()
+	delete(cancels, jobid)
+}
+
+func isCancelled(cancel <-chan struct{}) bool {
+	select {
+	case <-cancel:
+		return true
+	default:
+		return false
+	}
+}
+
+// Removes an object that a cancelled job had already uploaded. Not
+// every Uploader can delete.
+func removeUploaded(uploadedName string) error {
+	deleter, ok := uploader.(Deleter)
+	if !ok {
+		return fmt.Errorf("Uploader cannot delete %s", uploadedName)
+	}
+	return deleter.Delete(uploadedName)
+}
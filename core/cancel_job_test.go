@@ -0,0 +1,98 @@
+/*
+Copyright 2014 Helix Digital
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"image"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/helixdigital/imageserver/entities"
+	"github.com/helixdigital/imageserver/plugin/storage"
+	"github.com/helixdigital/imageserver/plugin/upload"
+)
+
+// An Uploader that does not return from Upload until it is released
+type blockingUpload struct {
+	upload.MockUpload
+	started chan bool
+	release chan bool
+}
+
+func (self *blockingUpload) Upload(rdr io.Reader, size int64, mime string, uplname string, options entities.UploadOptions) error {
+	self.started <- true
+	<-self.release
+	return self.MockUpload.Upload(rdr, size, mime, uplname, options)
+}
+
+func TestCancelJobWhileUploading(t *testing.T) {
+	blocking := &blockingUpload{started: make(chan bool), release: make(chan bool)}
+	WaitForJobs()
+	InjectUploader(blocking)
+	store := storage.NewJobStore()
+	InjectJobstore(&store)
+	MakeGrayFile(100, 100, "/tmp/cancel.png")
+	defer os.Remove("/tmp/cancel.png")
+
+	jobid, _ := NewJob(JobRequest{
+		Local_filename:    "/tmp/cancel.png",
+		Crop_to:           image.Rect(0, 0, 50, 50),
+		Uploaded_filename: "cancel.png",
+	})
+	<-blocking.started
+	if err := CancelJob(jobid); err != nil {
+		t.Fatal("Cancelling a running job unexpectedly threw an error", err)
+	}
+	blocking.release <- true
+
+	status := waitForStatus(jobid, "Cancelled")
+	if status != "Cancelled" {
+		t.Error("Status after cancelling should have been 'Cancelled' but was", status)
+	}
+	if blocking.DeletedName != "cancel.png" {
+		t.Error("The cancelled upload should have been deleted but deleted", blocking.DeletedName)
+	}
+	if err := CancelJob(jobid); err != ErrJobFinished {
+		t.Error("Cancelling a cancelled job should have thrown ErrJobFinished but threw", err)
+	}
+}
+
+func TestCancelUnknownJob(t *testing.T) {
+	WaitForJobs()
+	store := storage.NewJobStore()
+	InjectJobstore(&store)
+	if err := CancelJob(10); err == nil {
+		t.Error("Cancelling a job that does not exist should have thrown an error")
+	}
+}
+
+// Polls the job until it has the expected status or a couple of
+// seconds have gone by. Returns the last status seen.
+func waitForStatus(jobid int, expected string) string {
+	var status string
+	for i := 0; i < 200; i++ {
+		report, _ := JobStatus(jobid)
+		status = report.Status
+		if status == expected {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return status
+}
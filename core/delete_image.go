@@ -0,0 +1,153 @@
+/*
+Copyright 2014 Helix Digital
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"errors"
+
+	"github.com/helixdigital/imageserver/entities"
+)
+
+// ErrCannotDelete is returned by DeleteImage when the Uploader is not a
+// Deleter
+var ErrCannotDelete = errors.New("The uploader cannot delete images")
+
+// ErrJobRunning is returned by DeleteImage when a job that makes the
+// image has not finished
+var ErrJobRunning = errors.New("A job that makes the image is still running")
+
+// ErrNotMade is returned by DeleteImage when no job the server remembers
+// made the image
+var ErrNotMade = errors.New("No job the server remembers made the image")
+
+// DeleteReport is the output data structure of the DeleteImage() function
+type DeleteReport struct {
+	// the job that made the image
+	Jobid int
+	// every image that was deleted: the one asked for and the other
+	// images its job made
+	Deleted []string
+}
+
+// The latest job that uploaded the named image, if the server remembers
+// one. It is an error if a job that makes the image is still running.
+func jobThatMade(uploadedName string) (entities.Job, bool, error) {
+	var made entities.Job
+	found := false
+	for _, job := range jobstore.AllJobs() {
+		for _, out := range job.Outputs {
+			if out.Uploaded_filename != uploadedName {
+				continue
+			}
+			if !job.Finished() {
+				return made, false, ErrJobRunning
+			}
+			if out.Status == "Done" {
+				made, found = job, true
+			}
+		}
+	}
+	return made, found, nil
+}
+
+// JobThatMade returns the latest job that uploaded the named image. It
+// is ErrNotMade if the server remembers no such job, and ErrJobRunning
+// if a job that makes the image has not finished.
+func JobThatMade(uploadedName string) (entities.Job, error) {
+	job, found, err := jobThatMade(uploadedName)
+	if err == nil && !found {
+		err = ErrNotMade
+	}
+	return job, err
+}
+
+// VariantsOf returns the names of the images that DeleteImage would
+// delete: the named image, and every other image uploaded by the job
+// that made it.
+func VariantsOf(uploadedName string) ([]string, error) {
+	job, found, err := jobThatMade(uploadedName)
+	if err != nil || !found {
+		return []string{uploadedName}, err
+	}
+	return variants(job, uploadedName), nil
+}
+
+func variants(job entities.Job, uploadedName string) []string {
+	names := []string{uploadedName}
+	for _, out := range job.Outputs {
+		if out.Status == "Done" && out.Uploaded_filename != uploadedName {
+			names = append(names, out.Uploaded_filename)
+		}
+	}
+	return names
+}
+
+// DeleteImage removes the named image from the Uploader, along with the
+// other images uploaded by the job that made it. That job's outputs are
+// recorded as "Deleted", or "Error deleting" if they could not be, and
+// so is the job. An image that no remembered job made is not deleted.
+func DeleteImage(uploadedName string) (DeleteReport, error) {
+	report := DeleteReport{Jobid: -1}
+	deleter, ok := uploader.(Deleter)
+	if !ok {
+		return report, ErrCannotDelete
+	}
+	job, err := JobThatMade(uploadedName)
+	if err != nil {
+		return report, err
+	}
+	report.Jobid = job.Id
+	results := map[string]error{}
+	var failure error
+	for _, name := range variants(job, uploadedName) {
+		err := deleter.Delete(name)
+		results[name] = err
+		if err != nil {
+			if failure == nil {
+				failure = err
+			}
+			continue
+		}
+		report.Deleted = append(report.Deleted, name)
+	}
+	recordDeletion(job, results, failure)
+	return report, failure
+}
+
+// Records in the job which of its outputs were deleted and which could
+// not be. The job fails with the first error, or keeps the error it had.
+func recordDeletion(job entities.Job, results map[string]error, failure error) {
+	outputs := make([]entities.OutputStatus, len(job.Outputs))
+	copy(outputs, job.Outputs)
+	for i := range outputs {
+		err, tried := results[outputs[i].Uploaded_filename]
+		switch {
+		case !tried:
+		case err != nil:
+			outputs[i].Status, outputs[i].Err = "Error deleting", err
+		default:
+			outputs[i].Status, outputs[i].Err = "Deleted", nil
+		}
+	}
+	job.Outputs = outputs
+	if failure != nil {
+		job.Err = failure
+		saveNewStatus(job, "Error deleting")
+		return
+	}
+	saveNewStatus(job, "Deleted")
+}
@@ -0,0 +1,158 @@
+/*
+Copyright 2014 Helix Digital
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"errors"
+	"image"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/helixdigital/imageserver/plugin/upload"
+)
+
+// An Uploader that remembers every image it deletes, and fails to
+// delete those in refuse
+type deletingUpload struct {
+	upload.MockUpload
+	lock    sync.Mutex
+	deleted []string
+	refuse  map[string]bool
+}
+
+func (self *deletingUpload) Delete(uplname string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.refuse[uplname] {
+		return errors.New("AccessDenied")
+	}
+	self.deleted = append(self.deleted, uplname)
+	return nil
+}
+
+// Runs a job that makes large.png and avatar.png
+func runJobToDelete(t *testing.T, deleting *deletingUpload) int {
+	setupJobTest(deleting)
+	MakeGrayFile(100, 100, "/tmp/delete.png")
+	defer os.Remove("/tmp/delete.png")
+	jobid, _ := NewJob(JobRequest{
+		Local_filename: "/tmp/delete.png",
+		Outputs: []Output{
+			{Crop_to: image.Rect(0, 0, 100, 100), Uploaded_filename: "large.png"},
+			{Crop_to: image.Rect(25, 25, 75, 75), Uploaded_filename: "avatar.png"},
+		},
+	})
+	assertJobEndedWith(t, jobid, "Done")
+	return jobid
+}
+
+func TestDeleteImageAndItsVariants(t *testing.T) {
+	deleting := &deletingUpload{}
+	jobid := runJobToDelete(t, deleting)
+
+	report, err := DeleteImage("avatar.png")
+	if err != nil {
+		t.Fatal("Deleting unexpectedly threw", err)
+	}
+	expected := []string{"avatar.png", "large.png"}
+	if report.Jobid != jobid || !reflect.DeepEqual(report.Deleted, expected) || !reflect.DeepEqual(deleting.deleted, expected) {
+		t.Error("Both images of the job should have been deleted but report was", report, "and deleted", deleting.deleted)
+	}
+	job, _ := GetJob(jobid)
+	if job.Status != "Deleted" || job.Outputs[0].Status != "Deleted" || job.Outputs[1].Status != "Deleted" {
+		t.Error("The job and its outputs should have been recorded as 'Deleted' but were", job.Status, job.Outputs)
+	}
+	if !job.Finished() {
+		t.Error("A deleted job should have been finished")
+	}
+
+	deleting.deleted = nil
+	if _, err := DeleteImage("avatar.png"); err != ErrNotMade || len(deleting.deleted) != 0 {
+		t.Error("Deleting again should have thrown ErrNotMade and deleted nothing but threw", err, "and deleted", deleting.deleted)
+	}
+}
+
+func TestDeleteImageNoJobMade(t *testing.T) {
+	deleting := &deletingUpload{}
+	setupJobTest(deleting)
+	report, err := DeleteImage("old/avatar.png")
+	if err != ErrNotMade || report.Jobid != -1 || len(deleting.deleted) != 0 {
+		t.Error("An image no job made should not have been deleted but report was", report, err)
+	}
+}
+
+func TestDeleteImageKeepsTheJobError(t *testing.T) {
+	deleting := &deletingUpload{}
+	jobid := runJobToDelete(t, deleting)
+	job, _ := GetJob(jobid)
+	job.Err = errors.New("An earlier failure")
+	jobstore.Replace(jobid, job)
+
+	if _, err := DeleteImage("avatar.png"); err != nil {
+		t.Fatal("Deleting unexpectedly threw", err)
+	}
+	if job, _ := GetJob(jobid); job.Err == nil || job.Err.Error() != "An earlier failure" {
+		t.Error("A successful deletion should have kept the job's error but it became", job.Err)
+	}
+}
+
+func TestDeleteImageFailing(t *testing.T) {
+	deleting := &deletingUpload{refuse: map[string]bool{"large.png": true}}
+	jobid := runJobToDelete(t, deleting)
+
+	report, err := DeleteImage("avatar.png")
+	if err == nil || err.Error() != "AccessDenied" {
+		t.Error("A refused deletion should have thrown its error but threw", err)
+	}
+	if !reflect.DeepEqual(report.Deleted, []string{"avatar.png"}) {
+		t.Error("Only avatar.png should have been deleted but", report.Deleted, "were")
+	}
+	job, _ := GetJob(jobid)
+	if job.Status != "Error deleting" || job.Err == nil || job.Outputs[0].Status != "Error deleting" || job.Outputs[1].Status != "Deleted" {
+		t.Error("The job should have recorded which deletion failed but was", job.Status, job.Outputs)
+	}
+}
+
+func TestDeleteImageOfRunningJob(t *testing.T) {
+	blocking := &blockingUpload{started: make(chan bool), release: make(chan bool)}
+	setupJobTest(blocking)
+	MakeGrayFile(100, 100, "/tmp/running.png")
+	defer os.Remove("/tmp/running.png")
+	jobid, _ := NewJob(JobRequest{
+		Local_filename:    "/tmp/running.png",
+		Crop_to:           image.Rect(0, 0, 50, 50),
+		Uploaded_filename: "running.png",
+	})
+	<-blocking.started
+	if _, err := DeleteImage("running.png"); err != ErrJobRunning {
+		t.Error("Deleting an image that is being made should have thrown ErrJobRunning but threw", err)
+	}
+	if blocking.WasDeleted {
+		t.Error("An image that is being made should not have been deleted")
+	}
+	blocking.release <- true
+	assertJobEndedWith(t, jobid, "Done")
+}
+
+func TestDeleteImageNeedsDeleter(t *testing.T) {
+	setupJobTest(failingUpload{})
+	if _, err := DeleteImage("avatar.png"); err != ErrCannotDelete {
+		t.Error("Deleting without a Deleter should have thrown ErrCannotDelete but threw", err)
+	}
+}
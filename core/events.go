@@ -0,0 +1,110 @@
+/*
+Copyright 2014 Helix Digital
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"sync"
+	"time"
+
+	"github.com/helixdigital/imageserver/entities"
+)
+
+// Event is one change in the status of a job, as recorded by its watcher
+type Event struct {
+	Jobid  int
+	Status string
+	Error  string
+	// the Uploaded_filename of the output whose status changed, or empty
+	// if the status of the whole job changed
+	Output string
+	Time   time.Time
+	// true for the last event of a job
+	Final bool
+	// the id of the API key the job was requested with, if any
+	Client string
+}
+
+// AllJobs can be passed to Subscribe to receive the events of every job
+const AllJobs = -1
+
+// How many events a subscriber can fall behind by before further
+// events to it are dropped
+const subscriberBuffer = 256
+
+type subscriber struct {
+	jobid  int
+	events chan Event
+}
+
+var subscribers = make(map[*subscriber]bool)
+var subscribers_lock sync.Mutex
+
+// Subscribe returns a channel that receives every Event of the job with
+// the given jobid, or of every job if jobid is AllJobs, and a function
+// that must be called to unsubscribe. Events that happened before
+// subscribing are not sent. A subscriber that does not keep up misses
+// events rather than holding up the jobs.
+func Subscribe(jobid int) (<-chan Event, func()) {
+	sub := &subscriber{jobid: jobid, events: make(chan Event, subscriberBuffer)}
+	subscribers_lock.Lock()
+	subscribers[sub] = true
+	subscribers_lock.Unlock()
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() {
+			subscribers_lock.Lock()
+			delete(subscribers, sub)
+			subscribers_lock.Unlock()
+		})
+	}
+	return sub.events, unsubscribe
+}
+
+// Sends the event to each interested subscriber without blocking
+func publish(ev Event) {
+	subscribers_lock.Lock()
+	defer subscribers_lock.Unlock()
+	for sub := range subscribers {
+		if sub.jobid != AllJobs && sub.jobid != ev.Jobid {
+			continue
+		}
+		select {
+		case sub.events <- ev:
+		default:
+		}
+	}
+}
+
+// Publishes the current status of the job or of one of its outputs
+func publishStatus(job entities.Job, output string) {
+	ev := Event{
+		Jobid:  job.Id,
+		Status: job.Status,
+		Error:  errorText(job.Err),
+		Output: output,
+		Time:   job.Modified,
+		Final:  output == "" && job.Finished(),
+		Client: job.Client,
+	}
+	for _, out := range job.Outputs {
+		if output != "" && out.Uploaded_filename == output {
+			ev.Status = out.Status
+			ev.Error = errorText(out.Err)
+		}
+	}
+	publish(ev)
+}
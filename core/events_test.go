@@ -0,0 +1,122 @@
+/*
+Copyright 2014 Helix Digital
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"image"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/helixdigital/imageserver/plugin/upload"
+)
+
+func TestSubscribeSeesEveryStatus(t *testing.T) {
+	setupJobTest(upload.NewMock())
+	MakeGrayFile(100, 100, "/tmp/events.png")
+	defer os.Remove("/tmp/events.png")
+	events, unsubscribe := Subscribe(AllJobs)
+	defer unsubscribe()
+
+	jobid, _ := NewJob(JobRequest{
+		Local_filename:    "/tmp/events.png",
+		Crop_to:           image.Rect(0, 0, 50, 50),
+		Uploaded_filename: "events.png",
+	})
+	statuses := collectStatuses(t, events, jobid)
+	expected := []string{
+		"Queued",
+		"Checking the file",
+		"Reading the file",
+		"Decoding the file",
+		"events.png: Cropping",
+		"events.png: Resizing",
+		"events.png: Uploading",
+		"events.png: Done",
+		"Done",
+	}
+	if !reflect.DeepEqual(statuses, expected) {
+		t.Error("Should have seen", expected, "but saw", statuses)
+	}
+}
+
+func TestSubscribeToOneJob(t *testing.T) {
+	setupJobTest(upload.NewMock())
+	MakeGrayFile(100, 100, "/tmp/events.png")
+	defer os.Remove("/tmp/events.png")
+	req := JobRequest{
+		Local_filename:    "/tmp/events.png",
+		Crop_to:           image.Rect(0, 0, 50, 50),
+		Uploaded_filename: "events.png",
+	}
+	events, unsubscribe := Subscribe(1)
+	defer unsubscribe()
+
+	other, _ := NewJob(req)
+	jobid, _ := NewJob(req)
+	for {
+		select {
+		case ev := <-events:
+			if ev.Jobid != jobid {
+				t.Error("Should only have seen events of job", jobid, "but saw one of job", ev.Jobid)
+			}
+			if !ev.Final {
+				continue
+			}
+		case <-time.After(2 * time.Second):
+			t.Error("Did not see the final event")
+		}
+		break
+	}
+	assertJobEndedWith(t, other, "Done")
+}
+
+func TestUnsubscribe(t *testing.T) {
+	_, unsubscribe := Subscribe(AllJobs)
+	before := len(subscribers)
+	unsubscribe()
+	unsubscribe()
+	if len(subscribers) != before-1 {
+		t.Error("Unsubscribing should have removed the subscriber")
+	}
+}
+
+// Reads the events of the job until its final one. Events about an
+// output are given as "output: status".
+func collectStatuses(t *testing.T, events <-chan Event, jobid int) []string {
+	statuses := make([]string, 0)
+	for {
+		select {
+		case ev := <-events:
+			if ev.Jobid != jobid {
+				continue
+			}
+			if ev.Output != "" {
+				statuses = append(statuses, ev.Output+": "+ev.Status)
+			} else {
+				statuses = append(statuses, ev.Status)
+			}
+			if ev.Final {
+				return statuses
+			}
+		case <-time.After(2 * time.Second):
+			t.Error("Did not see the final event, only", statuses)
+			return statuses
+		}
+	}
+}
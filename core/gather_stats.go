@@ -23,6 +23,8 @@ import "time"
 type StorageReporter interface {
 	TotalCount() int
 	CountByStatus() map[string]int
+	PurgedCount() int
+	CountByClient() map[string]int
 }
 
 var reporter StorageReporter
@@ -32,8 +34,8 @@ func InjectStorageReporter(storagereporter StorageReporter) {
 	reporter = storagereporter
 }
 
-// TotalCount gives the number of jobs run on the server since
-// it started.
+// TotalCount gives the number of jobs the server remembers. Purged
+// jobs are no longer counted, so add PurgedCount for every job run.
 func TotalCount() int {
 	return reporter.TotalCount()
 }
@@ -44,8 +46,21 @@ func CountByStatus() map[string]int {
 	return reporter.CountByStatus()
 }
 
+// CountByClient returns the number of jobs partitioned by the id of
+// the API key they were requested with. Jobs requested without a key
+// are not counted, and neither are purged jobs.
+func CountByClient() map[string]int {
+	return reporter.CountByClient()
+}
+
 var starttime = time.Now()
 
+// PurgedCount returns the number of finished jobs that have been
+// thrown away to make room or because they were too old
+func PurgedCount() int {
+	return reporter.PurgedCount()
+}
+
 // SecondsUp is the difference between the current time and
 // the time this server was started
 func SecondsUp() int {
@@ -57,10 +72,22 @@ type Stats struct {
 	SecondsUp     int
 	TotalCount    int
 	CountByStatus map[string]int
+	CountByClient map[string]int
+	Purged        int
+	QueueDepth    int
+	ActiveWorkers int
 }
 
 // GetStats returns some basic statistics
 // of the current state of this server
 func GetStats() Stats {
-	return Stats{SecondsUp(), TotalCount(), CountByStatus()}
+	return Stats{
+		SecondsUp:     SecondsUp(),
+		TotalCount:    TotalCount(),
+		CountByStatus: CountByStatus(),
+		CountByClient: CountByClient(),
+		Purged:        PurgedCount(),
+		QueueDepth:    QueueDepth(),
+		ActiveWorkers: ActiveWorkers(),
+	}
 }
@@ -0,0 +1,119 @@
+/*
+Copyright 2014 Helix Digital
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// ErrOutsideRoots is the error of a job whose Local_filename is not in
+// one of the input roots
+var ErrOutsideRoots = errors.New("The file is not in an allowed input directory")
+
+var inputroots []string
+
+// The input roots as they were named, made absolute and clean
+var namedroots []string
+
+// InjectInputRoots is the setter for the directories that jobs may read
+// their Local_filename from. While there are none a job may read any
+// file. Each root must exist. Symlinks in the roots are resolved here,
+// once.
+func InjectInputRoots(roots []string) error {
+	resolved := make([]string, 0, len(roots))
+	named := make([]string, 0, len(roots))
+	for _, root := range roots {
+		real, err := resolveRoot(root)
+		if err != nil {
+			return fmt.Errorf("Bad input root %s: %s", root, err)
+		}
+		abs, _ := filepath.Abs(root)
+		named = append(named, abs)
+		resolved = append(resolved, real)
+	}
+	inputroots = resolved
+	namedroots = named
+	return nil
+}
+
+// executes the checkTheFile part of the job. Decides which file the
+// job will read, unless it has a Source_url and reads no file: the
+// spooled input if there is one, otherwise the
+// Local_filename with every symlink resolved. If there are input roots,
+// the Local_filename must be in one of them, both as it is named (under
+// the root as named or resolved) and once its symlinks are resolved.
+func checkTheFile(run *jobRun) error {
+	if run.req.Source_url != "" {
+		return nil
+	}
+	if run.req.Spooled_input != "" {
+		filename, err := spooledFile(run.req.Spooled_input)
+		run.filename = filename
+		return err
+	}
+	run.filename = run.req.Local_filename
+	if len(inputroots) == 0 {
+		return nil
+	}
+	name := run.req.Local_filename
+	if !filepath.IsAbs(name) || hasParentRef(name) || !(inRoots(name, namedroots) || inRoots(name, inputroots)) {
+		return ErrOutsideRoots
+	}
+	resolved, err := filepath.EvalSymlinks(name)
+	if err != nil {
+		// Reading the file will fail with the reason
+		return nil
+	}
+	if !inRoots(resolved, inputroots) {
+		return ErrOutsideRoots
+	}
+	run.filename = resolved
+	return nil
+}
+
+// The absolute path of the root with every symlink resolved
+func resolveRoot(root string) (string, error) {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(abs)
+}
+
+// Whether the name has a `..` element
+func hasParentRef(name string) bool {
+	for _, part := range strings.Split(filepath.ToSlash(name), "/") {
+		if part == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the cleaned name is one of the roots or is inside one of them
+func inRoots(name string, roots []string) bool {
+	name = filepath.Clean(name)
+	for _, root := range roots {
+		if name == root || strings.HasPrefix(name, strings.TrimSuffix(root, string(filepath.Separator))+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
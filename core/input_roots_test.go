@@ -0,0 +1,127 @@
+/*
+Copyright 2014 Helix Digital
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"image"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/helixdigital/imageserver/plugin/upload"
+)
+
+// Makes an input root holding in.png, and a file outside it
+func setupInputRootTest(t *testing.T) (string, string) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "uploads")
+	os.Mkdir(root, 0755)
+	MakeGrayFile(100, 100, filepath.Join(root, "in.png"))
+	outside := filepath.Join(dir, "secret.png")
+	MakeGrayFile(100, 100, outside)
+	if err := InjectInputRoots([]string{root}); err != nil {
+		t.Fatal("InjectInputRoots unexpectedly threw an error", err)
+	}
+	return root, outside
+}
+
+func runJobOn(filename string, mock *upload.MockUpload) int {
+	setupJobTest(mock)
+	jobid, _ := NewJob(JobRequest{
+		Local_filename:    filename,
+		Crop_to:           image.Rect(0, 0, 50, 50),
+		Uploaded_filename: "out.png",
+	})
+	return jobid
+}
+
+func TestInputInsideRootIsRead(t *testing.T) {
+	root, _ := setupInputRootTest(t)
+	defer InjectInputRoots(nil)
+
+	mock := upload.NewMock()
+	assertJobEndedWith(t, runJobOn(filepath.Join(root, "in.png"), mock), "Done")
+	if !mock.WasCalled {
+		t.Error("A file inside the root should have been uploaded")
+	}
+}
+
+func TestInputOutsideRootIsRefused(t *testing.T) {
+	root, outside := setupInputRootTest(t)
+	defer InjectInputRoots(nil)
+	os.Symlink(outside, filepath.Join(root, "link.png"))
+	os.Symlink(filepath.Dir(outside), filepath.Join(root, "linkdir"))
+
+	tests := map[string]string{
+		"absolute path outside": outside,
+		"traversal":             filepath.Join(root, "..", "secret.png"),
+		"unclean traversal":     root + "/../secret.png",
+		"traversal back inside": root + "/../uploads/in.png",
+		"relative path":         "uploads/in.png",
+		"symlinked file":        filepath.Join(root, "link.png"),
+		"symlinked directory":   filepath.Join(root, "linkdir", "secret.png"),
+		"root prefix":           root + "-other/in.png",
+	}
+	for name, filename := range tests {
+		mock := upload.NewMock()
+		jobid := runJobOn(filename, mock)
+		assertJobEndedWith(t, jobid, "Error file not allowed")
+		if job, _ := GetJob(jobid); job.Err != ErrOutsideRoots {
+			t.Error(name, "should have failed with ErrOutsideRoots but failed with", job.Err)
+		}
+		if mock.WasCalled {
+			t.Error(name, "should not have been uploaded")
+		}
+	}
+}
+
+func TestSymlinkInsideRootIsRead(t *testing.T) {
+	root, _ := setupInputRootTest(t)
+	defer InjectInputRoots(nil)
+	os.Symlink(filepath.Join(root, "in.png"), filepath.Join(root, "alias.png"))
+
+	assertJobEndedWith(t, runJobOn(filepath.Join(root, "alias.png"), upload.NewMock()), "Done")
+}
+
+func TestRootNamedThroughASymlink(t *testing.T) {
+	root, outside := setupInputRootTest(t)
+	defer InjectInputRoots(nil)
+	link := filepath.Join(filepath.Dir(root), "uploads-link")
+	os.Symlink(root, link)
+	if err := InjectInputRoots([]string{link}); err != nil {
+		t.Fatal("InjectInputRoots unexpectedly threw an error", err)
+	}
+
+	assertJobEndedWith(t, runJobOn(filepath.Join(link, "in.png"), upload.NewMock()), "Done")
+	assertJobEndedWith(t, runJobOn(filepath.Join(root, "in.png"), upload.NewMock()), "Done")
+	assertJobEndedWith(t, runJobOn(outside, upload.NewMock()), "Error file not allowed")
+	assertJobEndedWith(t, runJobOn(link+"/../secret.png", upload.NewMock()), "Error file not allowed")
+}
+
+func TestMissingInputInsideRoot(t *testing.T) {
+	root, _ := setupInputRootTest(t)
+	defer InjectInputRoots(nil)
+
+	assertJobEndedWith(t, runJobOn(filepath.Join(root, "missing.png"), upload.NewMock()), "Error reading the file")
+}
+
+func TestInjectInputRootsNeedsExistingRoots(t *testing.T) {
+	if err := InjectInputRoots([]string{"/no/such/root"}); err == nil {
+		t.Error("A root that does not exist should have thrown an error")
+	}
+	InjectInputRoots(nil)
+}
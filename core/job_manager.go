@@ -17,12 +17,14 @@ limitations under the License.
 package core
 
 import (
-	"bytes"
+	"errors"
 	"fmt"
 	"image"
 	"io"
 	"os"
+	"path"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/helixdigital/imageserver/entities"
@@ -32,6 +34,12 @@ import (
 type JobRequest struct {
 	// The filename of the image that will be cropped, resized and uploaded
 	Local_filename string
+	// The name SpoolInput gave an image sent with the request. If set it
+	// is used instead of Local_filename, and is removed when the job stops.
+	Spooled_input string
+	// An http or https URL to fetch the image from instead of reading
+	// Local_filename
+	Source_url string
 	// the coordinates and dimensions of the part of the input image to crop to
 	Crop_to image.Rectangle
 	// The width in pixels to resize the cropped image to before uploading.
@@ -40,8 +48,66 @@ type JobRequest struct {
 	// The height in pixels to resize the cropped image to before uploading.
 	// Leave as 0 and set resize_width to keep aspect ratio
 	Resize_height uint
+	// "jpg", "png" or "gif". If empty it is the format named by the
+	// extension of Uploaded_filename, or failing that of the input.
+	Format string
 	// The name that the cropped and resized image will be stored on S3 as.
 	Uploaded_filename string
+	// More than one image can be made from the one input file. If this
+	// is not empty, each Output is cropped, resized and uploaded in turn
+	// and the Crop_to, Resize_ and Uploaded_filename fields above are
+	// ignored.
+	Outputs []Output
+	// If not empty, this URL is sent a Notification when the job finishes
+	Callback_url string
+	// The id of the API key the job was requested with, if any
+	Client string
+	// How the images are to be served. Blank fields are taken from the
+	// options given to InjectUploadDefaults.
+	Upload_options entities.UploadOptions
+}
+
+// Output describes one of the images that a job makes from its input
+type Output struct {
+	// the coordinates and dimensions of the part of the input image to crop to
+	Crop_to image.Rectangle
+	// Leave as 0 and set Resize_height to keep aspect ratio
+	Resize_width uint
+	// Leave as 0 and set Resize_width to keep aspect ratio
+	Resize_height uint
+	// "jpg", "png" or "gif". If empty it is the format named by the
+	// extension of Uploaded_filename, or failing that of the input.
+	Format string
+	// The name that this image will be stored on S3 as.
+	Uploaded_filename string
+}
+
+// CheckOutputs returns an error if two of the images the job makes have
+// the same Uploaded_filename. Their statuses would be recorded as one,
+// and one upload would replace the other.
+func (self JobRequest) CheckOutputs() error {
+	seen := make(map[string]bool)
+	for _, out := range self.outputs() {
+		if seen[out.Uploaded_filename] {
+			return fmt.Errorf("uploaded_filename %s is given more than once", out.Uploaded_filename)
+		}
+		seen[out.Uploaded_filename] = true
+	}
+	return nil
+}
+
+// The images this job makes. A request without Outputs makes one image.
+func (self JobRequest) outputs() []Output {
+	if len(self.Outputs) > 0 {
+		return self.Outputs
+	}
+	return []Output{{
+		Crop_to:           self.Crop_to,
+		Resize_width:      self.Resize_width,
+		Resize_height:     self.Resize_height,
+		Format:            self.Format,
+		Uploaded_filename: self.Uploaded_filename,
+	}}
 }
 
 var jobstore entities.JobStore
@@ -53,9 +119,23 @@ func InjectJobstore(store entities.JobStore) {
 
 var uploader Uploader
 
-// Uploader is the plugin that will store the image on S3 - or whatever storage provider
+// Uploader is the plugin that will store the image on S3 - or whatever storage provider.
+// It is given the image as it is encoded, its size in bytes or -1 if it
+// is not known, its mime type, the name to store it as, and how it is
+// to be served. An error reading the image fails the upload.
+//
+// A failed upload is tried again, as the RetryPolicy allows, unless the
+// Uploader returns an entities.UploadError that is not Temporary.
 type Uploader interface {
-	Upload([]byte, string, string) error
+	Upload(io.Reader, int64, string, string, entities.UploadOptions) error
+}
+
+// FanOutUploader is implemented by Uploaders that send each image to
+// more than one destination. UploadToEach also says how each one fared,
+// which is recorded on the job.
+type FanOutUploader interface {
+	Uploader
+	UploadToEach(io.Reader, int64, string, string, entities.UploadOptions) ([]entities.DestinationStatus, error)
 }
 
 // The setter for the current uploader
@@ -63,150 +143,559 @@ func InjectUploader(upl Uploader) {
 	uploader = upl
 }
 
-// NewJob takes a JobRequest and starts executing
-// it. It returns a jobid that can later be used
-// to query the status of job's progress.
-func NewJob(req JobRequest) int {
+var uploadDefaults entities.UploadOptions
+
+// The setter for the options that images are uploaded with when a job
+// does not give its own
+func InjectUploadDefaults(options entities.UploadOptions) {
+	uploadDefaults = options
+}
+
+var fetcher Fetcher
+
+// Fetcher is the plugin that gets the image of a job with a Source_url.
+// It returns the image and its mime type.
+type Fetcher interface {
+	Fetch(string) (io.ReadCloser, string, error)
+}
+
+// The setter for the current fetcher. Without one jobs cannot have a
+// Source_url.
+func InjectFetcher(f Fetcher) {
+	fetcher = f
+}
+
+// NewJob takes a JobRequest and puts it in the queue
+// to be executed. It returns a jobid that can later
+// be used to query the status of job's progress, or
+// ErrQueueFull if there is no room in the queue. A request that fails
+// CheckOutputs is refused.
+func NewJob(req JobRequest) (int, error) {
+	if err := req.CheckOutputs(); err != nil {
+		DiscardSpooled(req.Spooled_input)
+		return -1, err
+	}
 	jobid := jobstore.AssignFreeId()
-	c := startOneJob(req)
-	jobstore.AddJob(entities.CreateJob(jobid, c))
-	go startJobWatcher(jobid)
-	return jobid
+	run := newJobRun(jobid, req)
+	// one for the pipeline and one for the watcher
+	running.Add(2)
+	if !enqueue(run) {
+		running.Add(-2)
+		forgetCancel(jobid)
+		DiscardSpooled(req.Spooled_input)
+		return -1, ErrQueueFull
+	}
+	job := entities.CreateJob(jobid, run.status)
+	job.Status = "Queued"
+	job.Client = req.Client
+	for _, out := range req.outputs() {
+		job.Outputs = append(job.Outputs, entities.OutputStatus{
+			Uploaded_filename: out.Uploaded_filename,
+			Status:            "Queued",
+		})
+	}
+	jobstore.AddJob(job)
+	publishStatus(job, "")
+	go startJobWatcher(run)
+	return jobid, nil
 }
 
-func startJobWatcher(jobid int) {
-	job, _ := jobstore.GetJob(jobid)
+// Counts the pipelines and watchers of the jobs that have not stopped,
+// so that tests can wait for them before swapping the plugins
+var running sync.WaitGroup
+
+// How long the watcher waits for the next status msg before it gives
+// up on a job
+var jobtimeout = 20 * time.Minute
+
+// Records each status msg of the job in the jobstore until the job
+// reports that it has stopped, or until it has been silent for longer
+// than jobtimeout. When the watcher returns it closes run.abandoned so
+// that the pipeline never blocks sending to it.
+//
+// A msg about one of the job's outputs updates that output. Its
+// progress is also the progress of the whole job, but its success or
+// failure does not end the job.
+func startJobWatcher(run *jobRun) {
+	defer running.Done()
+	defer close(run.abandoned)
+	job, _ := jobstore.GetJob(run.id)
 	for {
 		select {
-		case msg := <-job.Statuschan:
+		case msg := <-run.status:
+			if msg.Source != nil {
+				job.Source = *msg.Source
+			}
+			if msg.Output != "" {
+				job = saveOutputStatus(job, msg)
+				continue
+			}
 			switch msg.Statuscode {
 			case 100:
-				saveNewStatus(job, msg.Status)
-			case 200:
-				saveNewStatus(job, msg.Status)
+				job = saveNewStatus(job, msg.Status)
+			case 200, 499:
+				notifyFinished(run.req, saveNewStatus(job, msg.Status))
 				return
 			case 400:
 				job.Err = msg.Err
-				saveNewStatus(job, msg.Status)
+				notifyFinished(run.req, saveNewStatus(job, msg.Status))
 				return
 			}
-		case <-time.After(20 * time.Minute):
+		case <-time.After(jobtimeout):
 			job.Err = fmt.Errorf("Timed out after %s", job.Status)
-			saveNewStatus(job, "Timed out")
+			notifyFinished(run.req, saveNewStatus(job, "Timed out"))
 			return
 		}
 	}
 }
 
-func saveNewStatus(job entities.Job, status string) {
+func saveNewStatus(job entities.Job, status string) entities.Job {
 	job.Status = status
-	jobstore.Replace(job.Id, job)
+	job = replaceJob(job)
+	publishStatus(job, "")
+	return job
 }
 
-// executes the job. Returns a channel which sends
-// a msg each time the status changes
-func startOneJob(req JobRequest) <-chan entities.StatusMsg {
-	statuschannel := make(chan entities.StatusMsg)
-	go func() {
-		inputreader := readTheFile(req, statuschannel)
-		defer inputreader.Close()
-		original_image := getImage(req, inputreader, statuschannel)
+// Stores the job and returns it as stored, with its Modified time set
+// by the jobstore. The job is read back from the store it was put in.
+func replaceJob(job entities.Job) entities.Job {
+	store := jobstore
+	store.Replace(job.Id, job)
+	if stored, ok := store.GetJob(job.Id); ok {
+		return stored
+	}
+	return job
+}
 
-		cropped_image := cropImage(req, original_image, statuschannel)
+// The Outputs are copied, not changed in place, because copies of the
+// job handed out by the jobstore share them.
+func saveOutputStatus(job entities.Job, msg entities.StatusMsg) entities.Job {
+	outputs := make([]entities.OutputStatus, len(job.Outputs))
+	copy(outputs, job.Outputs)
+	for i := range outputs {
+		if outputs[i].Uploaded_filename == msg.Output {
+			outputs[i].Status = msg.Status
+			outputs[i].Err = msg.Err
+			if msg.Attempts > 0 {
+				outputs[i].Upload_attempts = msg.Attempts
+			}
+			if msg.Destinations != nil {
+				outputs[i].Destinations = msg.Destinations
+			}
+		}
+	}
+	job.Outputs = outputs
+	if msg.Statuscode == 100 {
+		job.Status = msg.Status
+	}
+	job = replaceJob(job)
+	publishStatus(job, msg.Output)
+	return job
+}
+
+// jobRun is the state of one job as it passes through the pipeline
+type jobRun struct {
+	id  int
+	req JobRequest
+	// the pipeline sends status msgs on this and the watcher receives them
+	status chan entities.StatusMsg
+	// closed when the job is cancelled
+	cancel <-chan struct{}
+	// closed when the watcher has stopped listening
+	abandoned chan struct{}
+
+	// the file that is read, once checkTheFile has approved it
+	filename string
+	input    io.ReadCloser
+	// the format of the input, which is used for outputs without a Format
+	inputformat entities.Format
+	decoded     entities.Image
+	// the input as it was decoded, sent with every msg once it is known
+	source *entities.SourceImage
+	// the output being made and the image as it is made
+	output Output
+	image  entities.Image
+	// how many times the output being made has been sent to the Uploader
+	attempts int
+	// how each destination fared in the last attempt, if the Uploader is
+	// a FanOutUploader
+	destinations []entities.DestinationStatus
+	// the names of the outputs that have been uploaded
+	uploaded []string
+}
+
+func newJobRun(jobid int, req JobRequest) *jobRun {
+	return &jobRun{
+		id:        jobid,
+		req:       req,
+		status:    make(chan entities.StatusMsg),
+		cancel:    cancellable(jobid),
+		abandoned: make(chan struct{}),
+	}
+}
+
+// Sends a status msg about the whole job to the watcher. Returns false,
+// without blocking, if the watcher has stopped listening.
+func (self *jobRun) send(code int, status string, err error) bool {
+	return self.sendMsg(entities.StatusMsg{Statuscode: code, Status: status, Err: err})
+}
+
+// Sends a status msg about the output currently being made
+func (self *jobRun) sendForOutput(code int, status string, err error) bool {
+	return self.sendMsg(entities.StatusMsg{
+		Statuscode:   code,
+		Status:       status,
+		Err:          err,
+		Output:       self.output.Uploaded_filename,
+		Attempts:     self.attempts,
+		Destinations: self.destinations,
+	})
+}
+
+func (self *jobRun) sendMsg(msg entities.StatusMsg) bool {
+	msg.Source = self.source
+	select {
+	case self.status <- msg:
+		return true
+	case <-self.abandoned:
+		return false
+	}
+}
 
-		resized_image := resizeImage(req, cropped_image, statuschannel)
+// stage is one step of the pipeline
+type stage struct {
+	// reported when the stage starts
+	status string
+	// reported when the stage returns an error
+	failure string
+	run     func(*jobRun) error
+}
 
-		uploadFile(req, resized_image, statuschannel)
+// The stages that are run once per job
+var pipeline = []stage{
+	{"Checking the file", "Error file not allowed", checkTheFile},
+	{"Reading the file", "Error reading the file", readTheFile},
+	{"Decoding the file", "Error decoding the file", getImage},
+}
 
-		statuschannel <- entities.StatusMsg{200, "Done", nil}
+// The stages that are run once for each output of the job
+var outputPipeline = []stage{
+	{"Cropping", "Error in cropping", cropImage},
+	{"Resizing", "Error in resizing", resizeImage},
+	{"Uploading", "Error in uploading", uploadFile},
+}
+
+// Executes each stage of the pipeline in turn, then the output stages
+// for each output. The first job stage to fail stops the job with that
+// stage's failure status. An output stage that fails stops only that
+// output, and the job ends with the first output failure once the other
+// outputs are made. Between stages the job stops if it has been
+// cancelled or if its watcher has gone away.
+func runPipeline(run *jobRun) {
+	defer forgetCancel(run.id)
+	defer DiscardSpooled(run.req.Spooled_input)
+	defer run.closeInput()
+	for _, st := range pipeline {
+		if stopIfCancelled(run) {
+			return
+		}
+		if !run.send(100, st.status, nil) {
+			return
+		}
+		if err := runStage(st, run); err != nil {
+			run.send(400, failureStatus(st, err), err)
+			return
+		}
+	}
+	run.decoded = run.image
+	var failure *entities.StatusMsg
+	for _, out := range run.req.outputs() {
+		run.output = out
+		run.image = run.decoded
+		run.attempts = 0
+		run.destinations = nil
+		msg, stopped := runOutputPipeline(run)
+		if stopped {
+			return
+		}
+		if msg != nil && failure == nil {
+			failure = msg
+		}
+	}
+	if stopIfCancelled(run) {
+		return
+	}
+	if failure != nil {
+		run.send(400, failure.Status, failure.Err)
+		return
+	}
+	run.send(200, "Done", nil)
+}
+
+// Makes and uploads the current output. Returns the failure msg if a
+// stage failed, and whether the whole job has stopped.
+func runOutputPipeline(run *jobRun) (*entities.StatusMsg, bool) {
+	for _, st := range outputPipeline {
+		if stopIfCancelled(run) {
+			return nil, true
+		}
+		if !run.sendForOutput(100, st.status, nil) {
+			return nil, true
+		}
+		if err := runStage(st, run); err != nil {
+			status := failureStatus(st, err)
+			msg := entities.StatusMsg{Statuscode: 400, Status: status, Err: err}
+			return &msg, !run.sendForOutput(400, status, err)
+		}
+	}
+	return nil, !run.sendForOutput(200, "Done", nil)
+}
+
+// The status a job ends with when the stage fails with err. An input
+// that is not a jpg, gif or png is "Unsupported format" whichever stage
+// finds it out.
+func failureStatus(st stage, err error) string {
+	if errors.Is(err, entities.ErrUnsupportedFormat) {
+		return "Unsupported format"
+	}
+	return st.failure
+}
+
+// Runs one stage, turning a panic in it into an error
+func runStage(st stage, run *jobRun) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%s: %v", st.status, r)
+		}
 	}()
-	return statuschannel
+	return st.run(run)
+}
+
+func (self *jobRun) closeInput() {
+	if self.input != nil {
+		self.input.Close()
+	}
 }
 
-// executes the readfile part of the job. Sends a msg on the statuschannel
-// when it starts or breaks
-func readTheFile(req JobRequest, statuschannel chan entities.StatusMsg) *os.File {
-	statuschannel <- entities.StatusMsg{100, "Reading the file", nil}
-	inputreader, err := os.Open(req.Local_filename)
+// Sends the "Cancelled" msg if the job has been cancelled, first removing
+// anything it had already uploaded. Returns whether the job should stop.
+func stopIfCancelled(run *jobRun) bool {
+	if !isCancelled(run.cancel) {
+		return false
+	}
+	for _, name := range run.uploaded {
+		if err := removeUploaded(name); err != nil {
+			run.send(400, "Error removing the cancelled upload", err)
+			return true
+		}
+	}
+	run.send(499, "Cancelled", nil)
+	return true
+}
+
+// executes the readfile part of the job, fetching the image if it has
+// a Source_url
+func readTheFile(run *jobRun) error {
+	if run.req.Source_url != "" {
+		return fetchTheFile(run)
+	}
+	inputreader, err := os.Open(run.filename)
 	if err != nil {
-		statuschannel <- entities.StatusMsg{400, "Error reading the file", err}
+		return err
 	}
-	return inputreader
+	run.input = inputreader
+	return nil
 }
 
-func getImage(req JobRequest, inputreader io.Reader, statuschannel chan entities.StatusMsg) entities.Image {
-	statuschannel <- entities.StatusMsg{100, "Decoding the file", nil}
-	img, err := entities.NewImage(inputreader, extension(req.Local_filename))
+// Fetches the image from its Source_url. The fetcher refuses a body that
+// is not a supported image with entities.ErrUnsupportedFormat, which ends
+// the job with "Unsupported format" rather than a reading error.
+func fetchTheFile(run *jobRun) error {
+	if fetcher == nil {
+		return errors.New("Fetching images from URLs is not enabled")
+	}
+	body, _, err := fetcher.Fetch(run.req.Source_url)
 	if err != nil {
-		statuschannel <- entities.StatusMsg{400, "Error decoding the file", err}
+		return err
 	}
-	return img
+	run.input = body
+	return nil
 }
 
-// executes the cropImage part of the job. Sends a msg on the statuschannel
-// when it starts or breaks
-func cropImage(req JobRequest, original_image entities.Image, statuschannel chan entities.StatusMsg) entities.Image {
-	statuschannel <- entities.StatusMsg{100, "Cropping", nil}
-	return original_image.CropTo(req.Crop_to)
+// executes the decoding part of the job. The format of the input is
+// recognised from its content, not from its name.
+func getImage(run *jobRun) error {
+	img, err := entities.NewImage(run.input)
+	if err != nil {
+		return err
+	}
+	bounds := img.Img.Bounds()
+	run.image = img
+	run.inputformat = img.Format
+	run.source = &entities.SourceImage{
+		Format: img.Format.String(),
+		Width:  bounds.Dx(),
+		Height: bounds.Dy(),
+	}
+	return nil
 }
 
-// executes the resizeImage part of the job. Sends a msg on the statuschannel
-// when it starts or breaks
-func resizeImage(req JobRequest, original_image entities.Image, statuschannel chan entities.StatusMsg) entities.Image {
-	statuschannel <- entities.StatusMsg{100, "Resizing", nil}
-	return original_image.ResizeTo(req.Resize_width, req.Resize_height)
+// executes the cropImage part of the job. The crop rectangle must be
+// inside the image. An empty one, as a `/request` without the crop
+// fields gives, leaves the image uncropped.
+func cropImage(run *jobRun) error {
+	if run.output.Crop_to.Empty() {
+		return nil
+	}
+	if err := checkCrop(run.image, run.output.Crop_to); err != nil {
+		return err
+	}
+	run.image = run.image.CropTo(run.output.Crop_to)
+	return nil
 }
 
-// executes the uploadFile part of the job. Sends a msg on the statuschannel
-// when it starts or breaks
-func uploadFile(req JobRequest, image_to_upload entities.Image, statuschannel chan entities.StatusMsg) {
-	statuschannel <- entities.StatusMsg{100, "Uploading", nil}
-	if err := sendToUploader(
-		image_to_upload.Reader(),
-		mimetype(req.Uploaded_filename),
-		req.Uploaded_filename,
-	); err != nil {
-		statuschannel <- entities.StatusMsg{400, "Error in uploading", err}
+func checkCrop(img entities.Image, crop image.Rectangle) error {
+	bounds := img.Img.Bounds()
+	if crop.Empty() || !crop.In(bounds) {
+		return fmt.Errorf("Cannot crop to %v in an image of %v", crop, bounds)
 	}
+	return nil
 }
 
-// Upload will store the given file on S3
-func sendToUploader(rdr io.Reader, mime string, uploadedName string) error {
-	var buf bytes.Buffer
-	if _, err := buf.ReadFrom(rdr); err != nil {
+// executes the resizeImage part of the job
+func resizeImage(run *jobRun) error {
+	run.image = run.image.ResizeTo(run.output.Resize_width, run.output.Resize_height)
+	return nil
+}
+
+// executes the uploadFile part of the job. The image is uploaded with
+// the mime type of the format it is encoded in.
+func uploadFile(run *jobRun) error {
+	format, err := outputFormat(run.output, run.inputformat)
+	if err != nil {
 		return err
 	}
-	return uploader.Upload(buf.Bytes(), mime, uploadedName)
+	run.image.Format = format
+	mime := run.image.Mime()
+	options := run.req.Upload_options.Over(uploadDefaults)
+	if err := options.Check(); err != nil {
+		return err
+	}
+	if err := uploadWithRetries(run, mime, options); err != nil {
+		return err
+	}
+	run.uploaded = append(run.uploaded, run.output.Uploaded_filename)
+	return nil
 }
 
-func mimetype(filename string) string {
-	ds := map[entities.Format]string{
-		entities.Jpg: "image/jpeg",
-		entities.Png: "image/png",
-		entities.Gif: "image/gif",
+// Upload will store the given image on S3. The image is encoded as the
+// uploader reads it, so it is never held in memory whole. An image that
+// cannot be encoded is a permanent error. If the uploader is a
+// FanOutUploader it also returns how each destination fared.
+func sendToUploader(img entities.Image, mime string, uploadedName string, options entities.UploadOptions) ([]entities.DestinationStatus, error) {
+	rdr, wtr := io.Pipe()
+	// stops the encoder if the uploader panics
+	defer rdr.Close()
+	encoded := make(chan error, 1)
+	go func() {
+		err := img.Encode(wtr)
+		wtr.CloseWithError(err)
+		encoded <- err
+	}()
+	var destinations []entities.DestinationStatus
+	var err error
+	if fanout, ok := uploader.(FanOutUploader); ok {
+		destinations, err = fanout.UploadToEach(rdr, -1, mime, uploadedName, options)
+	} else {
+		err = uploader.Upload(rdr, -1, mime, uploadedName, options)
+	}
+	// stops the encoder if the uploader gave up before reading it all
+	rdr.Close()
+	if encodeErr := <-encoded; encodeErr != nil && encodeErr != io.ErrClosedPipe {
+		return destinations, entities.PermanentUploadError(encodeErr)
 	}
-	return ds[extension(filename)]
+	return destinations, err
 }
 
-// JobStatus returns the current status of the job with the given jobid
-func JobStatus(jobid int) (string, error) {
+// The format an output is encoded as: the one it names, or else the one
+// the extension of its Uploaded_filename names, or else that of the input
+func outputFormat(out Output, input entities.Format) (entities.Format, error) {
+	if out.Format != "" {
+		return formatNamed(out.Format)
+	}
+	if format, ok := formatOfExtension(out.Uploaded_filename); ok {
+		return format, nil
+	}
+	return input, nil
+}
+
+// The format named by the extension of name, if it has one that does
+func formatOfExtension(name string) (entities.Format, bool) {
+	ext := path.Ext(name)
+	if ext == "" {
+		return entities.Png, false
+	}
+	format, err := formatNamed(ext[1:])
+	return format, err == nil
+}
+
+// Converts the name of a format given in an Output into a Format
+func formatNamed(name string) (entities.Format, error) {
+	switch strings.ToLower(name) {
+	case "jpg", "jpeg":
+		return entities.Jpg, nil
+	case "gif":
+		return entities.Gif, nil
+	case "png":
+		return entities.Png, nil
+	}
+	return entities.Png, fmt.Errorf("Unknown format %s", name)
+}
+
+// GetJob returns the job with the given jobid
+func GetJob(jobid int) (entities.Job, error) {
 	job, ok := jobstore.GetJob(jobid)
 	if !ok {
-		return fmt.Sprintf("No job found with id %d", jobid), fmt.Errorf("No job found with id %d", jobid)
+		return job, fmt.Errorf("No job found with id %d", jobid)
+	}
+	return job, nil
+}
+
+// ListJobs returns every job the server remembers, in order of jobid
+func ListJobs() []entities.Job {
+	return jobstore.AllJobs()
+}
+
+// URLer is implemented by Uploaders that can say where an uploaded
+// image can be fetched from
+type URLer interface {
+	URL(string) string
+}
+
+// OutputURL is where the image uploaded with the given name can be
+// fetched from, or empty if the Uploader cannot say
+func OutputURL(uploadedName string) string {
+	urler, ok := uploader.(URLer)
+	if !ok {
+		return ""
 	}
-	return job.Status, job.Err
+	return urler.URL(uploadedName)
+}
+
+// JobReport is the output data structure of the JobStatus() function
+type JobReport struct {
+	// the status of the whole job
+	Status string
+	// the status of each image the job makes
+	Outputs []entities.OutputStatus
 }
 
-func extension(input string) entities.Format {
-	lastdot := strings.LastIndex(input, ".")
-	ext := strings.ToLower(input[lastdot:])
-	switch ext {
-	case ".jpeg", ".jpg":
-		return entities.Jpg
-	case ".gif":
-		return entities.Gif
-	case ".png":
-		return entities.Png
+// JobStatus returns the current status of the job with the given jobid
+// and of each of the images it makes
+func JobStatus(jobid int) (JobReport, error) {
+	job, ok := jobstore.GetJob(jobid)
+	if !ok {
+		return JobReport{Status: fmt.Sprintf("No job found with id %d", jobid)}, fmt.Errorf("No job found with id %d", jobid)
 	}
-	return entities.Png
+	return JobReport{Status: job.Status, Outputs: job.Outputs}, job.Err
 }
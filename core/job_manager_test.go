@@ -17,10 +17,18 @@ limitations under the License.
 package core
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"image"
 	"io"
+	"io/ioutil"
+	"net/http"
 	"os"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/helixdigital/imageserver/entities"
 	"github.com/helixdigital/imageserver/plugin/storage"
@@ -28,6 +36,7 @@ import (
 )
 
 func TestNewJob(t *testing.T) {
+	WaitForJobs()
 	mock := upload.NewMock()
 	InjectUploader(mock)
 	store := storage.NewJobStore()
@@ -40,21 +49,558 @@ func TestNewJob(t *testing.T) {
 	defer os.Remove("/tmp/upload.png")
 
 	req := JobRequest{
-		"/tmp/upload.png",
-		image.Rect(200, 200, 200, 200),
-		0, 150,
-		"test.png",
+		Local_filename:    "/tmp/upload.png",
+		Crop_to:           image.Rect(200, 200, 200, 200),
+		Resize_width:      0,
+		Resize_height:     150,
+		Uploaded_filename: "test.png",
 	}
 
-	jobid := NewJob(req)
+	jobid, err := NewJob(req)
+	if err != nil {
+		t.Error("NewJob unexpectedly threw an error", err)
+	}
 	if jobid != 0 {
 		t.Errorf("Expected jobid to be %d but was %d\n", 0, jobid)
 	}
+	assertJobEndedWith(t, jobid, "Done")
+	assertUploadedSize(t, mock, 150, 150)
+}
+
+// Checks the size of the image the mock was last sent
+func assertUploadedSize(t *testing.T, mock *upload.MockUpload, w int, h int) {
+	img, err := entities.NewImage(strings.NewReader(mock.CalledData))
+	if err != nil {
+		t.Fatal("The uploaded image should have decoded but threw", err)
+	}
+	if size := img.Img.Bounds().Size(); size != image.Pt(w, h) {
+		t.Errorf("The uploaded image should have been %dx%d but was %v", w, h, size)
+	}
+}
+
+// An Uploader that always fails
+type failingUpload struct{}
+
+func (self failingUpload) Upload(rdr io.Reader, size int64, mime string, uplname string, options entities.UploadOptions) error {
+	return errors.New("S3 is down")
+}
+
+// An Uploader that panics
+type panickingUpload struct{}
+
+func (self panickingUpload) Upload(rdr io.Reader, size int64, mime string, uplname string, options entities.UploadOptions) error {
+	panic("nil bucket")
+}
+
+// An Uploader that remembers every upload
+type recordingUpload struct {
+	lock  sync.Mutex
+	mimes map[string]string
+}
+
+func (self *recordingUpload) Upload(rdr io.Reader, size int64, mime string, uplname string, options entities.UploadOptions) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.mimes[uplname] = mime
+	return nil
+}
+
+// Waits for the jobs of earlier tests to stop before swapping the
+// plugins they use
+func setupJobTest(upl Uploader) {
+	WaitForJobs()
+	InjectUploader(upl)
+	InjectRetryPolicy(quickRetries)
+	store := storage.NewJobStore()
+	InjectJobstore(&store)
+}
+
+func TestUploadOptionsOverDefaults(t *testing.T) {
+	mock := upload.NewMock()
+	setupJobTest(mock)
+	InjectUploadDefaults(entities.UploadOptions{
+		Cache_control: "public, max-age=86400",
+		Metadata:      map[string]string{"server": "imageserver"},
+	})
+	defer InjectUploadDefaults(entities.UploadOptions{})
+	MakeGrayFile(100, 100, "/tmp/options.png")
+	defer os.Remove("/tmp/options.png")
+
+	jobid, _ := NewJob(JobRequest{
+		Local_filename:    "/tmp/options.png",
+		Crop_to:           image.Rect(0, 0, 50, 50),
+		Uploaded_filename: "options.png",
+		Upload_options: entities.UploadOptions{
+			Content_disposition: "inline",
+			Metadata:            map[string]string{"user-id": "7"},
+		},
+	})
+	assertJobEndedWith(t, jobid, "Done")
+	options := mock.CalledOptions
+	if options.Cache_control != "public, max-age=86400" || options.Content_disposition != "inline" {
+		t.Error("The upload should have had the job's options over the defaults but had", options)
+	}
+	if options.Metadata["server"] != "imageserver" || options.Metadata["user-id"] != "7" {
+		t.Error("The metadata should have been merged but was", options.Metadata)
+	}
+}
+
+func TestBadUploadOptionsFailTheUpload(t *testing.T) {
+	mock := upload.NewMock()
+	setupJobTest(mock)
+	MakeGrayFile(100, 100, "/tmp/badoptions.png")
+	defer os.Remove("/tmp/badoptions.png")
+
+	jobid, _ := NewJob(JobRequest{
+		Local_filename:    "/tmp/badoptions.png",
+		Crop_to:           image.Rect(0, 0, 50, 50),
+		Uploaded_filename: "badoptions.png",
+		Upload_options:    entities.UploadOptions{Cache_control: "no-cache\r\nX-Injected: 1"},
+	})
+	assertJobEndedWith(t, jobid, "Error in uploading")
+	if mock.WasCalled {
+		t.Error("Options that cannot be sent should not have been uploaded")
+	}
+}
+
+func TestJobDone(t *testing.T) {
+	mock := upload.NewMock()
+	setupJobTest(mock)
+	MakeGrayFile(100, 100, "/tmp/done.png")
+	defer os.Remove("/tmp/done.png")
+
+	jobid, _ := NewJob(JobRequest{
+		Local_filename:    "/tmp/done.png",
+		Crop_to:           image.Rect(10, 10, 60, 60),
+		Resize_width:      20,
+		Uploaded_filename: "done.png",
+	})
+	assertJobEndedWith(t, jobid, "Done")
+	if !mock.WasCalled {
+		t.Error("Did not call the mock uploader")
+	}
+}
+
+func TestJobWithOutputs(t *testing.T) {
+	recording := &recordingUpload{mimes: make(map[string]string)}
+	setupJobTest(recording)
+	MakeGrayFile(100, 100, "/tmp/outputs.png")
+	defer os.Remove("/tmp/outputs.png")
+
+	jobid, _ := NewJob(JobRequest{
+		Local_filename: "/tmp/outputs.png",
+		Outputs: []Output{
+			{Crop_to: image.Rect(0, 0, 100, 100), Resize_width: 60, Uploaded_filename: "large.png"},
+			{Crop_to: image.Rect(0, 0, 100, 100), Resize_width: 40, Format: "jpg", Uploaded_filename: "medium.jpg"},
+			{Crop_to: image.Rect(25, 25, 75, 75), Resize_width: 10, Uploaded_filename: "avatar.png"},
+		},
+	})
+	assertJobEndedWith(t, jobid, "Done")
+	report, _ := JobStatus(jobid)
+	if len(report.Outputs) != 3 {
+		t.Fatal("Job should have reported 3 outputs but reported", len(report.Outputs))
+	}
+	for _, out := range report.Outputs {
+		if out.Status != "Done" {
+			t.Errorf("Output %s should have been 'Done' but was '%s'", out.Uploaded_filename, out.Status)
+		}
+	}
+	if len(recording.mimes) != 3 {
+		t.Error("Should have uploaded 3 images but uploaded", recording.mimes)
+	}
+	if recording.mimes["medium.jpg"] != "image/jpeg" {
+		t.Error("The jpg output should have been uploaded as 'image/jpeg' but was", recording.mimes["medium.jpg"])
+	}
+}
+
+func TestNewJobRefusesDuplicateOutputs(t *testing.T) {
+	setupJobTest(upload.NewMock())
+	_, err := NewJob(JobRequest{
+		Local_filename: "/tmp/outputs.png",
+		Outputs: []Output{
+			{Crop_to: image.Rect(0, 0, 100, 100), Uploaded_filename: "large.png"},
+			{Crop_to: image.Rect(0, 0, 50, 50), Uploaded_filename: "large.png"},
+		},
+	})
+	if err == nil {
+		t.Error("A job with two outputs of the same name should have been refused")
+	}
+	if len(ListJobs()) != 0 {
+		t.Error("A refused job should not have been stored but there were", len(ListJobs()))
+	}
+}
+
+func TestJobWithOneFailingOutput(t *testing.T) {
+	recording := &recordingUpload{mimes: make(map[string]string)}
+	setupJobTest(recording)
+	MakeGrayFile(100, 100, "/tmp/outputs.png")
+	defer os.Remove("/tmp/outputs.png")
+
+	jobid, _ := NewJob(JobRequest{
+		Local_filename: "/tmp/outputs.png",
+		Outputs: []Output{
+			{Crop_to: image.Rect(0, 0, 100, 100), Uploaded_filename: "whole.png"},
+			{Crop_to: image.Rect(50, 50, 150, 150), Uploaded_filename: "outside.png"},
+			{Crop_to: image.Rect(0, 0, 10, 10), Uploaded_filename: "corner.png"},
+		},
+	})
+	assertJobEndedWith(t, jobid, "Error in cropping")
+	report, _ := JobStatus(jobid)
+	expected := []string{"Done", "Error in cropping", "Done"}
+	for i, out := range report.Outputs {
+		if out.Status != expected[i] {
+			t.Errorf("Output %s should have been '%s' but was '%s'", out.Uploaded_filename, expected[i], out.Status)
+		}
+	}
+	if report.Outputs[1].Err == nil {
+		t.Error("The failed output should have an error")
+	}
+	if _, ok := recording.mimes["outside.png"]; ok {
+		t.Error("The output that could not be cropped should not have been uploaded")
+	}
+}
 
+func TestJobRecordsEachDestination(t *testing.T) {
+	mock := upload.NewMock()
+	fanout, _ := upload.NewFanOutUpload(upload.BestEffort,
+		upload.Destination{Name: "s3", Backend: failingUpload{}},
+		upload.Destination{Name: "fs", Backend: mock})
+	setupJobTest(fanout)
+	MakeGrayFile(100, 100, "/tmp/fanout.png")
+	defer os.Remove("/tmp/fanout.png")
+
+	jobid, _ := NewJob(JobRequest{
+		Local_filename:    "/tmp/fanout.png",
+		Crop_to:           image.Rect(0, 0, 50, 50),
+		Uploaded_filename: "fanout.png",
+	})
+	assertJobEndedWith(t, jobid, "Done")
+	job, _ := GetJob(jobid)
+	destinations := job.Outputs[0].Destinations
+	if len(destinations) != 2 || destinations[0].Destination != "s3" || destinations[1].Destination != "fs" {
+		t.Fatal("The job should have recorded both destinations but recorded", destinations)
+	}
+	if destinations[0].Err == nil || destinations[0].Err.Error() != "S3 is down" || destinations[1].Err != nil {
+		t.Error("The job should have recorded that only s3 failed but recorded", destinations)
+	}
+	if !mock.WasCalled {
+		t.Error("The image should have been uploaded to fs")
+	}
+}
+
+func TestOutputFormat(t *testing.T) {
+	formats := map[Output]entities.Format{
+		{Uploaded_filename: "avatar.jpg"}:                entities.Jpg,
+		{Uploaded_filename: "avatars/1.JPEG"}:            entities.Jpg,
+		{Uploaded_filename: "avatar.gif"}:                entities.Gif,
+		{Uploaded_filename: "avatar.jpg", Format: "png"}: entities.Png,
+		{Uploaded_filename: "avatar.webp"}:               entities.Gif,
+		{Uploaded_filename: "avatars.v2/1"}:              entities.Gif,
+		{Uploaded_filename: "avatar", Format: "JPG"}:     entities.Jpg,
+	}
+	for out, expected := range formats {
+		if format, err := outputFormat(out, entities.Gif); err != nil || format != expected {
+			t.Errorf("The format of %v from a gif should have been %d but was %d (%v)", out, expected, format, err)
+		}
+	}
+	if _, err := outputFormat(Output{Uploaded_filename: "avatar.png", Format: "webp"}, entities.Gif); err == nil {
+		t.Error("An unknown format should have thrown an error")
+	}
+}
+
+func TestJobEncodesAsTheUploadedFilenameSays(t *testing.T) {
+	mock := upload.NewMock()
+	setupJobTest(mock)
+	MakeGrayFile(100, 100, "/tmp/format.png")
+	defer os.Remove("/tmp/format.png")
+
+	jobid, _ := NewJob(JobRequest{
+		Local_filename:    "/tmp/format.png",
+		Crop_to:           image.Rect(0, 0, 50, 50),
+		Uploaded_filename: "format.jpg",
+	})
+	assertJobEndedWith(t, jobid, "Done")
+	if sniffed := http.DetectContentType([]byte(mock.CalledData)); mock.CalledMime != "image/jpeg" || sniffed != "image/jpeg" {
+		t.Error("A png uploaded as format.jpg should have been a jpeg but was uploaded as", mock.CalledMime, "and encoded as", sniffed)
+	}
+
+	jobid, _ = NewJob(JobRequest{
+		Local_filename:    "/tmp/format.png",
+		Crop_to:           image.Rect(0, 0, 50, 50),
+		Format:            "gif",
+		Uploaded_filename: "format.jpg",
+	})
+	assertJobEndedWith(t, jobid, "Done")
+	if sniffed := http.DetectContentType([]byte(mock.CalledData)); mock.CalledMime != "image/gif" || sniffed != "image/gif" {
+		t.Error("An explicit gif format should have been uploaded as a gif but was uploaded as", mock.CalledMime, "and encoded as", sniffed)
+	}
+}
+
+func TestJobFailsReadingMissingFile(t *testing.T) {
+	mock := upload.NewMock()
+	setupJobTest(mock)
+	jobid, _ := NewJob(JobRequest{
+		Local_filename:    "/tmp/there-is-no-such-file.png",
+		Crop_to:           image.Rect(0, 0, 50, 50),
+		Uploaded_filename: "missing.png",
+	})
+	assertJobEndedWith(t, jobid, "Error reading the file")
+	if mock.WasCalled {
+		t.Error("A job that could not read its file should not have uploaded anything")
+	}
+}
+
+// A Fetcher that serves one image from memory
+type memoryFetcher struct {
+	data []byte
+	mime string
+	err  error
+}
+
+func (self memoryFetcher) Fetch(url string) (io.ReadCloser, string, error) {
+	return ioutil.NopCloser(bytes.NewReader(self.data)), self.mime, self.err
+}
+
+func TestJobFetchesSourceURL(t *testing.T) {
+	mock := upload.NewMock()
+	setupJobTest(mock)
+	InjectFetcher(memoryFetcher{data: grayPNG(), mime: "image/png"})
+	defer InjectFetcher(nil)
+
+	jobid, _ := NewJob(JobRequest{
+		Source_url:        "https://example.com/avatar",
+		Crop_to:           image.Rect(0, 0, 50, 50),
+		Uploaded_filename: "fetched.png",
+	})
+	assertJobEndedWith(t, jobid, "Done")
+	if !mock.WasCalled {
+		t.Error("The fetched image should have been uploaded")
+	}
+}
+
+func TestJobFailsFetchingSourceURL(t *testing.T) {
+	setupJobTest(upload.NewMock())
+	InjectFetcher(memoryFetcher{err: errors.New("The URL is at an address that may not be fetched from")})
+	defer InjectFetcher(nil)
+
+	jobid, _ := NewJob(JobRequest{
+		Source_url:        "http://169.254.169.254/",
+		Crop_to:           image.Rect(0, 0, 50, 50),
+		Uploaded_filename: "fetched.png",
+	})
+	assertJobEndedWith(t, jobid, "Error reading the file")
+}
+
+func TestJobFetchingANonImage(t *testing.T) {
+	setupJobTest(upload.NewMock())
+	defer InjectFetcher(nil)
+
+	fetchers := map[string]memoryFetcher{
+		"refused by the fetcher": {err: fmt.Errorf("https://example.com/page is text/html, not an image: %w", entities.ErrUnsupportedFormat)},
+		"served by the fetcher":  {data: []byte("<html><body>not an image</body></html>"), mime: "text/html"},
+	}
+	for name, fetcher := range fetchers {
+		InjectFetcher(fetcher)
+		jobid, _ := NewJob(JobRequest{
+			Source_url:        "https://example.com/page",
+			Crop_to:           image.Rect(0, 0, 50, 50),
+			Uploaded_filename: "fetched.png",
+		})
+		assertJobEndedWith(t, jobid, "Unsupported format")
+		if job, _ := GetJob(jobid); !errors.Is(job.Err, entities.ErrUnsupportedFormat) {
+			t.Error(name, "should have recorded ErrUnsupportedFormat but recorded", job.Err)
+		}
+		WaitForJobs()
+	}
+}
+
+func TestJobWithSourceURLNeedsFetcher(t *testing.T) {
+	setupJobTest(upload.NewMock())
+	InjectFetcher(nil)
+
+	jobid, _ := NewJob(JobRequest{
+		Source_url:        "https://example.com/avatar.png",
+		Crop_to:           image.Rect(0, 0, 50, 50),
+		Uploaded_filename: "fetched.png",
+	})
+	assertJobEndedWith(t, jobid, "Error reading the file")
+}
+
+func TestJobFailsDecodingBadFile(t *testing.T) {
+	mock := upload.NewMock()
+	setupJobTest(mock)
+	MakeGrayFile(100, 100, "/tmp/truncated.png")
+	os.Truncate("/tmp/truncated.png", 50)
+	defer os.Remove("/tmp/truncated.png")
+	jobid, _ := NewJob(JobRequest{
+		Local_filename:    "/tmp/truncated.png",
+		Crop_to:           image.Rect(0, 0, 50, 50),
+		Uploaded_filename: "truncated.png",
+	})
+	assertJobEndedWith(t, jobid, "Error decoding the file")
+	if mock.WasCalled {
+		t.Error("A job that could not decode its file should not have uploaded anything")
+	}
+}
+
+func TestJobFailsOnUnsupportedFormat(t *testing.T) {
+	mock := upload.NewMock()
+	setupJobTest(mock)
+	ioutil.WriteFile("/tmp/notanimage.png", []byte("not an image"), 0644)
+	defer os.Remove("/tmp/notanimage.png")
+	jobid, _ := NewJob(JobRequest{
+		Local_filename:    "/tmp/notanimage.png",
+		Crop_to:           image.Rect(0, 0, 50, 50),
+		Uploaded_filename: "notanimage.png",
+	})
+	assertJobEndedWith(t, jobid, "Unsupported format")
+	if job, _ := GetJob(jobid); !errors.Is(job.Err, entities.ErrUnsupportedFormat) {
+		t.Error("The job should have recorded ErrUnsupportedFormat but recorded", job.Err)
+	}
+	if mock.WasCalled {
+		t.Error("A job with an unsupported input should not have uploaded anything")
+	}
+}
+
+func TestJobRecordsTheFormatFoundInTheInput(t *testing.T) {
+	mock := upload.NewMock()
+	setupJobTest(mock)
+	MakeGrayFile(120, 80, "/tmp/noextension.png")
+	os.Rename("/tmp/noextension.png", "/tmp/noextension")
+	defer os.Remove("/tmp/noextension")
+	jobid, _ := NewJob(JobRequest{
+		Local_filename:    "/tmp/noextension",
+		Crop_to:           image.Rect(0, 0, 50, 50),
+		Uploaded_filename: "noextension",
+	})
+	assertJobEndedWith(t, jobid, "Done")
+	job, _ := GetJob(jobid)
+	if job.Source != (entities.SourceImage{Format: "png", Width: 120, Height: 80}) {
+		t.Error("The job should have recorded a 120x80 png source but recorded", job.Source)
+	}
+	if mock.CalledMime != "image/png" {
+		t.Error("An output with no extension should have been a png like its input but was", mock.CalledMime)
+	}
+}
+
+func TestJobFailsCroppingOutsideImage(t *testing.T) {
+	mock := upload.NewMock()
+	setupJobTest(mock)
+	MakeGrayFile(100, 100, "/tmp/small.png")
+	defer os.Remove("/tmp/small.png")
+	jobid, _ := NewJob(JobRequest{
+		Local_filename:    "/tmp/small.png",
+		Crop_to:           image.Rect(50, 50, 150, 150),
+		Uploaded_filename: "small.png",
+	})
+	assertJobEndedWith(t, jobid, "Error in cropping")
+	if mock.WasCalled {
+		t.Error("A job that could not crop should not have uploaded anything")
+	}
+}
+
+func TestJobWithEmptyCropIsNotCropped(t *testing.T) {
+	mock := upload.NewMock()
+	setupJobTest(mock)
+	MakeGrayFile(100, 100, "/tmp/nothing.png")
+	defer os.Remove("/tmp/nothing.png")
+	jobid, _ := NewJob(JobRequest{
+		Local_filename:    "/tmp/nothing.png",
+		Crop_to:           image.Rect(20, 20, 20, 20),
+		Uploaded_filename: "nothing.png",
+	})
+	assertJobEndedWith(t, jobid, "Done")
+	assertUploadedSize(t, mock, 100, 100)
+}
+
+func TestJobFailsUploading(t *testing.T) {
+	setupJobTest(failingUpload{})
+	MakeGrayFile(100, 100, "/tmp/failing.png")
+	defer os.Remove("/tmp/failing.png")
+	jobid, _ := NewJob(JobRequest{
+		Local_filename:    "/tmp/failing.png",
+		Crop_to:           image.Rect(0, 0, 50, 50),
+		Uploaded_filename: "failing.png",
+	})
+	assertJobEndedWith(t, jobid, "Error in uploading")
+}
+
+func TestJobPanicInStageIsAnError(t *testing.T) {
+	setupJobTest(panickingUpload{})
+	MakeGrayFile(100, 100, "/tmp/panicking.png")
+	defer os.Remove("/tmp/panicking.png")
+	jobid, _ := NewJob(JobRequest{
+		Local_filename:    "/tmp/panicking.png",
+		Crop_to:           image.Rect(0, 0, 50, 50),
+		Uploaded_filename: "panicking.png",
+	})
+	assertJobEndedWith(t, jobid, "Error in uploading")
+}
+
+func TestJobTimesOutWithoutLeaking(t *testing.T) {
+	blocking := &blockingUpload{started: make(chan bool), release: make(chan bool)}
+	setupJobTest(blocking)
+	jobtimeout = 50 * time.Millisecond
+	defer func() { jobtimeout = 20 * time.Minute }()
+	MakeGrayFile(100, 100, "/tmp/slow.png")
+	defer os.Remove("/tmp/slow.png")
+
+	jobid, _ := NewJob(JobRequest{
+		Local_filename:    "/tmp/slow.png",
+		Crop_to:           image.Rect(0, 0, 50, 50),
+		Uploaded_filename: "slow.png",
+	})
+	<-blocking.started
+	status := waitForStatus(jobid, "Timed out")
+	if status != "Timed out" {
+		t.Error("Status of a stuck job should have been 'Timed out' but was", status)
+	}
+	_, err := JobStatus(jobid)
+	if err == nil || err.Error() != "Timed out after Uploading" {
+		t.Error("Error of a stuck job should have been 'Timed out after Uploading' but was", err)
+	}
+	blocking.release <- true
+	if !waitForPipelineToStop(jobid) {
+		t.Error("The pipeline of a timed out job should have stopped once its stage returned")
+	}
+}
+
+// Checks that the job finished with the expected status, that a
+// failed job has an error, and that its pipeline goroutine has stopped.
+func assertJobEndedWith(t *testing.T, jobid int, expected string) {
+	status := waitForStatus(jobid, expected)
+	if status != expected {
+		t.Errorf("Status should have been '%s' but was '%s'", expected, status)
+	}
+	_, err := JobStatus(jobid)
+	if expected != "Done" && err == nil {
+		t.Errorf("A job ending with '%s' should have an error", expected)
+	}
+	if !waitForPipelineToStop(jobid) {
+		t.Error("The pipeline goroutine should have stopped")
+	}
+}
+
+// Waits for the watcher to have recorded a final status and for the
+// pipeline goroutine to have returned, which it shows by unregistering
+// the job from the cancels
+func waitForPipelineToStop(jobid int) bool {
+	for i := 0; i < 200; i++ {
+		job, _ := jobstore.GetJob(jobid)
+		cancels_lock.Lock()
+		_, running := cancels[jobid]
+		cancels_lock.Unlock()
+		if job.Finished() && !running {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
 }
 
 func MakeGrayFile(w int, h int, filename string) error {
-	image := entities.Image{getGrayImage(w, h), extension(filename)}
+	format, _ := formatOfExtension(filename)
+	image := entities.Image{Img: getGrayImage(w, h), Format: format}
 	outputfile, err := os.Create(filename)
 	if err != nil {
 		return err
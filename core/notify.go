@@ -0,0 +1,149 @@
+/*
+Copyright 2014 Helix Digital
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"time"
+
+	"github.com/helixdigital/imageserver/entities"
+)
+
+// Notifier is the plugin that tells a client, at the callback URL it
+// gave in its JobRequest, that its job has finished
+type Notifier interface {
+	Notify(string, Notification) error
+}
+
+var notifier Notifier
+
+// InjectNotifier is the setter for the current Notifier
+func InjectNotifier(n Notifier) {
+	notifier = n
+}
+
+// URLChecker is implemented by Notifiers that can refuse a callback URL
+// when a job is requested, rather than only when the job finishes
+type URLChecker interface {
+	CheckURL(string) error
+}
+
+// CheckCallbackURL returns an error if the Notifier will not notify the
+// given callback URL
+func CheckCallbackURL(url string) error {
+	checker, ok := notifier.(URLChecker)
+	if !ok {
+		return nil
+	}
+	return checker.CheckURL(url)
+}
+
+// Notification describes a job that has finished. It is sent as JSON
+// with the same names as the v2 API uses.
+type Notification struct {
+	Jobid int `json:"jobid"`
+	// "Done", "Cancelled", "Timed out", "Unsupported format" or one of
+	// the "Error..." statuses
+	Status string `json:"status"`
+	// empty unless Status starts with "Error", is "Unsupported format"
+	// or is "Timed out"
+	Error   string           `json:"error,omitempty"`
+	Outputs []NotifiedOutput `json:"outputs"`
+	// the input as it was decoded, or nil if the job finished before
+	// decoding it
+	Source   *NotifiedSource `json:"source,omitempty"`
+	Created  time.Time       `json:"created"`
+	Finished time.Time       `json:"finished"`
+	// how long the job took, from being requested to finishing
+	Seconds float64 `json:"seconds"`
+}
+
+// NotifiedSource describes the input of a finished job
+type NotifiedSource struct {
+	Format string `json:"format"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+// NotifiedOutput describes one of the images a finished job made
+type NotifiedOutput struct {
+	Uploaded_filename string `json:"uploaded_filename"`
+	Status            string `json:"status"`
+	Error             string `json:"error,omitempty"`
+	// where the image can be fetched from, if it was uploaded and the
+	// Uploader can say
+	URL string `json:"url,omitempty"`
+	// how many times the image was sent to the Uploader
+	Upload_attempts int `json:"upload_attempts,omitempty"`
+	// how each destination fared, if the Uploader sends images to more
+	// than one
+	Destinations []NotifiedDestination `json:"destinations,omitempty"`
+}
+
+// NotifiedDestination describes how one of the places an image was
+// uploaded to fared
+type NotifiedDestination struct {
+	Destination string `json:"destination"`
+	// empty if the image was stored there
+	Error string `json:"error,omitempty"`
+}
+
+// Sends the Notification for a finished job, if the job asked for one.
+// It is sent from a goroutine of its own so that a slow callback does
+// not hold up the watcher.
+func notifyFinished(req JobRequest, job entities.Job) {
+	if req.Callback_url == "" || notifier == nil {
+		return
+	}
+	go notifier.Notify(req.Callback_url, newNotification(job))
+}
+
+func newNotification(job entities.Job) Notification {
+	n := Notification{
+		Jobid:    job.Id,
+		Status:   job.Status,
+		Error:    errorText(job.Err),
+		Created:  job.Created,
+		Finished: job.Modified,
+		Seconds:  job.Modified.Sub(job.Created).Seconds(),
+	}
+	if job.Source != (entities.SourceImage{}) {
+		n.Source = &NotifiedSource{job.Source.Format, job.Source.Width, job.Source.Height}
+	}
+	for _, out := range job.Outputs {
+		notified := NotifiedOutput{
+			Uploaded_filename: out.Uploaded_filename,
+			Status:            out.Status,
+			Error:             errorText(out.Err),
+			Upload_attempts:   out.Upload_attempts,
+		}
+		for _, dest := range out.Destinations {
+			notified.Destinations = append(notified.Destinations, NotifiedDestination{dest.Destination, errorText(dest.Err)})
+		}
+		if out.Status == "Done" {
+			notified.URL = OutputURL(out.Uploaded_filename)
+		}
+		n.Outputs = append(n.Outputs, notified)
+	}
+	return n
+}
+
+func errorText(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
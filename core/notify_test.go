@@ -0,0 +1,153 @@
+/*
+Copyright 2014 Helix Digital
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"errors"
+	"image"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/helixdigital/imageserver/plugin/upload"
+)
+
+// A Notifier that passes each Notification on to a channel
+type channelNotifier struct {
+	urls          chan string
+	notifications chan Notification
+}
+
+func (self channelNotifier) Notify(url string, n Notification) error {
+	self.urls <- url
+	self.notifications <- n
+	return nil
+}
+
+func newChannelNotifier() channelNotifier {
+	return channelNotifier{make(chan string, 1), make(chan Notification, 1)}
+}
+
+func TestNotifiesWhenDone(t *testing.T) {
+	setupJobTest(upload.NewMock())
+	notifications := newChannelNotifier()
+	InjectNotifier(notifications)
+	defer InjectNotifier(nil)
+	MakeGrayFile(100, 100, "/tmp/notify.png")
+	defer os.Remove("/tmp/notify.png")
+
+	jobid, _ := NewJob(JobRequest{
+		Local_filename:    "/tmp/notify.png",
+		Crop_to:           image.Rect(0, 0, 50, 50),
+		Uploaded_filename: "notify.png",
+		Callback_url:      "http://webapp/done",
+	})
+	url, n := waitForNotification(t, notifications)
+	if url != "http://webapp/done" {
+		t.Error("Should have notified 'http://webapp/done' but notified", url)
+	}
+	if n.Jobid != jobid || n.Status != "Done" || n.Error != "" {
+		t.Error("Notification should have been of a job that was done but was", n)
+	}
+	if len(n.Outputs) != 1 || n.Outputs[0].URL != "mock://notify.png" {
+		t.Error("Notification should have said where the image was uploaded but said", n.Outputs)
+	}
+	if n.Source == nil || *n.Source != (NotifiedSource{Format: "png", Width: 100, Height: 100}) {
+		t.Error("Notification should have described the input but said", n.Source)
+	}
+	if n.Finished.Before(n.Created) || n.Seconds < 0 {
+		t.Error("Notification should have sensible timings but had", n.Created, n.Finished, n.Seconds)
+	}
+}
+
+func TestNotifiesWhenFailed(t *testing.T) {
+	setupJobTest(failingUpload{})
+	notifications := newChannelNotifier()
+	InjectNotifier(notifications)
+	defer InjectNotifier(nil)
+	MakeGrayFile(100, 100, "/tmp/notify.png")
+	defer os.Remove("/tmp/notify.png")
+
+	NewJob(JobRequest{
+		Local_filename:    "/tmp/notify.png",
+		Crop_to:           image.Rect(0, 0, 50, 50),
+		Uploaded_filename: "notify.png",
+		Callback_url:      "http://webapp/done",
+	})
+	_, n := waitForNotification(t, notifications)
+	if n.Status != "Error in uploading" || n.Error != "S3 is down" {
+		t.Error("Notification should have been of a failed upload but was", n)
+	}
+	if n.Outputs[0].URL != "" {
+		t.Error("A failed output should not have a URL but had", n.Outputs[0].URL)
+	}
+	if n.Outputs[0].Upload_attempts != quickRetries.Max_attempts {
+		t.Error("A failed output should have been tried", quickRetries.Max_attempts, "times but was tried", n.Outputs[0].Upload_attempts)
+	}
+}
+
+// A Notifier that refuses every callback URL
+type refusingNotifier struct {
+	channelNotifier
+}
+
+func (self refusingNotifier) CheckURL(url string) error {
+	return errors.New("Refused " + url)
+}
+
+func TestCheckCallbackURL(t *testing.T) {
+	InjectNotifier(newChannelNotifier())
+	if err := CheckCallbackURL("http://10.0.0.1/done"); err != nil {
+		t.Error("A Notifier that cannot check URLs should allow them but threw", err)
+	}
+	InjectNotifier(refusingNotifier{newChannelNotifier()})
+	defer InjectNotifier(nil)
+	if err := CheckCallbackURL("http://10.0.0.1/done"); err == nil {
+		t.Error("The URL should have been refused by the Notifier")
+	}
+}
+
+func TestDoesNotNotifyWithoutCallback(t *testing.T) {
+	setupJobTest(upload.NewMock())
+	notifications := newChannelNotifier()
+	InjectNotifier(notifications)
+	defer InjectNotifier(nil)
+	MakeGrayFile(100, 100, "/tmp/notify.png")
+	defer os.Remove("/tmp/notify.png")
+
+	jobid, _ := NewJob(JobRequest{
+		Local_filename:    "/tmp/notify.png",
+		Crop_to:           image.Rect(0, 0, 50, 50),
+		Uploaded_filename: "notify.png",
+	})
+	assertJobEndedWith(t, jobid, "Done")
+	select {
+	case url := <-notifications.urls:
+		t.Error("A job without a callback URL should not have notified but notified", url)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func waitForNotification(t *testing.T, notifications channelNotifier) (string, Notification) {
+	select {
+	case url := <-notifications.urls:
+		return url, <-notifications.notifications
+	case <-time.After(2 * time.Second):
+		t.Fatal("Should have notified that the job had finished")
+	}
+	return "", Notification{}
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2014 Helix Digital
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/helixdigital/imageserver/entities"
+)
+
+// RetryPolicy says how often, and how patiently, an upload that failed
+// with a temporary error is tried again
+type RetryPolicy struct {
+	// the most times an image is sent to the Uploader. 1 never retries.
+	Max_attempts int
+	// how long to wait before the second attempt. Each attempt after
+	// that waits twice as long as the one before.
+	Backoff time.Duration
+	// the longest wait between attempts
+	Max_backoff time.Duration
+}
+
+// DefaultRetryPolicy tries an upload three times, waiting about a
+// second and then about two seconds
+var DefaultRetryPolicy = RetryPolicy{
+	Max_attempts: 3,
+	Backoff:      time.Second,
+	Max_backoff:  30 * time.Second,
+}
+
+var retryPolicy = DefaultRetryPolicy
+
+// The setter for the current RetryPolicy
+func InjectRetryPolicy(policy RetryPolicy) {
+	retryPolicy = policy
+}
+
+// How long to wait after the given attempt failed. The wait is random
+// between half and all of the exponential backoff, so that jobs that
+// failed together do not all retry together.
+func (self RetryPolicy) backoff(attempt int) time.Duration {
+	wait := self.Backoff
+	for i := 1; i < attempt && wait < self.Max_backoff; i++ {
+		wait *= 2
+	}
+	if wait > self.Max_backoff {
+		wait = self.Max_backoff
+	}
+	if wait <= 0 {
+		return 0
+	}
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+// Whether an upload that failed with err might succeed if it is tried
+// again. An Uploader says so with an entities.UploadError; any other
+// error, such as from the network, is taken as temporary.
+func retryable(err error) bool {
+	var uplerr entities.UploadError
+	if errors.As(err, &uplerr) {
+		return uplerr.Temporary
+	}
+	return !errors.Is(err, context.Canceled)
+}
+
+// Sends the current output to the Uploader until it succeeds, fails
+// with a permanent error or has been tried retryPolicy.Max_attempts
+// times. While waiting to try again it reports "Retrying the upload",
+// and it stops waiting if the job is cancelled.
+func uploadWithRetries(run *jobRun, mime string, options entities.UploadOptions) error {
+	for {
+		run.attempts++
+		destinations, err := sendToUploader(run.image, mime, run.output.Uploaded_filename, options)
+		run.destinations = destinations
+		if err == nil || !retryable(err) || run.attempts >= retryPolicy.Max_attempts {
+			return err
+		}
+		if !run.sendForOutput(100, "Retrying the upload", nil) {
+			return err
+		}
+		select {
+		case <-time.After(retryPolicy.backoff(run.attempts)):
+		case <-run.cancel:
+			return err
+		}
+		if !run.sendForOutput(100, "Uploading", nil) {
+			return err
+		}
+	}
+}
@@ -0,0 +1,160 @@
+/*
+Copyright 2014 Helix Digital
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/helixdigital/imageserver/entities"
+	"github.com/helixdigital/imageserver/plugin/upload"
+)
+
+// Retries quickly enough for tests that fail their uploads
+var quickRetries = RetryPolicy{Max_attempts: 3, Backoff: time.Millisecond, Max_backoff: time.Millisecond}
+
+// An Uploader that fails with err the first failures times it is called
+type flakyUpload struct {
+	upload.MockUpload
+	lock     sync.Mutex
+	failures int
+	err      error
+	calls    int
+}
+
+func (self *flakyUpload) Upload(rdr io.Reader, size int64, mime string, uplname string, options entities.UploadOptions) error {
+	self.lock.Lock()
+	self.calls++
+	failing := self.calls <= self.failures
+	self.lock.Unlock()
+	if failing {
+		return self.err
+	}
+	return self.MockUpload.Upload(rdr, size, mime, uplname, options)
+}
+
+func (self *flakyUpload) callCount() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.calls
+}
+
+func runFlakyJob(t *testing.T, flaky *flakyUpload, expected string) entities.Job {
+	setupJobTest(flaky)
+	MakeGrayFile(100, 100, "/tmp/flaky.png")
+	defer os.Remove("/tmp/flaky.png")
+	jobid, _ := NewJob(JobRequest{
+		Local_filename:    "/tmp/flaky.png",
+		Crop_to:           image.Rect(0, 0, 50, 50),
+		Uploaded_filename: "flaky.png",
+	})
+	assertJobEndedWith(t, jobid, expected)
+	job, _ := GetJob(jobid)
+	return job
+}
+
+func TestUploadIsRetriedUntilItSucceeds(t *testing.T) {
+	flaky := &flakyUpload{failures: 2, err: errors.New("connection reset by peer")}
+	job := runFlakyJob(t, flaky, "Done")
+	if flaky.callCount() != 3 || job.Outputs[0].Upload_attempts != 3 {
+		t.Error("The upload should have taken 3 attempts but took", flaky.callCount(), "and recorded", job.Outputs[0].Upload_attempts)
+	}
+	if _, err := entities.NewImage(strings.NewReader(flaky.CalledData)); err != nil {
+		t.Error("The attempt that succeeded should have been sent the whole image but", err)
+	}
+}
+
+func TestUploadGivesUpAfterMaxAttempts(t *testing.T) {
+	flaky := &flakyUpload{failures: 10, err: entities.TemporaryUploadError(errors.New("SlowDown"))}
+	job := runFlakyJob(t, flaky, "Error in uploading")
+	if flaky.callCount() != 3 || job.Outputs[0].Upload_attempts != 3 {
+		t.Error("The upload should have been given up after 3 attempts but took", flaky.callCount(), "and recorded", job.Outputs[0].Upload_attempts)
+	}
+	if job.Outputs[0].Err == nil || job.Outputs[0].Err.Error() != "SlowDown" {
+		t.Error("The output should have failed with the last error but had", job.Outputs[0].Err)
+	}
+}
+
+func TestPermanentUploadErrorIsNotRetried(t *testing.T) {
+	flaky := &flakyUpload{failures: 10, err: entities.PermanentUploadError(errors.New("AccessDenied"))}
+	job := runFlakyJob(t, flaky, "Error in uploading")
+	if flaky.callCount() != 1 || job.Outputs[0].Upload_attempts != 1 {
+		t.Error("A permanent error should not have been retried but took", flaky.callCount(), "attempts")
+	}
+}
+
+func TestCancelWhileWaitingToRetry(t *testing.T) {
+	flaky := &flakyUpload{failures: 10, err: errors.New("S3 is down")}
+	setupJobTest(flaky)
+	InjectRetryPolicy(RetryPolicy{Max_attempts: 3, Backoff: time.Minute, Max_backoff: time.Minute})
+	MakeGrayFile(100, 100, "/tmp/flaky.png")
+	defer os.Remove("/tmp/flaky.png")
+	jobid, _ := NewJob(JobRequest{
+		Local_filename:    "/tmp/flaky.png",
+		Crop_to:           image.Rect(0, 0, 50, 50),
+		Uploaded_filename: "flaky.png",
+	})
+	if status := waitForStatus(jobid, "Retrying the upload"); status != "Retrying the upload" {
+		t.Fatal("The job should have been waiting to retry but was", status)
+	}
+	CancelJob(jobid)
+	if status := waitForStatus(jobid, "Cancelled"); status != "Cancelled" {
+		t.Error("A job cancelled while waiting to retry should have been 'Cancelled' but was", status)
+	}
+	if !waitForPipelineToStop(jobid) {
+		t.Error("The pipeline should have stopped without waiting to retry")
+	}
+	if flaky.callCount() != 1 {
+		t.Error("A cancelled job should not have retried but took", flaky.callCount(), "attempts")
+	}
+}
+
+func TestBackoffGrowsWithJitter(t *testing.T) {
+	policy := RetryPolicy{Max_attempts: 10, Backoff: 100 * time.Millisecond, Max_backoff: 300 * time.Millisecond}
+	limits := map[int]time.Duration{1: 100, 2: 200, 3: 300, 9: 300}
+	for attempt, limit := range limits {
+		limit *= time.Millisecond
+		for i := 0; i < 20; i++ {
+			if wait := policy.backoff(attempt); wait < limit/2 || wait > limit {
+				t.Errorf("The wait after attempt %d should have been between %s and %s but was %s", attempt, limit/2, limit, wait)
+			}
+		}
+	}
+}
+
+func TestRetryableErrors(t *testing.T) {
+	errs := map[error]bool{
+		errors.New("connection reset by peer"):                           true,
+		entities.TemporaryUploadError(errors.New("SlowDown")):            true,
+		entities.PermanentUploadError(errors.New("AccessDenied")):        false,
+		fmt.Errorf("wrapped: %w", entities.PermanentUploadError(io.EOF)): false,
+		fmt.Errorf("Uploading was cancelled: %w", context.Canceled):      false,
+	}
+	for err, expected := range errs {
+		if retryable(err) != expected {
+			t.Errorf("Whether '%s' is retryable should have been %t", err, expected)
+		}
+	}
+}
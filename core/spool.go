@@ -0,0 +1,100 @@
+/*
+Copyright 2014 Helix Digital
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrInputTooLarge is returned by SpoolInput when the image is larger
+// than the most that can be sent
+var ErrInputTooLarge = errors.New("The image is too large")
+
+var spooldir = os.TempDir()
+var maxInputSize int64 = 32 << 20
+
+// InjectSpool is the setter for the directory that images sent with a
+// request are kept in until their job stops, and for the largest image
+// that can be sent
+func InjectSpool(dir string, maxsize int64) {
+	spooldir = dir
+	maxInputSize = maxsize
+}
+
+// MaxInputSize is the largest image, in bytes, that SpoolInput accepts
+func MaxInputSize() int64 {
+	return maxInputSize
+}
+
+// SpoolInput copies the image read from rdr into the spool directory so
+// that a job can be requested with it as its Spooled_input. The name the
+// client gave the image, which may be empty, decides the extension of
+// the file. It returns ErrInputTooLarge, and keeps nothing, if rdr holds
+// more than MaxInputSize bytes.
+func SpoolInput(rdr io.Reader, name string) (string, error) {
+	file, err := ioutil.TempFile(spooldir, "input-*"+spoolExtension(name))
+	if err != nil {
+		return "", err
+	}
+	written, err := io.Copy(file, io.LimitReader(rdr, maxInputSize+1))
+	file.Close()
+	if err == nil && written > maxInputSize {
+		err = ErrInputTooLarge
+	}
+	if err == nil && written == 0 {
+		err = errors.New("The image is empty")
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return filepath.Base(file.Name()), nil
+}
+
+// The extension of the spooled file. The pipeline recognises the format
+// of the input from its content, so this is only a convenience for
+// whoever looks in the spool directory.
+func spoolExtension(name string) string {
+	switch ext := strings.ToLower(filepath.Ext(name)); ext {
+	case ".jpg", ".jpeg", ".png", ".gif":
+		return ext
+	}
+	return ".png"
+}
+
+// The file in the spool directory with the name SpoolInput gave it
+func spooledFile(name string) (string, error) {
+	if name != filepath.Base(name) || !strings.HasPrefix(name, "input-") {
+		return "", fmt.Errorf("%s was not made by SpoolInput", name)
+	}
+	return filepath.Join(spooldir, name), nil
+}
+
+// DiscardSpooled removes an image spooled by SpoolInput. Jobs discard
+// their own Spooled_input when they stop, so this is only needed for an
+// image that is not given to a job after all.
+func DiscardSpooled(name string) {
+	if filename, err := spooledFile(name); err == nil {
+		os.Remove(filename)
+	}
+}
@@ -0,0 +1,127 @@
+/*
+Copyright 2014 Helix Digital
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"bytes"
+	"image"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/helixdigital/imageserver/entities"
+	"github.com/helixdigital/imageserver/plugin/upload"
+)
+
+func setupSpoolTest(t *testing.T, maxsize int64) string {
+	dir := t.TempDir()
+	InjectSpool(dir, maxsize)
+	return dir
+}
+
+func grayPNG() []byte {
+	var buf bytes.Buffer
+	buf.ReadFrom(entities.Image{Img: getGrayImage(100, 100), Format: entities.Png}.Reader())
+	return buf.Bytes()
+}
+
+func TestSpooledInputIsProcessedAndRemoved(t *testing.T) {
+	dir := setupSpoolTest(t, 1<<20)
+	defer InjectSpool(os.TempDir(), 32<<20)
+	mock := upload.NewMock()
+	setupJobTest(mock)
+
+	name, err := SpoolInput(bytes.NewReader(grayPNG()), "photo.PNG")
+	if err != nil {
+		t.Fatal("SpoolInput unexpectedly threw an error", err)
+	}
+	if !strings.HasSuffix(name, ".png") {
+		t.Error("The spooled file should have kept the extension but was", name)
+	}
+	jobid, _ := NewJob(JobRequest{
+		Spooled_input:     name,
+		Crop_to:           image.Rect(0, 0, 50, 50),
+		Uploaded_filename: "spooled.png",
+	})
+	assertJobEndedWith(t, jobid, "Done")
+	if !mock.WasCalled {
+		t.Error("The spooled image should have been uploaded")
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Error("The spooled image should have been removed when the job stopped but found", files)
+	}
+}
+
+func TestSpoolInputRefusesLargeImages(t *testing.T) {
+	dir := setupSpoolTest(t, 10)
+	defer InjectSpool(os.TempDir(), 32<<20)
+
+	if _, err := SpoolInput(bytes.NewReader(make([]byte, 11)), "big.png"); err != ErrInputTooLarge {
+		t.Error("An image over the limit should have thrown ErrInputTooLarge but threw", err)
+	}
+	if _, err := SpoolInput(bytes.NewReader(make([]byte, 10)), "small.png"); err != nil {
+		t.Error("An image at the limit should have been spooled but threw", err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Error("Only the image at the limit should have been kept but found", files)
+	}
+}
+
+func TestSpoolInputRefusesEmptyImages(t *testing.T) {
+	setupSpoolTest(t, 10)
+	defer InjectSpool(os.TempDir(), 32<<20)
+
+	if _, err := SpoolInput(bytes.NewReader(nil), "empty.png"); err == nil {
+		t.Error("An empty image should have thrown an error")
+	}
+}
+
+func TestSpooledInputMustComeFromTheSpool(t *testing.T) {
+	setupSpoolTest(t, 1<<20)
+	defer InjectSpool(os.TempDir(), 32<<20)
+	MakeGrayFile(100, 100, "/tmp/notspooled.png")
+	defer os.Remove("/tmp/notspooled.png")
+	setupJobTest(upload.NewMock())
+
+	for _, name := range []string{"/tmp/notspooled.png", "../notspooled.png", "notspooled.png"} {
+		jobid, _ := NewJob(JobRequest{
+			Spooled_input:     name,
+			Crop_to:           image.Rect(0, 0, 50, 50),
+			Uploaded_filename: "spooled.png",
+		})
+		assertJobEndedWith(t, jobid, "Error file not allowed")
+	}
+	if _, err := os.Stat("/tmp/notspooled.png"); err != nil {
+		t.Error("A file outside the spool should not have been removed")
+	}
+}
+
+func TestDiscardSpooled(t *testing.T) {
+	dir := setupSpoolTest(t, 1<<20)
+	defer InjectSpool(os.TempDir(), 32<<20)
+
+	name, _ := SpoolInput(bytes.NewReader(grayPNG()), "")
+	if filepath.Ext(name) != ".png" {
+		t.Error("An image without a name should be spooled as a png but was", name)
+	}
+	DiscardSpooled(name)
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Error("DiscardSpooled should have removed the image but found", files)
+	}
+}
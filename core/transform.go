@@ -0,0 +1,178 @@
+/*
+Copyright 2014 Helix Digital
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/helixdigital/imageserver/entities"
+)
+
+// TransformRequest is the input to the Transform() function. Unlike a
+// JobRequest it is carried out while the client waits and nothing is
+// uploaded.
+type TransformRequest struct {
+	// The path of the source image, relative to the source root
+	Source string
+	// The part of the source image to crop to. If empty the whole image is used.
+	Crop_to image.Rectangle
+	// Leave as 0 and set Resize_height to keep aspect ratio. Leave both as
+	// 0 to keep the size.
+	Resize_width uint
+	// Leave as 0 and set Resize_width to keep aspect ratio
+	Resize_height uint
+	// "jpg", "png" or "gif". If empty the result has the same format as the source.
+	Format string
+}
+
+// Transformed is the output of the Transform() function
+type Transformed struct {
+	Data []byte
+	Mime string
+	// Changes whenever the request or the source image changes
+	ETag string
+}
+
+// ErrNoSource is returned when the source image does not exist, or when
+// there is no source root to find it in
+var ErrNoSource = errors.New("No such source image")
+
+// ErrTransformBusy is returned when as many transforms are running as
+// there are workers
+var ErrTransformBusy = errors.New("Too many images are being transformed")
+
+// The largest width or height a transform may resize to
+var maxTransformSize uint = 2048
+
+// The setter for the largest width or height a transform may resize to
+func InjectMaxTransformSize(size uint) {
+	maxTransformSize = size
+}
+
+var sourceroot string
+
+// The setter for the directory that Transform reads source images from.
+// Transform is disabled while it is empty.
+func InjectSourceRoot(root string) {
+	sourceroot = root
+}
+
+// Transform reads the source image, crops, resizes and encodes it, and
+// returns the result. It returns ErrTransformBusy, without reading the
+// image, if every transform slot of the worker pool is taken.
+func Transform(req TransformRequest) (Transformed, error) {
+	filename, info, err := findSource(req.Source)
+	if err != nil {
+		return Transformed{}, err
+	}
+	var format entities.Format
+	if req.Format != "" {
+		if format, err = formatNamed(req.Format); err != nil {
+			return Transformed{}, err
+		}
+	}
+	if req.Resize_width > maxTransformSize || req.Resize_height > maxTransformSize {
+		return Transformed{}, fmt.Errorf("Cannot resize to more than %d pixels", maxTransformSize)
+	}
+	slots := currentPool().transforms
+	select {
+	case slots <- struct{}{}:
+		defer func() { <-slots }()
+	default:
+		return Transformed{}, ErrTransformBusy
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return Transformed{}, ErrNoSource
+	}
+	defer file.Close()
+	img, err := entities.NewImage(file)
+	if errors.Is(err, entities.ErrUnsupportedFormat) {
+		return Transformed{}, err
+	}
+	if err != nil {
+		return Transformed{}, fmt.Errorf("Error decoding the file: %s", err)
+	}
+	if req.Crop_to != (image.Rectangle{}) {
+		if err := checkCrop(img, req.Crop_to); err != nil {
+			return Transformed{}, err
+		}
+		img = img.CropTo(req.Crop_to)
+	}
+	if req.Resize_width != 0 || req.Resize_height != 0 {
+		img = img.ResizeTo(req.Resize_width, req.Resize_height)
+	}
+	if req.Format != "" {
+		img.Format = format
+	}
+	var buf bytes.Buffer
+	if err := img.Encode(&buf); err != nil {
+		return Transformed{}, err
+	}
+	return Transformed{Data: buf.Bytes(), Mime: img.Mime(), ETag: transformETag(req, info)}, nil
+}
+
+// TransformETag returns the ETag that Transform would give its result,
+// without doing the work, so that a client's cached copy can be checked
+// cheaply
+func TransformETag(req TransformRequest) (string, error) {
+	_, info, err := findSource(req.Source)
+	if err != nil {
+		return "", err
+	}
+	return transformETag(req, info), nil
+}
+
+// The ETag is a hash of the request and of the size and modification
+// time of the source
+func transformETag(req TransformRequest, info os.FileInfo) string {
+	hash := sha1.New()
+	fmt.Fprintf(hash, "%s|%d|%d|%v|%d|%d|%s",
+		filepath.Clean("/"+req.Source), info.Size(), info.ModTime().UnixNano(),
+		req.Crop_to, req.Resize_width, req.Resize_height, strings.ToLower(req.Format))
+	return `"` + hex.EncodeToString(hash.Sum(nil)) + `"`
+}
+
+// Returns the filename of the source under the source root, with its
+// symlinks resolved. The source cannot be outside the root, even by way
+// of a symlink.
+func findSource(source string) (string, os.FileInfo, error) {
+	if sourceroot == "" {
+		return "", nil, ErrNoSource
+	}
+	root, err := resolveRoot(sourceroot)
+	if err != nil {
+		return "", nil, ErrNoSource
+	}
+	filename, err := filepath.EvalSymlinks(filepath.Join(root, filepath.Clean("/"+source)))
+	if err != nil || !inRoots(filename, []string{root}) {
+		return "", nil, ErrNoSource
+	}
+	info, err := os.Stat(filename)
+	if err != nil || info.IsDir() {
+		return "", nil, ErrNoSource
+	}
+	return filename, info, nil
+}
@@ -0,0 +1,160 @@
+/*
+Copyright 2014 Helix Digital
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func setupTransformTest(t *testing.T) string {
+	root, err := ioutil.TempDir("", "transform")
+	if err != nil {
+		t.Fatal("Cannot make the source root", err)
+	}
+	InjectSourceRoot(root)
+	if err := MakeGrayFile(400, 300, filepath.Join(root, "gray.png")); err != nil {
+		t.Fatal("Cannot make the source image", err)
+	}
+	return root
+}
+
+func TestTransformCropsAndResizes(t *testing.T) {
+	root := setupTransformTest(t)
+	defer os.RemoveAll(root)
+
+	result, err := Transform(TransformRequest{
+		Source:       "gray.png",
+		Crop_to:      image.Rect(0, 0, 200, 200),
+		Resize_width: 50,
+	})
+	if err != nil {
+		t.Fatal("Transform unexpectedly threw an error", err)
+	}
+	if result.Mime != "image/png" {
+		t.Error("Mime should have been image/png but was", result.Mime)
+	}
+	img, err := png.Decode(bytes.NewReader(result.Data))
+	if err != nil {
+		t.Fatal("The result should have been a png", err)
+	}
+	if img.Bounds().Dx() != 50 || img.Bounds().Dy() != 50 {
+		t.Error("The result should have been 50x50 but was", img.Bounds())
+	}
+}
+
+func TestTransformChangesFormat(t *testing.T) {
+	root := setupTransformTest(t)
+	defer os.RemoveAll(root)
+
+	result, err := Transform(TransformRequest{Source: "gray.png", Format: "jpg"})
+	if err != nil || result.Mime != "image/jpeg" {
+		t.Error("Should have made a jpeg but got", result.Mime, err)
+	}
+}
+
+func TestTransformETag(t *testing.T) {
+	root := setupTransformTest(t)
+	defer os.RemoveAll(root)
+
+	req := TransformRequest{Source: "gray.png", Resize_width: 100}
+	result, _ := Transform(req)
+	etag, err := TransformETag(req)
+	if err != nil || etag != result.ETag {
+		t.Error("TransformETag should match the ETag of the result but was", etag, result.ETag)
+	}
+	other, _ := TransformETag(TransformRequest{Source: "gray.png", Resize_width: 101})
+	if other == etag {
+		t.Error("A different request should have a different ETag")
+	}
+	later := time.Now().Add(time.Hour)
+	os.Chtimes(filepath.Join(root, "gray.png"), later, later)
+	if changed, _ := TransformETag(req); changed == etag {
+		t.Error("Changing the source should change the ETag")
+	}
+}
+
+func TestTransformStaysInRoot(t *testing.T) {
+	root := setupTransformTest(t)
+	defer os.RemoveAll(root)
+	outside := filepath.Join(filepath.Dir(root), "outside.png")
+	MakeGrayFile(10, 10, outside)
+	defer os.Remove(outside)
+
+	_, err := Transform(TransformRequest{Source: "../outside.png"})
+	if err != ErrNoSource {
+		t.Error("A source outside the root should not have been found but got", err)
+	}
+}
+
+func TestTransformErrors(t *testing.T) {
+	root := setupTransformTest(t)
+	defer os.RemoveAll(root)
+
+	if _, err := Transform(TransformRequest{Source: "missing.png"}); err != ErrNoSource {
+		t.Error("A missing source should be ErrNoSource but was", err)
+	}
+	if _, err := Transform(TransformRequest{Source: "gray.png", Crop_to: image.Rect(300, 0, 500, 100)}); err == nil {
+		t.Error("Cropping outside the image should have thrown an error")
+	}
+	if _, err := Transform(TransformRequest{Source: "gray.png", Resize_width: 100000}); err == nil {
+		t.Error("Resizing too large should have thrown an error")
+	}
+	InjectSourceRoot("")
+	if _, err := Transform(TransformRequest{Source: "gray.png"}); err != ErrNoSource {
+		t.Error("Without a source root nothing should be found but got", err)
+	}
+}
+
+func TestTransformIsRefusedWhenBusy(t *testing.T) {
+	root := setupTransformTest(t)
+	defer os.RemoveAll(root)
+	WaitForJobs()
+	StartWorkers(1, 1)
+	defer StartWorkers(defaultWorkers, defaultQueueLength)
+
+	currentPool().transforms <- struct{}{}
+	if _, err := Transform(TransformRequest{Source: "gray.png"}); err != ErrTransformBusy {
+		t.Error("A transform while every slot is taken should have been ErrTransformBusy but was", err)
+	}
+	<-currentPool().transforms
+	if _, err := Transform(TransformRequest{Source: "gray.png"}); err != nil {
+		t.Error("A transform with a free slot unexpectedly threw an error", err)
+	}
+	if len(currentPool().transforms) != 0 {
+		t.Error("The transform should have given back its slot")
+	}
+}
+
+func TestTransformDoesNotFollowSymlinksOut(t *testing.T) {
+	root := setupTransformTest(t)
+	defer os.RemoveAll(root)
+	outside := filepath.Join(filepath.Dir(root), "outside-link-target.png")
+	MakeGrayFile(10, 10, outside)
+	defer os.Remove(outside)
+	os.Symlink(outside, filepath.Join(root, "link.png"))
+
+	if _, err := Transform(TransformRequest{Source: "link.png"}); err != ErrNoSource {
+		t.Error("A symlink out of the root should not have been followed but got", err)
+	}
+}
@@ -0,0 +1,135 @@
+/*
+Copyright 2014 Helix Digital
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"errors"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrQueueFull is returned by NewJob when every worker is busy and the
+// queue has no room for another job
+var ErrQueueFull = errors.New("The job queue is full")
+
+// A fixed number of workers that take jobs, oldest first, off a
+// queue of limited length, and as many slots for transforms. This
+// bounds how many images are decoded in memory at once.
+type workerPool struct {
+	queue  chan *jobRun
+	active int32
+	// holds a token for each transform that is running
+	transforms chan struct{}
+}
+
+var pool *workerPool
+var pool_lock sync.Mutex
+
+// The size of the pool used if StartWorkers is never called
+var defaultWorkers = runtime.NumCPU()
+var defaultQueueLength = 100
+
+// StartWorkers starts the given number of workers and a queue that holds
+// at most queuelength jobs that are waiting for a worker. As many
+// transforms as there are workers may run at once, beside the jobs.
+// Call it once, before the first job is requested. If it is called
+// again the workers it started before run the jobs already queued for
+// them and then stop.
+func StartWorkers(workers int, queuelength int) {
+	pool_lock.Lock()
+	defer pool_lock.Unlock()
+	if pool != nil {
+		close(pool.queue)
+	}
+	pool = newWorkerPool(workers, queuelength)
+}
+
+func newWorkerPool(workers int, queuelength int) *workerPool {
+	p := &workerPool{
+		queue:      make(chan *jobRun, queuelength),
+		transforms: make(chan struct{}, workers),
+	}
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+func currentPool() *workerPool {
+	pool_lock.Lock()
+	defer pool_lock.Unlock()
+	return startedPool()
+}
+
+// The pool, started with the default size if StartWorkers was never
+// called. pool_lock must be held.
+func startedPool() *workerPool {
+	if pool == nil {
+		pool = newWorkerPool(defaultWorkers, defaultQueueLength)
+	}
+	return pool
+}
+
+func (self *workerPool) work() {
+	for run := range self.queue {
+		atomic.AddInt32(&self.active, 1)
+		runPipeline(run)
+		atomic.AddInt32(&self.active, -1)
+		running.Done()
+	}
+}
+
+// Puts the job at the back of the queue of the current pool. The pool
+// stays locked so that StartWorkers cannot close the queue meanwhile.
+func enqueue(run *jobRun) bool {
+	pool_lock.Lock()
+	defer pool_lock.Unlock()
+	return startedPool().enqueue(run)
+}
+
+// Puts the job at the back of the queue. Returns false, without
+// blocking, if the queue is full.
+func (self *workerPool) enqueue(run *jobRun) bool {
+	select {
+	case self.queue <- run:
+		return true
+	default:
+		return false
+	}
+}
+
+// QueueDepth is the number of jobs waiting for a worker
+func QueueDepth() int {
+	pool_lock.Lock()
+	defer pool_lock.Unlock()
+	if pool == nil {
+		return 0
+	}
+	return len(pool.queue)
+}
+
+// ActiveWorkers is the number of workers of the current pool that are
+// running a job
+func ActiveWorkers() int {
+	pool_lock.Lock()
+	defer pool_lock.Unlock()
+	if pool == nil {
+		return 0
+	}
+	return int(atomic.LoadInt32(&pool.active))
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2014 Helix Digital
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"image"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestQueueFillsThenRejects(t *testing.T) {
+	blocking := &blockingUpload{started: make(chan bool), release: make(chan bool)}
+	setupJobTest(blocking)
+	StartWorkers(1, 1)
+	defer StartWorkers(defaultWorkers, defaultQueueLength)
+	MakeGrayFile(100, 100, "/tmp/queued.png")
+	defer os.Remove("/tmp/queued.png")
+	req := JobRequest{
+		Local_filename:    "/tmp/queued.png",
+		Crop_to:           image.Rect(0, 0, 50, 50),
+		Uploaded_filename: "queued.png",
+	}
+
+	running, _ := NewJob(req)
+	<-blocking.started
+	queued, err := NewJob(req)
+	if err != nil {
+		t.Fatal("The second job should have been queued but threw", err)
+	}
+	if report, _ := JobStatus(queued); report.Status != "Queued" {
+		t.Error("Status of a job waiting for a worker should have been 'Queued' but was", report.Status)
+	}
+	if QueueDepth() != 1 {
+		t.Error("QueueDepth should have been 1 but was", QueueDepth())
+	}
+	if ActiveWorkers() != 1 {
+		t.Error("ActiveWorkers should have been 1 but was", ActiveWorkers())
+	}
+	if _, err := NewJob(req); err != ErrQueueFull {
+		t.Error("The third job should have thrown ErrQueueFull but threw", err)
+	}
+
+	blocking.release <- true
+	<-blocking.started
+	blocking.release <- true
+	assertJobEndedWith(t, running, "Done")
+	assertJobEndedWith(t, queued, "Done")
+	for i := 0; i < 200 && ActiveWorkers() != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if ActiveWorkers() != 0 {
+		t.Error("ActiveWorkers should have been 0 once the jobs were done but was", ActiveWorkers())
+	}
+}
+
+func TestStartWorkersAgainStopsTheOldWorkers(t *testing.T) {
+	StartWorkers(1, 1)
+	old := pool
+	StartWorkers(defaultWorkers, defaultQueueLength)
+	if _, open := <-old.queue; open {
+		t.Error("Starting workers again should have closed the queue of the old ones")
+	}
+}
+
+func TestStatsWithoutWorkers(t *testing.T) {
+	pool_lock.Lock()
+	started := pool
+	pool = nil
+	pool_lock.Unlock()
+	defer func() {
+		pool_lock.Lock()
+		pool = started
+		pool_lock.Unlock()
+	}()
+
+	if QueueDepth() != 0 || ActiveWorkers() != 0 {
+		t.Error("Without workers QueueDepth and ActiveWorkers should have been 0 but were", QueueDepth(), ActiveWorkers())
+	}
+	if pool != nil {
+		t.Error("Reading the stats should not have started any workers")
+	}
+}
+
+func TestCancelQueuedJob(t *testing.T) {
+	blocking := &blockingUpload{started: make(chan bool), release: make(chan bool)}
+	setupJobTest(blocking)
+	StartWorkers(1, 1)
+	defer StartWorkers(defaultWorkers, defaultQueueLength)
+	MakeGrayFile(100, 100, "/tmp/queued.png")
+	defer os.Remove("/tmp/queued.png")
+	req := JobRequest{
+		Local_filename:    "/tmp/queued.png",
+		Crop_to:           image.Rect(0, 0, 50, 50),
+		Uploaded_filename: "queued.png",
+	}
+
+	running, _ := NewJob(req)
+	<-blocking.started
+	queued, _ := NewJob(req)
+	if err := CancelJob(queued); err != nil {
+		t.Fatal("Cancelling a queued job unexpectedly threw an error", err)
+	}
+	blocking.release <- true
+	assertJobEndedWith(t, running, "Done")
+	status := waitForStatus(queued, "Cancelled")
+	if status != "Cancelled" {
+		t.Error("Status of a cancelled queued job should have been 'Cancelled' but was", status)
+	}
+}
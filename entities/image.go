@@ -18,6 +18,8 @@ package entities
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"image"
 	"image/draw"
 	"image/gif"
@@ -36,23 +38,81 @@ const (
 	Png
 )
 
+// ErrUnsupportedFormat is returned by NewImage for data that is not a
+// jpg, gif or png
+var ErrUnsupportedFormat = errors.New("Unsupported format")
+
+// The Format of each name the image package registers a decoder as
+var decoderFormats = map[string]Format{
+	"jpeg": Jpg,
+	"gif":  Gif,
+	"png":  Png,
+}
+
+var formatNames = map[Format]string{
+	Jpg: "jpg",
+	Gif: "gif",
+	Png: "png",
+}
+
+// The name a job request uses for the format, such as "jpg"
+func (self Format) String() string {
+	if name, ok := formatNames[self]; ok {
+		return name
+	}
+	return fmt.Sprintf("Format(%d)", int(self))
+}
+
+var mimetypes = map[Format]string{
+	Jpg: "image/jpeg",
+	Png: "image/png",
+	Gif: "image/gif",
+}
+
+// Mime is the mime type of images encoded in this format
+func (self Format) Mime() string {
+	return mimetypes[self]
+}
+
+// FormatOfMime returns the Format with the given mime type, if there is one
+func FormatOfMime(mime string) (Format, bool) {
+	for format, name := range mimetypes {
+		if name == mime {
+			return format, true
+		}
+	}
+	return Png, false
+}
+
 type Image struct {
 	Img    image.Image
 	Format Format
 }
 
+// Mime is the mime type of what Encode and Reader write. It follows
+// Format, so set Format rather than choosing a mime type separately.
+func (self Image) Mime() string {
+	return self.Format.Mime()
+}
+
 // creates an io.Reader of image from entities.Image
 func (self Image) Reader() io.Reader {
 	output := new(bytes.Buffer)
+	self.Encode(output)
+	return output
+}
+
+// Encode writes the image to w in its format
+func (self Image) Encode(w io.Writer) error {
 	switch self.Format {
 	case Jpg:
-		jpeg.Encode(output, self.Img, &jpeg.Options{85})
+		return jpeg.Encode(w, self.Img, &jpeg.Options{85})
 	case Gif:
-		gif.Encode(output, self.Img, &gif.Options{256, nil, nil})
+		return gif.Encode(w, self.Img, &gif.Options{256, nil, nil})
 	case Png:
-		png.Encode(output, self.Img)
+		return png.Encode(w, self.Img)
 	}
-	return output
+	return fmt.Errorf("Cannot encode format %d", self.Format)
 }
 
 // CropTo returns a copy of this image that has been cropped
@@ -70,11 +130,20 @@ func (self Image) ResizeTo(w uint, h uint) Image {
 }
 
 // NewImage taking a reader and if it correctly decodes as one of
-// Jpg, Gif or Png will return an entity.Image struct
-func NewImage(rdr io.Reader, format Format) (Image, error) {
-	src, _, err := image.Decode(rdr)
+// Jpg, Gif or Png will return an entity.Image struct. The format is
+// recognised from the magic bytes at the start of the data, whatever
+// the data was called. Anything else is ErrUnsupportedFormat.
+func NewImage(rdr io.Reader) (Image, error) {
+	src, name, err := image.Decode(rdr)
+	if err == image.ErrFormat {
+		return Image{}, ErrUnsupportedFormat
+	}
 	if err != nil {
 		return Image{}, err
 	}
+	format, ok := decoderFormats[name]
+	if !ok {
+		return Image{}, fmt.Errorf("%w: %s", ErrUnsupportedFormat, name)
+	}
 	return Image{Img: src, Format: format}, nil
 }
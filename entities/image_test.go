@@ -16,7 +16,65 @@ limitations under the License.
 
 package entities
 
-import "testing"
+import (
+	"bytes"
+	"errors"
+	"image"
+	"net/http"
+	"testing"
+)
 
 func TestImageReader(t *testing.T) {
 }
+
+func TestImageEncode(t *testing.T) {
+	gray := image.NewGray(image.Rect(0, 0, 20, 10))
+	for _, format := range []Format{Jpg, Gif, Png} {
+		var buf bytes.Buffer
+		if err := (Image{Img: gray, Format: format}).Encode(&buf); err != nil {
+			t.Error("Encoding format", format, "unexpectedly threw an error", err)
+		}
+		decoded, err := NewImage(&buf)
+		if err != nil || decoded.Img.Bounds() != gray.Bounds() || decoded.Format != format {
+			t.Error("The encoded image should have decoded to the same size but got", err)
+		}
+	}
+	var buf bytes.Buffer
+	if err := (Image{Img: gray, Format: 42}).Encode(&buf); err == nil {
+		t.Error("Encoding an unknown format should have thrown an error")
+	}
+}
+
+func TestNewImageRejectsUnsupportedFormats(t *testing.T) {
+	for _, data := range []string{"", "not an image", "BM\x36\x00\x00\x00", "RIFF\x00\x00\x00\x00WEBPVP8 "} {
+		if _, err := NewImage(bytes.NewBufferString(data)); !errors.Is(err, ErrUnsupportedFormat) {
+			t.Errorf("Decoding %q should have been an unsupported format but got %v", data, err)
+		}
+	}
+}
+
+func TestFormatString(t *testing.T) {
+	for format, name := range map[Format]string{Jpg: "jpg", Gif: "gif", Png: "png", 42: "Format(42)"} {
+		if format.String() != name {
+			t.Error("Expected", name, "but got", format.String())
+		}
+	}
+}
+
+func TestImageMimeIsWhatEncodeWrites(t *testing.T) {
+	gray := image.NewGray(image.Rect(0, 0, 20, 10))
+	for _, format := range []Format{Jpg, Gif, Png} {
+		img := Image{Img: gray, Format: format}
+		var buf bytes.Buffer
+		img.Encode(&buf)
+		if sniffed := http.DetectContentType(buf.Bytes()); sniffed != img.Mime() {
+			t.Errorf("Format %d should have been encoded as %s but was %s", format, img.Mime(), sniffed)
+		}
+		if found, ok := FormatOfMime(img.Mime()); !ok || found != format {
+			t.Errorf("The format of %s should have been %d but was %d", img.Mime(), format, found)
+		}
+	}
+	if _, ok := FormatOfMime("image/webp"); ok {
+		t.Error("An unknown mime type should not have had a format")
+	}
+}
@@ -17,13 +17,27 @@ limitations under the License.
 // Entities are the basic data elements with their basic operations.
 package entities
 
-import "time"
+import (
+	"strings"
+	"time"
+)
 
 // Messages that each job returns to notify listeners of its status
 type StatusMsg struct {
 	Statuscode int
 	Status     string
 	Err        error
+	// the Uploaded_filename of the output this msg is about, or empty if it
+	// is about the whole job
+	Output string
+	// how many times the output has been sent to the Uploader, or 0 if it
+	// has not been yet
+	Attempts int
+	// how each destination fared in the last attempt, if the Uploader
+	// sends the output to more than one
+	Destinations []DestinationStatus
+	// the input of the job, once it has been decoded
+	Source *SourceImage
 }
 
 // JobStore is the plugin that provides a job API in front of the database
@@ -36,6 +50,7 @@ type JobStore interface {
 	AssignFreeId() int
 	GetJob(int) (Job, bool)
 	Replace(int, Job)
+	AllJobs() []Job
 }
 
 // Job encapsulates the concept of performing the series of cropping,
@@ -53,6 +68,44 @@ type Job struct {
 	Created time.Time
 	// the time of the most recent change to this data structure
 	Modified time.Time
+	// the status of each of the images the job makes
+	Outputs []OutputStatus
+	// the id of the API key that requested this job, or empty if it was
+	// requested without one
+	Client string
+	// the image the job read, or the zero SourceImage until it is decoded
+	Source SourceImage
+}
+
+// SourceImage describes the image a job read, as it was decoded
+type SourceImage struct {
+	// recognised from the image itself: "jpg", "gif" or "png"
+	Format string
+	Width  int
+	Height int
+}
+
+// OutputStatus is the status of one of the images that a job makes
+type OutputStatus struct {
+	// the name the image is uploaded as
+	Uploaded_filename string
+	// the human-readable description of the most-recently reported status of this image
+	Status string
+	// if Status starts with the substring "Error" then Err contains the binary error and `nil` otherwise
+	Err error
+	// how many times the image has been sent to the Uploader
+	Upload_attempts int
+	// how each destination fared, if the Uploader sends the image to more
+	// than one
+	Destinations []DestinationStatus
+}
+
+// DestinationStatus is how one of the places an image is uploaded to fared
+type DestinationStatus struct {
+	// the name the destination was given
+	Destination string
+	// nil if the image was stored there
+	Err error
 }
 
 // Returns a Job datastructure initialised with defaults plus the
@@ -67,3 +120,15 @@ func CreateJob(id int, c <-chan StatusMsg) Job {
 		Modified:   time.Now(),
 	}
 }
+
+// Finished reports whether the job has stopped running, either because
+// it is done, was cancelled, or because it failed or timed out. A job
+// whose images were deleted afterwards is finished too.
+func (self Job) Finished() bool {
+	return self.Status == "Done" ||
+		self.Status == "Deleted" ||
+		self.Status == "Timed out" ||
+		self.Status == "Cancelled" ||
+		self.Status == "Unsupported format" ||
+		strings.HasPrefix(self.Status, "Error")
+}
@@ -0,0 +1,41 @@
+/*
+Copyright 2014 Helix Digital
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package entities
+
+import "testing"
+
+func TestFinished(t *testing.T) {
+	finished := map[string]bool{
+		"Starting":               false,
+		"Reading the file":       false,
+		"Uploading":              false,
+		"Done":                   true,
+		"Error reading the file": true,
+		"Error in uploading":     true,
+		"Timed out":              true,
+		"Cancelled":              true,
+		"Deleted":                true,
+		"Error deleting":         true,
+		"Unsupported format":     true,
+	}
+	for status, expected := range finished {
+		job := Job{Status: status}
+		if job.Finished() != expected {
+			t.Errorf("Finished() for status '%s' should have been %v", status, expected)
+		}
+	}
+}
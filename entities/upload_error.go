@@ -0,0 +1,44 @@
+/*
+Copyright 2014 Helix Digital
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package entities
+
+// UploadError is an error from an Uploader that says whether the upload
+// might succeed if it were tried again
+type UploadError struct {
+	Err       error
+	Temporary bool
+}
+
+func (self UploadError) Error() string {
+	return self.Err.Error()
+}
+
+func (self UploadError) Unwrap() error {
+	return self.Err
+}
+
+// PermanentUploadError marks an error as one that trying the upload
+// again will not fix, such as a name the storage provider refuses
+func PermanentUploadError(err error) error {
+	return UploadError{Err: err, Temporary: false}
+}
+
+// TemporaryUploadError marks an error as one that may go away, such as
+// the storage provider being too busy
+func TemporaryUploadError(err error) error {
+	return UploadError{Err: err, Temporary: true}
+}
@@ -0,0 +1,41 @@
+/*
+Copyright 2014 Helix Digital
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package entities
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestUploadError(t *testing.T) {
+	cause := errors.New("SlowDown")
+	err := fmt.Errorf("Uploading avatar.png: %w", TemporaryUploadError(cause))
+	var uplerr UploadError
+	if !errors.As(err, &uplerr) || !uplerr.Temporary {
+		t.Error("A wrapped temporary error should have been found as temporary but was", uplerr)
+	}
+	if !errors.Is(err, cause) {
+		t.Error("The cause should have been found in the error")
+	}
+	if err.Error() != "Uploading avatar.png: SlowDown" {
+		t.Error("The error should have read as its cause but was", err)
+	}
+	if errors.As(PermanentUploadError(cause), &uplerr); uplerr.Temporary {
+		t.Error("A permanent error should not have been temporary")
+	}
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2014 Helix Digital
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package entities
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// UploadOptions describes how an uploaded image is to be served. Blank
+// fields are left to the storage provider.
+type UploadOptions struct {
+	// such as "public, max-age=86400"
+	Cache_control string
+	// such as `attachment; filename="avatar.png"`
+	Content_disposition string
+	// such as "gzip", for images that are stored compressed
+	Content_encoding string
+	// kept with the image, and sent back as x-amz-meta-<name> headers by S3
+	Metadata map[string]string
+	// tags for the storage provider to sort images by, such as for
+	// lifecycle rules
+	Tags map[string]string
+}
+
+// UploadOptionsError says which field of UploadOptions is not valid
+type UploadOptionsError struct {
+	Field  string
+	Reason string
+}
+
+func (self UploadOptionsError) Error() string {
+	return self.Field + " " + self.Reason
+}
+
+// The limits S3 puts on metadata and tags
+const (
+	maxMetadataSize = 2048
+	maxTags         = 10
+	maxTagKey       = 128
+	maxTagValue     = 256
+)
+
+var metadataName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+var tagText = regexp.MustCompile(`^[\p{L}\p{Z}\p{N}_.:/=+@-]*$`)
+
+// Check returns an UploadOptionsError if any field cannot be sent as a
+// header, or is beyond the limits of S3
+func (self UploadOptions) Check() error {
+	headers := map[string]string{
+		"cache_control":       self.Cache_control,
+		"content_disposition": self.Content_disposition,
+		"content_encoding":    self.Content_encoding,
+	}
+	for field, value := range headers {
+		if !isHeaderText(value) {
+			return UploadOptionsError{field, "may only hold printable ASCII"}
+		}
+	}
+	size := 0
+	for name, value := range self.Metadata {
+		if !metadataName.MatchString(name) {
+			return UploadOptionsError{"metadata", fmt.Sprintf("name %q may only hold letters, digits, - and _", name)}
+		}
+		if !isHeaderText(value) {
+			return UploadOptionsError{"metadata", fmt.Sprintf("%s may only hold printable ASCII", name)}
+		}
+		size += len(name) + len(value)
+	}
+	if size > maxMetadataSize {
+		return UploadOptionsError{"metadata", fmt.Sprintf("must be no more than %d bytes", maxMetadataSize)}
+	}
+	if len(self.Tags) > maxTags {
+		return UploadOptionsError{"tags", fmt.Sprintf("must be no more than %d", maxTags)}
+	}
+	for key, value := range self.Tags {
+		if key == "" || len(key) > maxTagKey || !tagText.MatchString(key) {
+			return UploadOptionsError{"tags", fmt.Sprintf("key %q must be 1 to %d letters, digits, spaces or _.:/=+-@", key, maxTagKey)}
+		}
+		if len(value) > maxTagValue || !tagText.MatchString(value) {
+			return UploadOptionsError{"tags", fmt.Sprintf("%s must be up to %d letters, digits, spaces or _.:/=+-@", key, maxTagValue)}
+		}
+	}
+	return nil
+}
+
+// Over returns the options with each blank field taken from defaults.
+// Metadata and tags are merged, the options' own winning.
+func (self UploadOptions) Over(defaults UploadOptions) UploadOptions {
+	if self.Cache_control == "" {
+		self.Cache_control = defaults.Cache_control
+	}
+	if self.Content_disposition == "" {
+		self.Content_disposition = defaults.Content_disposition
+	}
+	if self.Content_encoding == "" {
+		self.Content_encoding = defaults.Content_encoding
+	}
+	self.Metadata = mergeStrings(defaults.Metadata, self.Metadata)
+	self.Tags = mergeStrings(defaults.Tags, self.Tags)
+	return self
+}
+
+func mergeStrings(under map[string]string, over map[string]string) map[string]string {
+	if len(under) == 0 {
+		return over
+	}
+	merged := make(map[string]string, len(under)+len(over))
+	for key, value := range under {
+		merged[key] = value
+	}
+	for key, value := range over {
+		merged[key] = value
+	}
+	return merged
+}
+
+func isHeaderText(value string) bool {
+	for _, c := range []byte(value) {
+		if c < ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2014 Helix Digital
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package entities
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUploadOptionsCheck(t *testing.T) {
+	good := UploadOptions{
+		Cache_control:       "public, max-age=86400",
+		Content_disposition: `attachment; filename="avatar.png"`,
+		Metadata:            map[string]string{"user-id": "42", "source_app": "web"},
+		Tags:                map[string]string{"kind": "avatar", "expires on": "2026-12-01"},
+	}
+	if err := good.Check(); err != nil {
+		t.Error("The options should have been valid but threw", err)
+	}
+
+	bad := map[string]UploadOptions{
+		"cache_control":       {Cache_control: "public\r\nX-Injected: 1"},
+		"content_disposition": {Content_disposition: "attachment; filename=\"café.png\""},
+		"metadata":            {Metadata: map[string]string{"has space": "x"}},
+		"tags":                {Tags: map[string]string{"": "empty key"}},
+	}
+	for field, options := range bad {
+		err, ok := options.Check().(UploadOptionsError)
+		if !ok || err.Field != field {
+			t.Error("The options should have been refused for", field, "but threw", err)
+		}
+	}
+
+	big := UploadOptions{Metadata: map[string]string{"big": strings.Repeat("x", 2048)}}
+	if err := big.Check(); err == nil {
+		t.Error("Metadata over 2KB should have been refused")
+	}
+	many := UploadOptions{Tags: map[string]string{}}
+	for _, key := range strings.Split("a b c d e f g h i j k", " ") {
+		many.Tags[key] = "x"
+	}
+	if err := many.Check(); err == nil {
+		t.Error("More than 10 tags should have been refused")
+	}
+}
+
+func TestUploadOptionsOver(t *testing.T) {
+	defaults := UploadOptions{
+		Cache_control: "public, max-age=86400",
+		Metadata:      map[string]string{"server": "imageserver", "env": "prod"},
+	}
+	options := UploadOptions{
+		Content_disposition: "inline",
+		Metadata:            map[string]string{"env": "staging"},
+	}.Over(defaults)
+
+	if options.Cache_control != "public, max-age=86400" || options.Content_disposition != "inline" {
+		t.Error("Blank fields should have come from the defaults but the options were", options)
+	}
+	if options.Metadata["server"] != "imageserver" || options.Metadata["env"] != "staging" {
+		t.Error("Metadata should have been merged, the options winning, but was", options.Metadata)
+	}
+	if defaults.Metadata["env"] != "prod" {
+		t.Error("The defaults should not have been changed but were", defaults.Metadata)
+	}
+}
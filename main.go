@@ -18,30 +18,201 @@ package main
 
 import (
 	"flag"
+	"log"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/helixdigital/imageserver/core"
+	"github.com/helixdigital/imageserver/entities"
+	"github.com/helixdigital/imageserver/plugin/fetch"
+	"github.com/helixdigital/imageserver/plugin/notify"
 	"github.com/helixdigital/imageserver/plugin/presentation"
 	"github.com/helixdigital/imageserver/plugin/storage"
 	"github.com/helixdigital/imageserver/plugin/upload"
 )
 
 func injectDependencies() {
-	uploader := upload.NewAmazonS3Upload(s3accesskey, s3secretkey, s3bucketname)
-	core.InjectUploader(uploader)
+	core.InjectUploader(newUploader())
+	defaults := entities.UploadOptions{Cache_control: cachecontrol}
+	if err := defaults.Check(); err != nil {
+		log.Fatal("Bad --cachecontrol: ", err)
+	}
+	core.InjectUploadDefaults(defaults)
+	if retries.Max_attempts < 1 {
+		log.Fatal("--uploadattempts must be at least 1")
+	}
+	core.InjectRetryPolicy(retries)
+	var callbackallowed []string
+	if callbackallow != "" {
+		callbackallowed = strings.Split(callbackallow, ",")
+	}
+	callbackguard, err := fetch.NewGuard(callbackallowed)
+	if err != nil {
+		log.Fatal("Bad --callbackallow: ", err)
+	}
+	core.InjectNotifier(notify.NewWebhook(webhooksecret, callbackguard))
+	core.InjectSourceRoot(sourceroot)
+	core.InjectMaxTransformSize(transformmax)
+	core.InjectSpool(spooldir, maxupload)
+	var allowed []string
+	if fetchallow != "" {
+		allowed = strings.Split(fetchallow, ",")
+	}
+	fetcher, err := fetch.NewHTTPFetcher(maxupload, allowed)
+	if err != nil {
+		log.Fatal("Bad --fetchallow: ", err)
+	}
+	core.InjectFetcher(fetcher)
+	if inputroots != "" {
+		if err := core.InjectInputRoots(filepath.SplitList(inputroots)); err != nil {
+			log.Fatal(err)
+		}
+	}
 
-	store := storage.NewJobStore()
-	core.InjectJobstore(&store)
-	core.InjectStorageReporter(&store)
+	policy := storage.Retention{MaxAge: retention, MaxJobs: maxjobs}
+	if jobstorefile == "" {
+		store := storage.NewJobStore()
+		core.InjectJobstore(&store)
+		core.InjectStorageReporter(&store)
+		storage.StartReaper(&store, policy, time.Minute)
+		return
+	}
+	store, err := storage.NewFileJobStore(jobstorefile)
+	if err != nil {
+		log.Fatal("Cannot open the job store: ", err)
+	}
+	core.InjectJobstore(store)
+	core.InjectStorageReporter(store)
+	storage.StartReaper(store, policy, time.Minute)
+}
+
+// The uploader for --backend. More than one backend, separated by
+// commas, are all sent each image as --fanout says.
+func newUploader() core.Uploader {
+	names := strings.Split(backend, ",")
+	if len(names) == 1 {
+		return newBackend(backend)
+	}
+	policy, err := upload.FanOutPolicyNamed(fanout)
+	if err != nil {
+		log.Fatal("--fanout must be all or best, not ", fanout)
+	}
+	var destinations []upload.Destination
+	for _, name := range names {
+		destinations = append(destinations, upload.Destination{Name: name, Backend: newBackend(name)})
+	}
+	uploader, err := upload.NewFanOutUpload(policy, destinations...)
+	if err != nil {
+		log.Fatal("Bad --backend: ", err)
+	}
+	return uploader
+}
+
+func newBackend(name string) core.Uploader {
+	switch name {
+	case "s3":
+		uploader, err := upload.NewAmazonS3Upload(s3accesskey, s3secretkey, s3bucketname, s3config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return uploader
+	case "fs":
+		perm, err := strconv.ParseUint(fsperm, 8, 32)
+		if err != nil {
+			log.Fatal("Bad --fsperm: ", err)
+		}
+		uploader, err := upload.NewFilesystemUpload(fsroot, os.FileMode(perm), fsurl)
+		if err != nil {
+			log.Fatal("Cannot use --fsroot: ", err)
+		}
+		return uploader
+	}
+	log.Fatal("--backend must be s3 or fs, not ", name)
+	return nil
 }
 
 var portflag int
+var backend string
+var fanout string
+var fsroot string
+var fsperm string
+var fsurl string
+var cachecontrol string
+var retries = core.DefaultRetryPolicy
 var s3accesskey string
 var s3secretkey string
 var s3bucketname string
+var s3config = upload.DefaultS3Config
+var jobstorefile string
+var retention time.Duration
+var maxjobs int
+var workers int
+var webhooksecret string
+var queuelength int
+var sourceroot string
+var transformmax uint
+var urlsecret string
+var apikeyfile string
+var inputroots string
+var spooldir string
+var maxupload int64
+var fetchallow string
+var callbackallow string
 
 func handleFlags() {
 	flag.IntVar(&portflag, "port", 9877, "The port the app will run on")
+	flag.StringVar(
+		&backend,
+		"backend",
+		envOr("IMAGESERVER_BACKEND", "s3"),
+		"Where images are uploaded to: s3 or fs, or both separated by a comma",
+	)
+	flag.StringVar(
+		&fanout,
+		"fanout",
+		envOr("IMAGESERVER_FANOUT", "all"),
+		"With more than one --backend, whether all must store an image (all) or any one (best)",
+	)
+	flag.StringVar(
+		&fsroot,
+		"fsroot",
+		envOr("IMAGESERVER_FS_ROOT", "images"),
+		"The directory images are uploaded to with --backend=fs",
+	)
+	flag.StringVar(
+		&fsperm,
+		"fsperm",
+		"0644",
+		"The octal permissions of images uploaded with --backend=fs",
+	)
+	flag.StringVar(
+		&fsurl,
+		"fsurl",
+		os.Getenv("IMAGESERVER_FS_URL"),
+		"The URL --fsroot is served from. If blank, images have file:// URLs",
+	)
+	flag.StringVar(
+		&cachecontrol,
+		"cachecontrol",
+		envOr("IMAGESERVER_CACHE_CONTROL", "public, max-age=86400"),
+		"The Cache-Control header of uploaded images, unless a job gives its own",
+	)
+	flag.IntVar(
+		&retries.Max_attempts,
+		"uploadattempts",
+		retries.Max_attempts,
+		"The most times an image is sent to the backend before its upload fails",
+	)
+	flag.DurationVar(
+		&retries.Backoff,
+		"uploadbackoff",
+		retries.Backoff,
+		"How long to wait before trying a failed upload again. It doubles with each attempt",
+	)
 	flag.StringVar(
 		&s3accesskey,
 		"accesskey",
@@ -60,11 +231,178 @@ func handleFlags() {
 		os.Getenv("IMAGESERVER_S3_BUCKET_NAME"),
 		"Amazon S3 bucket name",
 	)
+	flag.StringVar(
+		&s3config.Region,
+		"s3region",
+		envOr("IMAGESERVER_S3_REGION", s3config.Region),
+		"Amazon S3 region of the bucket",
+	)
+	flag.StringVar(
+		&s3config.Endpoint,
+		"s3endpoint",
+		os.Getenv("IMAGESERVER_S3_ENDPOINT"),
+		"The URL of an S3-compatible store to use instead of Amazon",
+	)
+	flag.BoolVar(
+		&s3config.PathStyle,
+		"s3pathstyle",
+		s3config.PathStyle,
+		"Address the bucket in the path rather than the host name",
+	)
+	flag.StringVar(
+		&s3config.ACL,
+		"s3acl",
+		envOr("IMAGESERVER_S3_ACL", s3config.ACL),
+		"The canned ACL uploaded images get, such as private or public-read",
+	)
+	flag.StringVar(
+		&s3config.StorageClass,
+		"s3storageclass",
+		os.Getenv("IMAGESERVER_S3_STORAGE_CLASS"),
+		"The storage class of uploaded images. If blank, the bucket's default",
+	)
+	flag.StringVar(
+		&s3config.ServerSideEncryption,
+		"s3sse",
+		os.Getenv("IMAGESERVER_S3_SSE"),
+		"Server side encryption of uploaded images: AES256 or aws:kms. If blank, the bucket's default",
+	)
+	flag.StringVar(
+		&s3config.SSEKMSKeyId,
+		"s3ssekmskeyid",
+		os.Getenv("IMAGESERVER_S3_SSE_KMS_KEY_ID"),
+		"The KMS key uploaded images are encrypted with when --s3sse=aws:kms",
+	)
+	flag.Int64Var(
+		&s3config.PartSize,
+		"s3partsize",
+		s3config.PartSize,
+		"Images bigger than this many bytes are uploaded in parts of this size. At least 5MiB",
+	)
+	flag.IntVar(
+		&s3config.PartThreads,
+		"s3partthreads",
+		s3config.PartThreads,
+		"How many parts of an image are uploaded at once",
+	)
+	flag.StringVar(
+		&jobstorefile,
+		"jobstore",
+		os.Getenv("IMAGESERVER_JOBSTORE"),
+		"File to keep the job history in. If blank, jobs are kept in memory only",
+	)
+	flag.DurationVar(
+		&retention,
+		"retention",
+		7*24*time.Hour,
+		"How long finished jobs are kept before being purged. 0 keeps them forever",
+	)
+	flag.IntVar(
+		&maxjobs,
+		"maxjobs",
+		100000,
+		"The most jobs to keep. The oldest finished jobs are purged first. 0 is no limit",
+	)
+	flag.IntVar(
+		&workers,
+		"workers",
+		runtime.NumCPU(),
+		"The most images to process at once",
+	)
+	flag.IntVar(
+		&queuelength,
+		"queue",
+		100,
+		"The most jobs that can wait for a worker. Further requests get a 503",
+	)
+	flag.StringVar(
+		&webhooksecret,
+		"webhooksecret",
+		os.Getenv("IMAGESERVER_WEBHOOK_SECRET"),
+		"The secret that job completion callbacks are signed with. If blank, callbacks are refused",
+	)
+	flag.StringVar(
+		&sourceroot,
+		"sourceroot",
+		os.Getenv("IMAGESERVER_SOURCE_ROOT"),
+		"The directory /img/ serves transformed images from. If blank, /img/ is disabled",
+	)
+	flag.UintVar(
+		&transformmax,
+		"transformmax",
+		2048,
+		"The largest width or height, in pixels, that /img/ resizes to",
+	)
+	flag.StringVar(
+		&urlsecret,
+		"urlsecret",
+		os.Getenv("IMAGESERVER_URL_SECRET"),
+		"The secret URLs must be signed with. If blank, URLs need no signature",
+	)
+	flag.StringVar(
+		&apikeyfile,
+		"apikeys",
+		os.Getenv("IMAGESERVER_API_KEYS"),
+		"A JSON file of the API keys clients must use. If blank, no key is needed",
+	)
+	flag.StringVar(
+		&inputroots,
+		"inputroots",
+		os.Getenv("IMAGESERVER_INPUT_ROOTS"),
+		"The directories, separated like $PATH, that local_filename must be in. If blank, any file can be read",
+	)
+	flag.StringVar(
+		&spooldir,
+		"spooldir",
+		os.TempDir(),
+		"The directory images sent with a request are kept in until their job stops",
+	)
+	flag.Int64Var(
+		&maxupload,
+		"maxupload",
+		32<<20,
+		"The largest image, in bytes, that can be sent with or fetched for a request",
+	)
+	flag.StringVar(
+		&fetchallow,
+		"fetchallow",
+		os.Getenv("IMAGESERVER_FETCH_ALLOW"),
+		"Comma separated CIDRs of internal networks that source_url may fetch from",
+	)
+	flag.StringVar(
+		&callbackallow,
+		"callbackallow",
+		os.Getenv("IMAGESERVER_CALLBACK_ALLOW"),
+		"Comma separated CIDRs of internal networks that callback_url may notify",
+	)
 	flag.Parse()
 }
 
+// The environment variable, or def if it is not set
+func envOr(name string, def string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return def
+}
+
 func main() {
 	handleFlags()
 	injectDependencies()
+	if workers < 1 {
+		log.Fatal("--workers must be at least 1")
+	}
+	if queuelength < 1 {
+		log.Fatal("--queue must be at least 1")
+	}
+	core.StartWorkers(workers, queuelength)
+	presentation.InjectURLSecret(urlsecret)
+	if apikeyfile != "" {
+		keys, err := presentation.LoadAPIKeys(apikeyfile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		presentation.InjectAPIKeys(keys)
+	}
 	presentation.StartWebServer(portflag)
 }
@@ -0,0 +1,161 @@
+/*
+Copyright 2014 Helix Digital
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fetch
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+// ErrBlockedAddress is returned when a URL leads to an address that
+// may not be fetched from
+var ErrBlockedAddress = errors.New("The URL is at an address that may not be fetched from")
+
+// How many redirects are followed before giving up
+const maxRedirects = 5
+
+// The ranges that are blocked even though they are not loopback,
+// private, link-local or multicast
+var blockedNets = parseCIDRs("0.0.0.0/8", "100.64.0.0/10", "192.0.0.0/24", "198.18.0.0/15", "240.0.0.0/4", "64:ff9b::/96")
+
+// Guard keeps requests that this server makes to URLs it was given away
+// from loopback, private, link-local and other internal addresses, even
+// by way of a redirect or a DNS name, unless they are in Allowed.
+type Guard struct {
+	// internal networks that may be connected to after all
+	Allowed []*net.IPNet
+}
+
+// NewGuard is the Guard factory. allowed is a list of CIDRs, such as
+// "10.1.0.0/16", of internal networks that may be connected to.
+func NewGuard(allowed []string) (*Guard, error) {
+	self := &Guard{}
+	for _, cidr := range allowed {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		self.Allowed = append(self.Allowed, network)
+	}
+	return self, nil
+}
+
+// Client returns an http.Client that only connects to addresses the
+// Guard allows, and only follows http and https redirects
+func (self *Guard) Client(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: 5 * time.Second, Control: self.Control}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy:                 nil,
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   5 * time.Second,
+			ResponseHeaderTimeout: 10 * time.Second,
+			MaxIdleConns:          10,
+			IdleConnTimeout:       30 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return fmt.Errorf("Stopped after %d redirects", maxRedirects)
+			}
+			return checkScheme(req.URL)
+		},
+	}
+}
+
+// Control refuses to connect to blocked addresses. It is called by the
+// dialer of Client with the address the name resolved to, just before
+// connecting, so a DNS name or redirect that leads to one is refused too.
+func (self *Guard) Control(network string, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !self.allows(ip) {
+		return ErrBlockedAddress
+	}
+	return nil
+}
+
+// CheckURL returns an error unless the URL is http or https and its host
+// resolves only to addresses the Guard allows. It refuses a URL when it
+// is given to the server. Client checks again when it connects, since
+// the name may resolve elsewhere by then.
+func (self *Guard) CheckURL(rawurl string) error {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return err
+	}
+	if err := checkScheme(u); err != nil {
+		return err
+	}
+	ips, err := net.LookupIP(u.Hostname())
+	if err != nil {
+		return err
+	}
+	for _, ip := range ips {
+		if !self.allows(ip) {
+			return ErrBlockedAddress
+		}
+	}
+	return nil
+}
+
+func (self *Guard) allows(ip net.IP) bool {
+	for _, allowed := range self.Allowed {
+		if allowed.Contains(ip) {
+			return true
+		}
+	}
+	return !isBlocked(ip)
+}
+
+func isBlocked(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return true
+	}
+	for _, network := range blockedNets {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func checkScheme(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("Cannot use %s: only http and https URLs can be used", u.Redacted())
+	}
+	return nil
+}
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, _ := net.ParseCIDR(cidr)
+		networks = append(networks, network)
+	}
+	return networks
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2014 Helix Digital
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fetch
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestIsBlocked(t *testing.T) {
+	tests := map[string]bool{
+		"127.0.0.1":       true,
+		"10.1.2.3":        true,
+		"172.16.0.1":      true,
+		"192.168.1.1":     true,
+		"169.254.169.254": true,
+		"100.64.0.1":      true,
+		"0.0.0.0":         true,
+		"::1":             true,
+		"fd00::1":         true,
+		"fe80::1":         true,
+		"::ffff:10.0.0.1": true,
+		"93.184.216.34":   false,
+		"2606:2800::1":    false,
+	}
+	for ip, expected := range tests {
+		if isBlocked(net.ParseIP(ip)) != expected {
+			t.Error("isBlocked of", ip, "should have been", expected)
+		}
+	}
+}
+
+func TestGuardChecksURLs(t *testing.T) {
+	guard, _ := NewGuard([]string{"10.1.0.0/16"})
+	tests := map[string]bool{
+		"http://127.0.0.1/done":                    false,
+		"http://localhost:8080/done":               false,
+		"http://169.254.169.254/latest/meta-data/": false,
+		"http://[::1]/done":                        false,
+		"http://192.168.1.1/done":                  false,
+		"http://10.1.2.3/done":                     true,
+		"https://93.184.216.34/done":               true,
+		"ftp://93.184.216.34/done":                 false,
+	}
+	for url, allowed := range tests {
+		if err := guard.CheckURL(url); (err == nil) != allowed {
+			t.Error("CheckURL of", url, "should have allowed it:", allowed, "but threw", err)
+		}
+	}
+	if err := guard.CheckURL("http://10.2.0.1/"); !errors.Is(err, ErrBlockedAddress) {
+		t.Error("An internal address outside Allowed should have thrown ErrBlockedAddress but threw", err)
+	}
+}
+
+func TestNewGuardChecksAllowed(t *testing.T) {
+	if _, err := NewGuard([]string{"10.1.0.0"}); err == nil {
+		t.Error("A bad CIDR should have thrown an error")
+	}
+}
@@ -0,0 +1,117 @@
+/*
+Copyright 2014 Helix Digital
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Getting source images from elsewhere on the web is a detail of how
+// this server talks to the outside world, like uploading them.
+package fetch
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/helixdigital/imageserver/entities"
+)
+
+// ErrTooLarge is returned when the image is larger than MaxSize
+var ErrTooLarge = errors.New("The image at the URL is too large")
+
+// HTTPFetcher implements github.com/helixdigital/imageserver/core/Fetcher
+//
+// It GETs images over http and https. Its Guard keeps it from internal
+// addresses.
+type HTTPFetcher struct {
+	*Guard
+	client *http.Client
+	// the largest image, in bytes, that is fetched
+	MaxSize int64
+}
+
+// NewHTTPFetcher is the HTTPFetcher factory. allowed is a list of CIDRs,
+// such as "10.1.0.0/16", of internal networks that may be fetched from.
+func NewHTTPFetcher(maxsize int64, allowed []string) (*HTTPFetcher, error) {
+	guard, err := NewGuard(allowed)
+	if err != nil {
+		return nil, err
+	}
+	return &HTTPFetcher{Guard: guard, client: guard.Client(time.Minute), MaxSize: maxsize}, nil
+}
+
+// Fetch implements github.com/helixdigital/imageserver/core/Fetcher.
+// It returns the body of the response and its content type, which is
+// sniffed from the body rather than trusted from the headers. A body
+// that is not a jpeg, png or gif is refused with an error that wraps
+// entities.ErrUnsupportedFormat. Reading the body fails with ErrTooLarge
+// once more than MaxSize bytes are read.
+func (self *HTTPFetcher) Fetch(rawurl string) (io.ReadCloser, string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := checkScheme(u); err != nil {
+		return nil, "", err
+	}
+	resp, err := self.client.Get(u.String())
+	if err != nil {
+		return nil, "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, "", fmt.Errorf("Fetching %s responded %s", u.Redacted(), resp.Status)
+	}
+	if resp.ContentLength > self.MaxSize {
+		resp.Body.Close()
+		return nil, "", ErrTooLarge
+	}
+	buffered := bufio.NewReaderSize(io.LimitReader(resp.Body, self.MaxSize+1), 512)
+	head, err := buffered.Peek(512)
+	if err != nil && err != io.EOF {
+		resp.Body.Close()
+		return nil, "", err
+	}
+	mime := http.DetectContentType(head)
+	switch mime {
+	case "image/jpeg", "image/png", "image/gif":
+		return &limitedBody{Reader: buffered, closer: resp.Body, max: self.MaxSize}, mime, nil
+	}
+	resp.Body.Close()
+	return nil, "", fmt.Errorf("%s is %s, not an image: %w", u.Redacted(), mime, entities.ErrUnsupportedFormat)
+}
+
+// A response body that fails once it has given more than max bytes
+type limitedBody struct {
+	io.Reader
+	closer io.Closer
+	max    int64
+	read   int64
+}
+
+func (self *limitedBody) Read(p []byte) (int, error) {
+	n, err := self.Reader.Read(p)
+	self.read += int64(n)
+	if self.read > self.max {
+		return n, ErrTooLarge
+	}
+	return n, err
+}
+
+func (self *limitedBody) Close() error {
+	return self.closer.Close()
+}
@@ -0,0 +1,185 @@
+/*
+Copyright 2014 Helix Digital
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fetch
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/helixdigital/imageserver/entities"
+)
+
+func grayPNG(w int, h int) []byte {
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewGray(image.Rect(0, 0, w, h)))
+	return buf.Bytes()
+}
+
+// An origin server with an image, a page, and a redirect loop
+func newOrigin() *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/gray.png", func(w http.ResponseWriter, r *http.Request) {
+		// claims to be something else: the type is sniffed
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write(grayPNG(100, 100))
+	})
+	mux.HandleFunc("/page.html", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("<html><body>not an image</body></html>"))
+	})
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	})
+	mux.HandleFunc("/missing.png", http.NotFound)
+	return httptest.NewServer(mux)
+}
+
+// A fetcher that may fetch from the test origin on the loopback address
+func newTestFetcher(maxsize int64) *HTTPFetcher {
+	fetcher, _ := NewHTTPFetcher(maxsize, []string{"127.0.0.0/8", "::1/128"})
+	return fetcher
+}
+
+func TestFetchSniffsImage(t *testing.T) {
+	origin := newOrigin()
+	defer origin.Close()
+
+	body, mime, err := newTestFetcher(1 << 20).Fetch(origin.URL + "/gray.png")
+	if err != nil {
+		t.Fatal("Fetch unexpectedly threw an error", err)
+	}
+	defer body.Close()
+	if mime != "image/png" {
+		t.Error("The mime type should have been sniffed as image/png but was", mime)
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil || !bytes.Equal(data, grayPNG(100, 100)) {
+		t.Error("The body should have been the whole image but was", len(data), "bytes", err)
+	}
+}
+
+func TestFetchRefusesNonImages(t *testing.T) {
+	origin := newOrigin()
+	defer origin.Close()
+
+	if _, _, err := newTestFetcher(1 << 20).Fetch(origin.URL + "/page.html"); !errors.Is(err, entities.ErrUnsupportedFormat) {
+		t.Error("A page that is not an image should have been refused but got", err)
+	}
+}
+
+func TestFetchRefusesLargeImages(t *testing.T) {
+	origin := newOrigin()
+	defer origin.Close()
+
+	if _, _, err := newTestFetcher(100).Fetch(origin.URL + "/gray.png"); err != ErrTooLarge {
+		t.Error("An image over the limit should have thrown ErrTooLarge but threw", err)
+	}
+}
+
+func TestFetchFailsLargeImagesWithoutLength(t *testing.T) {
+	image := grayPNG(1000, 1000)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// flushing first leaves out the Content-Length
+		w.Write(image[:600])
+		w.(http.Flusher).Flush()
+		w.Write(image[600:])
+	}))
+	defer origin.Close()
+
+	body, _, err := newTestFetcher(int64(len(image) - 1)).Fetch(origin.URL)
+	if err != nil {
+		t.Fatal("Fetch should only fail once the limit is read but threw", err)
+	}
+	defer body.Close()
+	if _, err := ioutil.ReadAll(body); err != ErrTooLarge {
+		t.Error("Reading past the limit should have thrown ErrTooLarge but threw", err)
+	}
+}
+
+func TestFetchStopsRedirectLoops(t *testing.T) {
+	origin := newOrigin()
+	defer origin.Close()
+
+	if _, _, err := newTestFetcher(1 << 20).Fetch(origin.URL + "/loop"); err == nil || !strings.Contains(err.Error(), "redirects") {
+		t.Error("A redirect loop should have been stopped but got", err)
+	}
+}
+
+func TestFetchReportsErrorResponses(t *testing.T) {
+	origin := newOrigin()
+	defer origin.Close()
+
+	if _, _, err := newTestFetcher(1 << 20).Fetch(origin.URL + "/missing.png"); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Error("A 404 should have been reported but got", err)
+	}
+}
+
+func TestFetchBlocksInternalAddresses(t *testing.T) {
+	origin := newOrigin()
+	defer origin.Close()
+	fetcher, _ := NewHTTPFetcher(1<<20, nil)
+
+	_, _, err := fetcher.Fetch(origin.URL + "/gray.png")
+	if !errors.Is(err, ErrBlockedAddress) {
+		t.Error("The loopback address should have been blocked but got", err)
+	}
+	localhost := strings.Replace(origin.URL, "127.0.0.1", "localhost", 1)
+	if _, _, err := fetcher.Fetch(localhost + "/gray.png"); !errors.Is(err, ErrBlockedAddress) {
+		t.Error("A name that resolves to loopback should have been blocked but got", err)
+	}
+}
+
+func TestFetchBlocksRedirectsToInternalAddresses(t *testing.T) {
+	internal := newOrigin()
+	defer internal.Close()
+	// only the listener of the redirecting server is allowed
+	redirector := httptest.NewUnstartedServer(http.RedirectHandler(internal.URL+"/gray.png", http.StatusFound))
+	listener, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Skip("Cannot listen on 127.0.0.2", err)
+	}
+	redirector.Listener = listener
+	redirector.Start()
+	defer redirector.Close()
+	fetcher, _ := NewHTTPFetcher(1<<20, []string{"127.0.0.2/32"})
+
+	if _, _, err := fetcher.Fetch(redirector.URL); !errors.Is(err, ErrBlockedAddress) {
+		t.Error("A redirect to a blocked address should have been blocked but got", err)
+	}
+}
+
+func TestFetchRefusesOtherSchemes(t *testing.T) {
+	for _, url := range []string{"file:///etc/passwd", "ftp://example.com/a.png", "gopher://example.com"} {
+		if _, _, err := newTestFetcher(1 << 20).Fetch(url); err == nil {
+			t.Error("Fetching", url, "should have been refused")
+		}
+	}
+}
+
+func TestNewHTTPFetcherChecksAllowed(t *testing.T) {
+	if _, err := NewHTTPFetcher(1, []string{"not a network"}); err == nil {
+		t.Error("A bad CIDR should have thrown an error")
+	}
+}
@@ -0,0 +1,146 @@
+/*
+Copyright 2014 Helix Digital
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Telling clients that their jobs have finished is, like presentation,
+// a detail of how this server talks to the outside world.
+package notify
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/helixdigital/imageserver/core"
+	"github.com/helixdigital/imageserver/plugin/fetch"
+)
+
+// Webhook implements github.com/helixdigital/imageserver/core/Notifier
+//
+// It POSTs the Notification as JSON to the callback URL. The body is
+// signed so the receiver can check that it came from this server: the
+// X-Imageserver-Signature header is "sha256=" followed by the hex HMAC-SHA256,
+// keyed with the shared secret, of the X-Imageserver-Timestamp header, a
+// ".", and the body.
+//
+// Callback URLs are given by whoever requests a job, so the guard keeps
+// the POST, and any redirect it follows, away from internal addresses.
+// Without a secret anyone could forge a notification, so none is sent.
+type Webhook struct {
+	secret []byte
+	guard  *fetch.Guard
+	client *http.Client
+	// how many times a notification is tried before giving up
+	Attempts int
+	// the wait before the first retry. It doubles after each retry.
+	Backoff time.Duration
+}
+
+// ErrNoSecret is returned when a callback is asked for but the Webhook
+// has no secret to sign it with
+var ErrNoSecret = errors.New("Callbacks are not enabled: the server has no webhook secret")
+
+// NewWebhook is the Webhook factory. The secret is shared with the
+// receivers so that they can check the signature. If it is empty every
+// callback is refused. The guard decides which addresses may be
+// notified.
+func NewWebhook(secret string, guard *fetch.Guard) *Webhook {
+	return &Webhook{
+		secret:   []byte(secret),
+		guard:    guard,
+		client:   guard.Client(10 * time.Second),
+		Attempts: 6,
+		Backoff:  time.Second,
+	}
+}
+
+// Notify implements github.com/helixdigital/imageserver/core/Notifier.
+// A receiver that cannot be reached, or that responds with a 5xx or a
+// 429, is tried again after a backoff. Any other response other than a
+// 2xx is not retried, nor is a receiver at a blocked address.
+func (self *Webhook) Notify(url string, n core.Notification) error {
+	if len(self.secret) == 0 {
+		return ErrNoSecret
+	}
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	wait := self.Backoff
+	for attempt := 1; ; attempt++ {
+		retry, err := self.post(url, body)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= self.Attempts {
+			fmt.Printf("Giving up notifying %s of job %d: %s\n", url, n.Jobid, err)
+			return err
+		}
+		time.Sleep(wait)
+		wait = wait * 2
+	}
+}
+
+// Makes one attempt at delivering the body. Returns whether a failure
+// is worth retrying.
+func (self *Webhook) post(url string, body []byte) (bool, error) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set("X-Imageserver-Timestamp", timestamp)
+	req.Header.Set("X-Imageserver-Signature", "sha256="+Sign(self.secret, timestamp, body))
+	resp, err := self.client.Do(req)
+	if err != nil {
+		return !errors.Is(err, fetch.ErrBlockedAddress), err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	err = fmt.Errorf("Callback responded %s", resp.Status)
+	return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests, err
+}
+
+// CheckURL implements github.com/helixdigital/imageserver/core/URLChecker.
+// It refuses every callback URL if there is no secret, and otherwise
+// those that are not http or https, or whose host is at an address the
+// guard blocks.
+func (self *Webhook) CheckURL(url string) error {
+	if len(self.secret) == 0 {
+		return ErrNoSecret
+	}
+	return self.guard.CheckURL(url)
+}
+
+// Sign returns the hex HMAC-SHA256 of the timestamp and body, as sent in
+// the X-Imageserver-Signature header. Receivers can use it to check a
+// notification.
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,202 @@
+/*
+Copyright 2014 Helix Digital
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/helixdigital/imageserver/core"
+	"github.com/helixdigital/imageserver/plugin/fetch"
+)
+
+// Records what a webhook receiver was sent. The first `failures` calls
+// are answered with `failWith`.
+type receiver struct {
+	lock     sync.Mutex
+	calls    int
+	failures int
+	failWith int
+	bodies   [][]byte
+	headers  []http.Header
+}
+
+func (self *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.calls++
+	body, _ := ioutil.ReadAll(r.Body)
+	self.bodies = append(self.bodies, body)
+	self.headers = append(self.headers, r.Header)
+	if self.calls <= self.failures {
+		w.WriteHeader(self.failWith)
+	}
+}
+
+// A Webhook that may notify the receivers these tests start on loopback
+func newTestWebhook() *Webhook {
+	guard, _ := fetch.NewGuard([]string{"127.0.0.0/8"})
+	webhook := NewWebhook("s3cr3t", guard)
+	webhook.Attempts = 3
+	webhook.Backoff = time.Millisecond
+	return webhook
+}
+
+func TestNotifySendsSignedJSON(t *testing.T) {
+	rcv := &receiver{}
+	server := httptest.NewServer(rcv)
+	defer server.Close()
+
+	err := newTestWebhook().Notify(server.URL, core.Notification{Jobid: 7, Status: "Done"})
+	if err != nil {
+		t.Fatal("Notify unexpectedly threw an error", err)
+	}
+	if rcv.calls != 1 {
+		t.Fatal("Receiver should have been called once but was called", rcv.calls)
+	}
+	var n core.Notification
+	if err := json.Unmarshal(rcv.bodies[0], &n); err != nil || n.Jobid != 7 || n.Status != "Done" {
+		t.Error("Receiver should have got job 7 'Done' but got", string(rcv.bodies[0]))
+	}
+	if !bytes.Contains(rcv.bodies[0], []byte(`"jobid":7`)) || !bytes.Contains(rcv.bodies[0], []byte(`"status":"Done"`)) {
+		t.Error("The notification should have been sent with snake_case names but was", string(rcv.bodies[0]))
+	}
+	timestamp := rcv.headers[0].Get("X-Imageserver-Timestamp")
+	expected := "sha256=" + Sign([]byte("s3cr3t"), timestamp, rcv.bodies[0])
+	if rcv.headers[0].Get("X-Imageserver-Signature") != expected {
+		t.Error("Signature should have been", expected, "but was", rcv.headers[0].Get("X-Imageserver-Signature"))
+	}
+}
+
+func TestWebhookWithoutSecretRefusesCallbacks(t *testing.T) {
+	rcv := &receiver{}
+	server := httptest.NewServer(rcv)
+	defer server.Close()
+	guard, _ := fetch.NewGuard([]string{"127.0.0.0/8"})
+	webhook := NewWebhook("", guard)
+
+	if err := webhook.CheckURL(server.URL); err != ErrNoSecret {
+		t.Error("A callback URL should have been refused without a secret but got", err)
+	}
+	if err := webhook.Notify(server.URL, core.Notification{Jobid: 1, Status: "Done"}); err != ErrNoSecret || rcv.calls != 0 {
+		t.Error("A notification should not have been sent without a secret but got", err, "and", rcv.calls, "calls")
+	}
+}
+
+func TestNotifyRetriesServerErrors(t *testing.T) {
+	rcv := &receiver{failures: 2, failWith: 503}
+	server := httptest.NewServer(rcv)
+	defer server.Close()
+
+	err := newTestWebhook().Notify(server.URL, core.Notification{Jobid: 1, Status: "Done"})
+	if err != nil {
+		t.Error("Notify should have succeeded on the third attempt but threw", err)
+	}
+	if rcv.calls != 3 {
+		t.Error("Receiver should have been called 3 times but was called", rcv.calls)
+	}
+}
+
+func TestNotifyGivesUp(t *testing.T) {
+	rcv := &receiver{failures: 10, failWith: 500}
+	server := httptest.NewServer(rcv)
+	defer server.Close()
+
+	err := newTestWebhook().Notify(server.URL, core.Notification{Jobid: 1, Status: "Done"})
+	if err == nil {
+		t.Error("Notify should have given up with an error")
+	}
+	if rcv.calls != 3 {
+		t.Error("Receiver should have been called 3 times but was called", rcv.calls)
+	}
+}
+
+func TestNotifyDoesNotRetryClientErrors(t *testing.T) {
+	rcv := &receiver{failures: 10, failWith: 404}
+	server := httptest.NewServer(rcv)
+	defer server.Close()
+
+	newTestWebhook().Notify(server.URL, core.Notification{Jobid: 1, Status: "Done"})
+	if rcv.calls != 1 {
+		t.Error("A 404 should not have been retried but the receiver was called", rcv.calls)
+	}
+}
+
+func TestNotifyRetriesUnreachableReceiver(t *testing.T) {
+	server := httptest.NewServer(&receiver{})
+	url := server.URL
+	server.Close()
+
+	start := time.Now()
+	err := newTestWebhook().Notify(url, core.Notification{Jobid: 1, Status: "Done"})
+	if err == nil {
+		t.Error("Notifying a closed server should have thrown an error")
+	}
+	if time.Since(start) < 3*time.Millisecond {
+		t.Error("Notify should have backed off between attempts")
+	}
+}
+
+func TestNotifyRefusesInternalAddresses(t *testing.T) {
+	rcv := &receiver{}
+	server := httptest.NewServer(rcv)
+	defer server.Close()
+	guard, _ := fetch.NewGuard(nil)
+	webhook := NewWebhook("s3cr3t", guard)
+	webhook.Backoff = time.Second
+
+	start := time.Now()
+	err := webhook.Notify(server.URL, core.Notification{Jobid: 1, Status: "Done"})
+	if !errors.Is(err, fetch.ErrBlockedAddress) {
+		t.Error("Notifying a loopback address should have been blocked but threw", err)
+	}
+	if rcv.calls != 0 || time.Since(start) > webhook.Backoff {
+		t.Error("A blocked address should not have been called or retried but was called", rcv.calls, "times")
+	}
+	if err := webhook.CheckURL(server.URL); !errors.Is(err, fetch.ErrBlockedAddress) {
+		t.Error("CheckURL of a loopback address should have thrown ErrBlockedAddress but threw", err)
+	}
+}
+
+func TestNotifyRefusesRedirectsToInternalAddresses(t *testing.T) {
+	rcv := &receiver{}
+	internal := httptest.NewServer(rcv)
+	defer internal.Close()
+	// only the listener of the redirecting server is allowed
+	redirector := httptest.NewUnstartedServer(http.RedirectHandler(internal.URL, http.StatusTemporaryRedirect))
+	listener, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Skip("Cannot listen on 127.0.0.2", err)
+	}
+	redirector.Listener = listener
+	redirector.Start()
+	defer redirector.Close()
+	guard, _ := fetch.NewGuard([]string{"127.0.0.2/32"})
+
+	err = NewWebhook("s3cr3t", guard).Notify(redirector.URL, core.Notification{Jobid: 1, Status: "Done"})
+	if !errors.Is(err, fetch.ErrBlockedAddress) || rcv.calls != 0 {
+		t.Error("A redirect to an internal address should have been blocked but threw", err)
+	}
+}
@@ -0,0 +1,206 @@
+/*
+Copyright 2014 Helix Digital
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package presentation
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/helixdigital/imageserver/core"
+)
+
+// APIKey is one client of the server, as read from the API key file
+type APIKey struct {
+	// names the client in the jobs it requests and in `/stats`
+	Id string `json:"id"`
+	// the secret the client sends in the X-Api-Key header
+	Key string `json:"key"`
+	// what the client may do: "request", "status", "stats", "cancel",
+	// "delete" and "transform"
+	Scopes []string `json:"scopes"`
+	// the client may only upload, and delete, under these prefixes. If
+	// empty it may upload anywhere.
+	Upload_prefixes []string `json:"upload_prefixes"`
+}
+
+var apikeys []APIKey
+
+// The setter for the API keys that are accepted. While there are none
+// no key is needed.
+func InjectAPIKeys(keys []APIKey) {
+	apikeys = keys
+}
+
+// LoadAPIKeys reads a JSON list of APIKeys from the given file
+func LoadAPIKeys(filename string) ([]APIKey, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var keys []APIKey
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&keys); err != nil {
+		return nil, fmt.Errorf("Cannot read API keys from %s: %s", filename, err)
+	}
+	ids := make(map[string]bool)
+	for i, key := range keys {
+		if key.Id == "" || key.Key == "" {
+			return nil, fmt.Errorf("API key %d in %s needs an id and a key", i, filename)
+		}
+		if ids[key.Id] {
+			return nil, fmt.Errorf("API key id %s is used twice in %s", key.Id, filename)
+		}
+		ids[key.Id] = true
+	}
+	return keys, nil
+}
+
+type apiKeyContext struct{}
+
+// Wraps a handler so that it is only called for requests with an API
+// key that has the scope. If there are API keys and a URL secret, a
+// request without a key may instead be signed (see signed). Without
+// either the handler is always called.
+func guard(scope string, handler http.HandlerFunc) http.HandlerFunc {
+	bySignature := signed(handler)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(apikeys) == 0 || (requestKey(r) == "" && len(urlsecret) > 0) {
+			bySignature(w, r)
+			return
+		}
+		key, ok := findKey(requestKey(r))
+		if !ok {
+			http.Error(w, "A valid API key is needed", http.StatusUnauthorized)
+			return
+		}
+		if !key.hasScope(scope) {
+			http.Error(w, fmt.Sprintf("API key %s may not %s", key.Id, scope), http.StatusForbidden)
+			return
+		}
+		handler(w, r.WithContext(context.WithValue(r.Context(), apiKeyContext{}, key)))
+	}
+}
+
+// The key sent in the X-Api-Key header, or as a bearer token
+func requestKey(r *http.Request) string {
+	if key := r.Header.Get("X-Api-Key"); key != "" {
+		return key
+	}
+	return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+func findKey(secret string) (APIKey, bool) {
+	for _, key := range apikeys {
+		if subtle.ConstantTimeCompare([]byte(key.Key), []byte(secret)) == 1 {
+			return key, true
+		}
+	}
+	return APIKey{}, false
+}
+
+func (self APIKey) hasScope(scope string) bool {
+	for _, allowed := range self.Scopes {
+		if allowed == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// The API key the request was made with, if it was made with one
+func keyOf(r *http.Request) (APIKey, bool) {
+	key, ok := r.Context().Value(apiKeyContext{}).(APIKey)
+	return key, ok
+}
+
+// Whether the request may see or cancel the job. A request made with an
+// API key may only reach the jobs that were requested with that key.
+func mayAccessJob(r *http.Request, client string) bool {
+	key, ok := keyOf(r)
+	return !ok || key.Id == client
+}
+
+// Whether the request may see or cancel the job with the given jobid.
+// A job that does not exist is left for the handler to report.
+func mayAccessJobId(r *http.Request, jobid int) bool {
+	job, err := core.GetJob(jobid)
+	return err != nil || mayAccessJob(r, job.Client)
+}
+
+// Checks that the API key the request was made with, if any, may
+// upload every image of the job, and records the key on the job
+func authorizeJob(r *http.Request, jobreq *core.JobRequest) error {
+	key, ok := keyOf(r)
+	if !ok {
+		return nil
+	}
+	names := []string{jobreq.Uploaded_filename}
+	if len(jobreq.Outputs) > 0 {
+		names = names[:0]
+		for _, out := range jobreq.Outputs {
+			names = append(names, out.Uploaded_filename)
+		}
+	}
+	for _, name := range names {
+		if !key.mayUpload(name) {
+			return fmt.Errorf("API key %s may not upload %s", key.Id, name)
+		}
+	}
+	jobreq.Client = key.Id
+	return nil
+}
+
+// Checks that the API key the request was made with, if any, may
+// upload every image that deleting the named one would delete
+func authorizeDelete(r *http.Request, name string) error {
+	key, ok := keyOf(r)
+	if !ok {
+		return nil
+	}
+	// an image that no remembered job made, or that is still being made,
+	// is not deleted, so it is enough to check its name
+	job, err := core.JobThatMade(name)
+	if err == nil && !mayAccessJob(r, job.Client) {
+		return fmt.Errorf("API key %s may not delete the images of another key", key.Id)
+	}
+	names, _ := core.VariantsOf(name)
+	for _, variant := range names {
+		if !key.mayUpload(variant) {
+			return fmt.Errorf("API key %s may not delete %s", key.Id, variant)
+		}
+	}
+	return nil
+}
+
+func (self APIKey) mayUpload(name string) bool {
+	if len(self.Upload_prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range self.Upload_prefixes {
+		if strings.HasPrefix(name, prefix) && !strings.Contains(name[len(prefix):], "..") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,307 @@
+/*
+Copyright 2014 Helix Digital
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package presentation
+
+import (
+	"bufio"
+	"encoding/json"
+	"image"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/helixdigital/imageserver/core"
+	"github.com/helixdigital/imageserver/signedurl"
+)
+
+var testKeys = []APIKey{
+	{Id: "billing", Key: "k-billing", Scopes: []string{"request", "status"}, Upload_prefixes: []string{"billing/"}},
+	{Id: "ops", Key: "k-ops", Scopes: []string{"stats"}},
+}
+
+func callGuarded(scope string, req *http.Request) (*httptest.ResponseRecorder, bool) {
+	handler := &calledHandler{}
+	resp := httptest.NewRecorder()
+	guard(scope, handler.handle)(resp, req)
+	return resp, handler.called
+}
+
+func withKey(req *http.Request, key string) *http.Request {
+	req.Header.Set("X-Api-Key", key)
+	return req
+}
+
+func TestGuardChecksKeysAndScopes(t *testing.T) {
+	InjectAPIKeys(testKeys)
+	defer InjectAPIKeys(nil)
+
+	if resp, called := callGuarded("stats", httptest.NewRequest("GET", "/stats", nil)); called || resp.Code != http.StatusUnauthorized {
+		t.Error("A request without a key should have got a 401 but got", resp.Code)
+	}
+	if resp, called := callGuarded("stats", withKey(httptest.NewRequest("GET", "/stats", nil), "guessed")); called || resp.Code != http.StatusUnauthorized {
+		t.Error("A request with an unknown key should have got a 401 but got", resp.Code)
+	}
+	if resp, called := callGuarded("stats", withKey(httptest.NewRequest("GET", "/stats", nil), "k-billing")); called || resp.Code != http.StatusForbidden {
+		t.Error("A key without the scope should have got a 403 but got", resp.Code)
+	}
+	if _, called := callGuarded("stats", withKey(httptest.NewRequest("GET", "/stats", nil), "k-ops")); !called {
+		t.Error("A key with the scope should have been let through")
+	}
+	bearer := httptest.NewRequest("GET", "/stats", nil)
+	bearer.Header.Set("Authorization", "Bearer k-ops")
+	if _, called := callGuarded("stats", bearer); !called {
+		t.Error("A key sent as a bearer token should have been let through")
+	}
+}
+
+func TestGuardAcceptsSignatureInsteadOfKey(t *testing.T) {
+	InjectAPIKeys(testKeys)
+	InjectURLSecret("s3cr3t")
+	defer InjectAPIKeys(nil)
+	defer InjectURLSecret("")
+
+	link := signedurl.URL([]byte("s3cr3t"), "/status", url.Values{"jobid": {"1"}}, time.Now().Add(time.Minute))
+	if _, called := callGuarded("status", httptest.NewRequest("GET", link, nil)); !called {
+		t.Error("A signed request without a key should have been let through")
+	}
+	if _, called := callGuarded("status", httptest.NewRequest("GET", "/status?jobid=1", nil)); called {
+		t.Error("A request with neither a key nor a signature should not have been let through")
+	}
+}
+
+func TestRequestRecordsClientAndChecksPrefixes(t *testing.T) {
+	setupJSONTest()
+	InjectAPIKeys(testKeys)
+	defer InjectAPIKeys(nil)
+	MakeGrayFile(300, 300, "/tmp/apikey.gif")
+	defer os.Remove("/tmp/apikey.gif")
+
+	v := getTestValues()
+	v.Set("local_filename", "/tmp/apikey.gif")
+	v.Set("uploaded_filename", "avatars/1.gif")
+	handler := guard("request", requestHandler)
+	rec := httptest.NewRecorder()
+	handler(rec, withKey(formPost("/request", v), "k-billing"))
+	if rec.Code != http.StatusForbidden {
+		t.Error("Uploading outside the key's prefixes should have got a 403 but got", rec.Code, rec.Body.String())
+	}
+
+	v.Set("uploaded_filename", "billing/1.gif")
+	rec = httptest.NewRecorder()
+	handler(rec, withKey(formPost("/request", v), "k-billing"))
+	if rec.Code != http.StatusOK {
+		t.Fatal("Uploading inside the key's prefixes should have got a 200 but got", rec.Code, rec.Body.String())
+	}
+	job, err := core.GetJob(toInt(rec.Body.String()))
+	if err != nil || job.Client != "billing" {
+		t.Error("The job should have recorded the key id 'billing' but recorded", job.Client, err)
+	}
+	waitForJobToFinish(job.Id)
+	if by_client := core.CountByClient(); by_client["billing"] != 1 {
+		t.Error("Stats should have counted 1 job for 'billing' but counted", by_client)
+	}
+}
+
+func TestDeleteChecksPrefixesAndOwner(t *testing.T) {
+	setupJSONTest()
+	InjectAPIKeys([]APIKey{
+		{Id: "billing", Key: "k-billing", Scopes: []string{"delete"}, Upload_prefixes: []string{"billing/"}},
+		{Id: "support", Key: "k-support", Scopes: []string{"delete"}},
+	})
+	defer InjectAPIKeys(nil)
+	MakeGrayFile(300, 300, "/tmp/apikey.gif")
+	defer os.Remove("/tmp/apikey.gif")
+	for _, name := range []string{"avatars/1.gif", "billing/1.gif"} {
+		jobid, _ := core.NewJob(core.JobRequest{Local_filename: "/tmp/apikey.gif", Crop_to: image.Rect(0, 0, 50, 50), Uploaded_filename: name, Client: "billing"})
+		waitForJobToFinish(jobid)
+	}
+
+	handler := guard("delete", deleteHandler)
+	rec := httptest.NewRecorder()
+	handler(rec, withKey(formPost("/delete", url.Values{"uploaded_filename": {"avatars/1.gif"}}), "k-billing"))
+	if rec.Code != http.StatusForbidden {
+		t.Error("Deleting outside the key's prefixes should have got a 403 but got", rec.Code, rec.Body.String())
+	}
+	rec = httptest.NewRecorder()
+	handler(rec, withKey(formPost("/delete", url.Values{"uploaded_filename": {"billing/1.gif"}}), "k-support"))
+	if rec.Code != http.StatusForbidden {
+		t.Error("Deleting the image of another key's job should have got a 403 but got", rec.Code, rec.Body.String())
+	}
+	rec = httptest.NewRecorder()
+	handler(rec, withKey(formPost("/delete", url.Values{"uploaded_filename": {"billing/1.gif"}}), "k-billing"))
+	if rec.Code != http.StatusOK || rec.Body.String() != "Deleted\nbilling/1.gif" {
+		t.Error("Deleting inside the key's prefixes should have got a 200 but got", rec.Code, rec.Body.String())
+	}
+	rec = httptest.NewRecorder()
+	handler(rec, withKey(formPost("/delete", url.Values{"uploaded_filename": {"support/1.gif"}}), "k-support"))
+	if rec.Code != http.StatusNotFound {
+		t.Error("Deleting an image no job made should have got a 404 but got", rec.Code, rec.Body.String())
+	}
+}
+
+func TestJobsAreOnlySeenByTheirKey(t *testing.T) {
+	setupJSONTest()
+	scopes := []string{"status", "cancel"}
+	InjectAPIKeys([]APIKey{{Id: "billing", Key: "k-billing", Scopes: scopes}, {Id: "support", Key: "k-support", Scopes: scopes}})
+	defer InjectAPIKeys(nil)
+	server := httptest.NewServer(guard("status", eventsHandler))
+	defer server.Close()
+	stream, _ := http.NewRequest("GET", server.URL+"/events", nil)
+	resp, err := http.DefaultClient.Do(withKey(stream, "k-support"))
+	if err != nil {
+		t.Fatal("Getting the event stream unexpectedly threw an error", err)
+	}
+	// closing the body ends the stream, so the server can close
+	defer resp.Body.Close()
+	streamed := make(chan core.Event, 100)
+	go func() {
+		defer close(streamed)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			var ev core.Event
+			if json.Unmarshal([]byte(strings.TrimPrefix(scanner.Text(), "data: ")), &ev) == nil {
+				streamed <- ev
+			}
+		}
+	}()
+
+	billing, _ := core.NewJob(core.JobRequest{Local_filename: "/tmp/missing.gif", Uploaded_filename: "b.gif", Client: "billing"})
+	waitForJobToFinish(billing)
+	support, _ := core.NewJob(core.JobRequest{Local_filename: "/tmp/missing.gif", Uploaded_filename: "s.gif", Client: "support"})
+	waitForJobToFinish(support)
+	timeout := time.After(5 * time.Second)
+	for final := false; !final; {
+		select {
+		case ev := <-streamed:
+			if ev.Jobid == billing {
+				t.Fatal("The event stream of one key should not carry the jobs of another")
+			}
+			final = ev.Jobid == support && ev.Final
+		case <-timeout:
+			t.Fatal("The event stream should have carried the key's own job")
+		}
+	}
+
+	query := url.Values{"jobid": {strconv.Itoa(billing)}}
+	rec := httptest.NewRecorder()
+	guard("status", statusHandler)(rec, withKey(httptest.NewRequest("GET", "/status?"+query.Encode(), nil), "k-support"))
+	if rec.Code != http.StatusGone {
+		t.Error("The status of another key's job should have been a 410 but was", rec.Code, rec.Body.String())
+	}
+	rec = httptest.NewRecorder()
+	guard("status", statusHandler)(rec, withKey(httptest.NewRequest("GET", "/status?"+query.Encode(), nil), "k-billing"))
+	if !strings.Contains(rec.Body.String(), "Error reading the file") {
+		t.Error("The status of the key's own job should have been reported but was", rec.Code, rec.Body.String())
+	}
+	rec = httptest.NewRecorder()
+	guard("cancel", cancelHandler)(rec, withKey(formPost("/cancel", query), "k-support"))
+	if rec.Code != http.StatusGone {
+		t.Error("Cancelling another key's job should have been a 410 but was", rec.Code, rec.Body.String())
+	}
+	rec = httptest.NewRecorder()
+	guard("status", v2JobHandler)(rec, withKey(httptest.NewRequest("GET", "/v2/jobs/"+strconv.Itoa(billing), nil), "k-support"))
+	if rec.Code != http.StatusNotFound {
+		t.Error("GET of another key's job should have been a 404 but was", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	v2JobsHandler(rec, withKey(httptest.NewRequest("GET", "/v2/jobs", nil), "k-support"))
+	var listed []jsonJob
+	json.Unmarshal(rec.Body.Bytes(), &listed)
+	if len(listed) != 1 || listed[0].Id != support {
+		t.Error("The list of jobs should have held only the key's own job but held", listed)
+	}
+}
+
+func TestLoadAPIKeys(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "apikeys")
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "keys.json")
+	b, _ := json.Marshal(testKeys)
+	ioutil.WriteFile(filename, b, 0600)
+
+	keys, err := LoadAPIKeys(filename)
+	if err != nil || len(keys) != 2 || keys[0].Upload_prefixes[0] != "billing/" {
+		t.Error("Should have loaded the two test keys but loaded", keys, err)
+	}
+
+	ioutil.WriteFile(filename, []byte(`[{"id": "a", "key": "x"}, {"id": "a", "key": "y"}]`), 0600)
+	if _, err := LoadAPIKeys(filename); err == nil || !strings.Contains(err.Error(), "twice") {
+		t.Error("An id used twice should have thrown an error but threw", err)
+	}
+	ioutil.WriteFile(filename, []byte(`[{"id": "a"}]`), 0600)
+	if _, err := LoadAPIKeys(filename); err == nil {
+		t.Error("A key without a secret should have thrown an error")
+	}
+}
+
+func TestMayUpload(t *testing.T) {
+	key := testKeys[0]
+	tests := map[string]bool{
+		"billing/1.gif":          true,
+		"billing/2014/1.gif":     true,
+		"avatars/1.gif":          false,
+		"billing/../avatars.gif": false,
+	}
+	for name, expected := range tests {
+		if key.mayUpload(name) != expected {
+			t.Error("mayUpload of", name, "should have been", expected)
+		}
+	}
+	if !testKeys[1].mayUpload("anything.gif") {
+		t.Error("A key without prefixes should be able to upload anywhere")
+	}
+}
+
+func formPost(path string, v url.Values) *http.Request {
+	req := httptest.NewRequest("POST", path, strings.NewReader(v.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req
+}
+
+// Waits until every job has finished and no worker is busy with one, so
+// that the jobs of earlier tests stop using the plugins before a test
+// swaps them
+func waitForJobs() {
+	for i := 0; i < 1000; i++ {
+		idle := core.QueueDepth() == 0 && core.ActiveWorkers() == 0
+		if teststore != nil {
+			for _, job := range teststore.AllJobs() {
+				idle = idle && job.Finished()
+			}
+		}
+		if idle {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func waitForJobToFinish(jobid int) {
+	for i := 0; i < 200; i++ {
+		if job, _ := core.GetJob(jobid); job.Finished() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,121 @@
+/*
+Copyright 2014 Helix Digital
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package presentation
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/helixdigital/imageserver/core"
+	"github.com/helixdigital/imageserver/entities"
+)
+
+// How often a comment is sent down an idle stream so that proxies keep
+// it open
+var keepalive = 15 * time.Second
+
+// Streams the status changes of jobs as Server-Sent Events. With a
+// `jobid` the stream starts with the job's current status and ends
+// after its final status. Without one it carries the changes of every
+// job until the client goes away. A request made with an API key only
+// gets the events of the jobs of that key.
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	jobid := core.AllJobs
+	if r.FormValue("jobid") != "" {
+		jobid = toInt(r.FormValue("jobid"))
+	}
+	events, unsubscribe := core.Subscribe(jobid)
+	defer unsubscribe()
+
+	var job entities.Job
+	if jobid != core.AllJobs {
+		var err error
+		job, err = core.GetJob(jobid)
+		if err == nil && !mayAccessJob(r, job.Client) {
+			err = fmt.Errorf("No job found with id %d", jobid)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusGone)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if jobid != core.AllJobs {
+		writeEvent(w, currentEvent(job))
+		if job.Finished() {
+			return
+		}
+	}
+	flusher.Flush()
+
+	ticker := time.NewTicker(keepalive)
+	defer ticker.Stop()
+	for {
+		select {
+		case ev := <-events:
+			if !mayAccessJob(r, ev.Client) {
+				continue
+			}
+			writeEvent(w, ev)
+			flusher.Flush()
+			if jobid != core.AllJobs && ev.Final {
+				return
+			}
+		case <-ticker.C:
+			// An event may have been missed by a slow client, so a
+			// single-job stream also checks whether its job has finished.
+			if jobid != core.AllJobs {
+				job, err := core.GetJob(jobid)
+				if err != nil {
+					return
+				}
+				if job.Finished() {
+					writeEvent(w, currentEvent(job))
+					return
+				}
+			}
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func currentEvent(job entities.Job) core.Event {
+	return core.Event{
+		Jobid:  job.Id,
+		Status: job.Status,
+		Error:  errorText(job.Err),
+		Time:   job.Modified,
+		Final:  job.Finished(),
+	}
+}
+
+func writeEvent(w http.ResponseWriter, ev core.Event) {
+	b, _ := json.Marshal(ev)
+	fmt.Fprintf(w, "event: status\ndata: %s\n\n", b)
+}
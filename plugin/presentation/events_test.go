@@ -0,0 +1,144 @@
+/*
+Copyright 2014 Helix Digital
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package presentation
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"image"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/helixdigital/imageserver/core"
+	"github.com/helixdigital/imageserver/entities"
+	"github.com/helixdigital/imageserver/plugin/upload"
+)
+
+// Holds every upload until the gate is closed
+type gatedUpload struct {
+	upload.MockUpload
+	started chan bool
+	gate    chan bool
+}
+
+func (self *gatedUpload) Upload(rdr io.Reader, size int64, mime string, uplname string, options entities.UploadOptions) error {
+	self.started <- true
+	<-self.gate
+	return self.MockUpload.Upload(rdr, size, mime, uplname, options)
+}
+
+func TestEventsStreamEndsWithJob(t *testing.T) {
+	gated := &gatedUpload{started: make(chan bool, 1), gate: make(chan bool)}
+	waitForJobs()
+	core.InjectUploader(gated)
+	defer func() {
+		waitForJobs()
+		core.InjectUploader(upload.NewMock())
+	}()
+	injectNewJobstore()
+	MakeGrayFile(300, 300, "/tmp/events.gif")
+	defer os.Remove("/tmp/events.gif")
+	server := httptest.NewServer(http.HandlerFunc(eventsHandler))
+	defer server.Close()
+
+	jobid, _ := core.NewJob(core.JobRequest{
+		Local_filename:    "/tmp/events.gif",
+		Crop_to:           image.Rect(0, 0, 200, 200),
+		Uploaded_filename: "events.gif",
+	})
+	<-gated.started
+	resp, err := http.Get(fmt.Sprintf("%s/events?jobid=%d", server.URL, jobid))
+	if err != nil {
+		close(gated.gate)
+		t.Fatal("Getting the event stream unexpectedly threw an error", err)
+	}
+	assertContentTypeWas("text/event-stream", resp, t)
+
+	done := make(chan []core.Event)
+	go func() { done <- readEvents(resp) }()
+	close(gated.gate)
+	var events []core.Event
+	select {
+	case events = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The event stream should have closed once the job was done")
+	}
+	statuses := make([]string, 0)
+	for _, ev := range events {
+		statuses = append(statuses, ev.Status)
+	}
+	joined := strings.Join(statuses, ",")
+	if len(events) < 2 || !strings.HasSuffix(joined, ",Done") {
+		t.Error("Should have streamed the current status and then 'Done' but streamed", joined)
+	}
+	if !events[len(events)-1].Final {
+		t.Error("The last event should have been marked final")
+	}
+}
+
+func TestEventsOfFinishedJob(t *testing.T) {
+	waitForJobs()
+	injectNewJobstore()
+	jobid, _ := core.NewJob(core.JobRequest{Local_filename: "/tmp/missing.gif", Uploaded_filename: "missing.gif"})
+	for i := 0; i < 200; i++ {
+		if job, _ := core.GetJob(jobid); job.Finished() {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	server := httptest.NewServer(http.HandlerFunc(eventsHandler))
+	defer server.Close()
+
+	resp, _ := http.Get(fmt.Sprintf("%s/events?jobid=%d", server.URL, jobid))
+	events := readEvents(resp)
+	if len(events) != 1 || events[0].Status != "Error reading the file" || !events[0].Final {
+		t.Error("A finished job should stream only its final status but streamed", events)
+	}
+}
+
+func TestEventsOfMissingJob(t *testing.T) {
+	waitForJobs()
+	injectNewJobstore()
+	server := httptest.NewServer(http.HandlerFunc(eventsHandler))
+	defer server.Close()
+
+	resp, err := http.Get(fmt.Sprintf("%s/events?jobid=10", server.URL))
+	assertGotStatusCode(410, resp, err, t)
+}
+
+// Reads the events in the stream until it is closed
+func readEvents(resp *http.Response) []core.Event {
+	defer resp.Body.Close()
+	events := make([]core.Event, 0)
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		var ev core.Event
+		json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &ev)
+		events = append(events, ev)
+	}
+	return events
+}
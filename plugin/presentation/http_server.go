@@ -40,6 +40,7 @@ import (
 	"strings"
 
 	"github.com/helixdigital/imageserver/core"
+	"github.com/helixdigital/imageserver/entities"
 )
 
 // Start the go standard library web server on the given port.
@@ -51,16 +52,28 @@ func StartWebServer(port int) {
 	log.Fatal(http.ListenAndServe(portstring, nil))
 }
 
-// There are four endpoints:
+// There are seven form-based endpoints:
 // - `/` Does nothing at the moment: merely displays a hello world
 // - `/status` returns current status of the given job
 // - `/stats` returns the current status of the running server
 // - `/request` starts a new job
+// - `/cancel` stops a running job
+// - `/delete` removes an uploaded image and the others its job made
+// - `/events` streams status changes as they happen
+// as well as `/img/` which serves transformed images (see imgHandler)
+// and the JSON API set up by setupJSONHandlers. All but `/` need an API
+// key with the right scope if there are API keys (see InjectAPIKeys),
+// or a signed URL if there is a URL secret (see InjectURLSecret).
 func setuphandlers() {
 	http.HandleFunc("/", rootHandler)
-	http.HandleFunc("/status", statusHandler)
-	http.HandleFunc("/stats", statsHandler)
-	http.HandleFunc("/request", requestHandler)
+	http.HandleFunc("/status", guard("status", statusHandler))
+	http.HandleFunc("/stats", guard("stats", statsHandler))
+	http.HandleFunc("/request", guard("request", requestHandler))
+	http.HandleFunc("/cancel", guard("cancel", cancelHandler))
+	http.HandleFunc("/delete", guard("delete", deleteHandler))
+	http.HandleFunc("/events", guard("status", eventsHandler))
+	http.HandleFunc("/img/", guard("transform", imgHandler))
+	setupJSONHandlers()
 }
 
 // Simply returns a greeting string when `/` is called
@@ -69,10 +82,15 @@ func rootHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // Calls the core.JobStatus use-case with the jobid found in the GET
-// query parmeter.
+// query parmeter. A job of another API key is reported as not found.
 func statusHandler(w http.ResponseWriter, r *http.Request) {
 	jobid := toInt(r.FormValue("jobid"))
-	status, err := core.JobStatus(jobid)
+	if !mayAccessJobId(r, jobid) {
+		http.Error(w, fmt.Sprintf("No job found with id %d", jobid), http.StatusGone)
+		return
+	}
+	report, err := core.JobStatus(jobid)
+	status := report.Status
 	if strings.Contains(status, "No job found with id") {
 		fmt.Printf("No job found with id %d\n", jobid)
 		http.Error(w, status, http.StatusGone)
@@ -83,22 +101,139 @@ func statusHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	fmt.Printf("Status %d is %s\n", jobid, status)
 	fmt.Fprintf(w, "%s", status)
+	writeOutputStatuses(w, report)
 }
 
+// A job that makes more than one image has the status of each image
+// on a line of its own after the status of the whole job
+func writeOutputStatuses(w http.ResponseWriter, report core.JobReport) {
+	if len(report.Outputs) < 2 {
+		return
+	}
+	for _, out := range report.Outputs {
+		fmt.Fprintf(w, "\n%s: %s", out.Uploaded_filename, out.Status)
+	}
+}
+
+// How many seconds a client is asked to wait before requesting again
+// when the job queue is full
+const retryAfter = "10"
+
 // Calls the core.NewJob use-case with the data send in the http POST form
 func requestHandler(w http.ResponseWriter, r *http.Request) {
+	spooled, err := spoolRequestInput(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), spoolErrorCode(err))
+		return
+	}
 	jobreq := getJobRequestFrom(r)
+	jobreq.Spooled_input = spooled
+	if err := jobreq.Upload_options.Check(); err != nil {
+		core.DiscardSpooled(spooled)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := jobreq.CheckOutputs(); err != nil {
+		core.DiscardSpooled(spooled)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkCallback(jobreq.Callback_url); err != nil {
+		core.DiscardSpooled(spooled)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := authorizeJob(r, &jobreq); err != nil {
+		core.DiscardSpooled(spooled)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
 	if r.FormValue("debug") == "1" {
+		core.DiscardSpooled(spooled)
 		fmt.Fprintf(w, "%#v", jobreq)
 		return
 	}
 
-	newid := core.NewJob(jobreq)
-	fmt.Printf("New job requested %#v -> id:%d\n", newid)
+	newid, err := core.NewJob(jobreq)
+	if err == core.ErrQueueFull {
+		w.Header().Set("Retry-After", retryAfter)
+		http.Error(w, fmt.Sprintf("%s", err), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Cannot start the job: %s", err), http.StatusInternalServerError)
+		return
+	}
+	fmt.Printf("New job requested %#v -> id:%d\n", jobreq, newid)
 	fmt.Fprintf(w, "%d", newid)
 
 }
 
+// Calls the core.CancelJob use-case with the jobid found in the POST
+// form. The job stops at the end of its current stage. A job of another
+// API key is reported as not found.
+func cancelHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Cancel with a POST", http.StatusMethodNotAllowed)
+		return
+	}
+	jobid := toInt(r.FormValue("jobid"))
+	if !mayAccessJobId(r, jobid) {
+		http.Error(w, fmt.Sprintf("No job found with id %d", jobid), http.StatusGone)
+		return
+	}
+	err := core.CancelJob(jobid)
+	if err == core.ErrJobFinished {
+		http.Error(w, fmt.Sprintf("%s", err), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%s", err), http.StatusGone)
+		return
+	}
+	fmt.Printf("Cancelling job %d\n", jobid)
+	fmt.Fprintf(w, "%s", "Cancelling")
+}
+
+// Calls the core.DeleteImage use-case with the uploaded_filename found
+// in the POST form, and lists each image that was deleted on a line of
+// its own.
+func deleteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Delete with a POST", http.StatusMethodNotAllowed)
+		return
+	}
+	name := r.FormValue("uploaded_filename")
+	if name == "" {
+		http.Error(w, "uploaded_filename is needed", http.StatusBadRequest)
+		return
+	}
+	if err := authorizeDelete(r, name); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	report, err := core.DeleteImage(name)
+	switch {
+	case err == core.ErrNotMade:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err == core.ErrJobRunning:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err == core.ErrCannotDelete:
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	case err != nil:
+		http.Error(w, fmt.Sprintf("Error deleting: %s", err), http.StatusBadGateway)
+		return
+	}
+	fmt.Printf("Deleted %v of job %d\n", report.Deleted, report.Jobid)
+	fmt.Fprintf(w, "%s", "Deleted")
+	for _, deleted := range report.Deleted {
+		fmt.Fprintf(w, "\n%s", deleted)
+	}
+}
+
 // Displays as JSON the structure returned by the call to core.GetStats
 func statsHandler(w http.ResponseWriter, r *http.Request) {
 	data := core.GetStats()
@@ -112,9 +247,52 @@ func statsHandler(w http.ResponseWriter, r *http.Request) {
 
 // Converts the data sent in the http POST to requestHandler into a
 // core.JobRequest data structure.
+//
+// To make more than one image from the input, repeat uploaded_filename
+// once for each image. The other fields may then be repeated too: the
+// n-th value of each belongs to the n-th image, and a field given fewer
+// times falls back to its first value.
 func getJobRequestFrom(r *http.Request) core.JobRequest {
+	jobreq := getSingleJobRequestFrom(r)
+	count := len(r.Form["uploaded_filename"])
+	if count < 2 {
+		return jobreq
+	}
+	for i := 0; i < count; i++ {
+		jobreq.Outputs = append(jobreq.Outputs, getOutputFrom(r, i))
+	}
+	return jobreq
+}
+
+func getOutputFrom(r *http.Request, i int) core.Output {
+	return core.Output{
+		Crop_to: image.Rect(
+			toInt(formValueAt(r, "crop_to_x", i)),
+			toInt(formValueAt(r, "crop_to_y", i)),
+			toInt(formValueAt(r, "crop_to_x", i))+toInt(formValueAt(r, "crop_to_w", i)),
+			toInt(formValueAt(r, "crop_to_y", i))+toInt(formValueAt(r, "crop_to_h", i)),
+		),
+		Resize_width:      toUint(formValueAt(r, "resize_width", i)),
+		Resize_height:     toUint(formValueAt(r, "resize_height", i)),
+		Format:            formValueAt(r, "format", i),
+		Uploaded_filename: formValueAt(r, "uploaded_filename", i),
+	}
+}
+
+// The i-th value of a repeated form field, or its first value if it
+// was given fewer than i+1 times
+func formValueAt(r *http.Request, key string, i int) string {
+	values := r.Form[key]
+	if i < len(values) {
+		return values[i]
+	}
+	return r.FormValue(key)
+}
+
+func getSingleJobRequestFrom(r *http.Request) core.JobRequest {
 	return core.JobRequest{
 		Local_filename: r.FormValue("local_filename"),
+		Source_url:     r.FormValue("source_url"),
 		Crop_to: image.Rect(
 			toInt(r.FormValue("crop_to_x")),
 			toInt(r.FormValue("crop_to_y")),
@@ -123,8 +301,37 @@ func getJobRequestFrom(r *http.Request) core.JobRequest {
 		),
 		Resize_width:      toUint(r.FormValue("resize_width")),
 		Resize_height:     toUint(r.FormValue("resize_height")),
+		Format:            r.FormValue("format"),
 		Uploaded_filename: r.FormValue("uploaded_filename"),
+		Callback_url:      r.FormValue("callback_url"),
+		Upload_options:    getUploadOptionsFrom(r),
+	}
+}
+
+// Metadata and tags are given as repeated "name=value" fields
+func getUploadOptionsFrom(r *http.Request) entities.UploadOptions {
+	return entities.UploadOptions{
+		Cache_control:       r.FormValue("cache_control"),
+		Content_disposition: r.FormValue("content_disposition"),
+		Content_encoding:    r.FormValue("content_encoding"),
+		Metadata:            toPairs(r.Form["metadata"]),
+		Tags:                toPairs(r.Form["tags"]),
+	}
+}
+
+func toPairs(fields []string) map[string]string {
+	if len(fields) == 0 {
+		return nil
+	}
+	pairs := make(map[string]string, len(fields))
+	for _, field := range fields {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) == 1 {
+			parts = append(parts, "")
+		}
+		pairs[parts[0]] = parts[1]
 	}
+	return pairs
 }
 
 // When passed two keys to the form values in r, this gets the
@@ -31,7 +31,6 @@ import (
 
 	"github.com/helixdigital/imageserver/core"
 	"github.com/helixdigital/imageserver/entities"
-	"github.com/helixdigital/imageserver/plugin/storage"
 	"github.com/helixdigital/imageserver/plugin/upload"
 )
 
@@ -42,10 +41,9 @@ func TestAllWithSetup(t *testing.T) {
 	go StartWebServer(portnum)
 	time.Sleep(50 * time.Millisecond)
 	mock = upload.NewMock()
+	waitForJobs()
 	core.InjectUploader(mock)
-	store := storage.NewJobStore()
-	core.InjectJobstore(&store)
-	core.InjectStorageReporter(&store)
+	injectNewJobstore()
 	err := MakeGrayFile(1000, 1000, "/tmp/upload.gif")
 	if err != nil {
 		t.Error("Error in creating test file")
@@ -55,8 +53,50 @@ func TestAllWithSetup(t *testing.T) {
 	testStartWebserver(t)
 	testStatusOfBadJob(t)
 	testRequestingNewJob(t)
+	testRequestingSeveralOutputs(t)
 	testStatusOfExistingJob(t)
 	testStatsReturnsJSON(t)
+	testCancelNeedsPost(t)
+	testCancelOfBadJob(t)
+	testCancelOfFinishedJob(t)
+	testDeleteNeedsPost(t)
+	testDeleteUploadedImage(t)
+	testRequestWhenQueueIsFull(t)
+}
+
+func TestRequestWithUploadOptions(t *testing.T) {
+	setupJSONTest()
+	mock := upload.NewMock()
+	core.InjectUploader(mock)
+	MakeGrayFile(300, 300, "/tmp/upload.gif")
+	defer os.Remove("/tmp/upload.gif")
+
+	v := getTestValues()
+	v.Set("cache_control", "public, max-age=60")
+	v["metadata"] = []string{"user-id=7", "app=web"}
+	v["tags"] = []string{"kind=avatar"}
+	if code, status := requestAndWait(t, formPost("/request", v)); code != http.StatusOK || status != "Done" {
+		t.Fatal("A request with upload options should have made a 'Done' job but got", code, status)
+	}
+	options := mock.CalledOptions
+	if options.Cache_control != "public, max-age=60" || options.Metadata["user-id"] != "7" ||
+		options.Metadata["app"] != "web" || options.Tags["kind"] != "avatar" {
+		t.Error("The upload should have had the options of the request but had", options)
+	}
+
+	v["metadata"] = []string{"user id=7"}
+	if code, _ := requestAndWait(t, formPost("/request", v)); code != http.StatusBadRequest {
+		t.Error("Metadata with a bad name should have got a 400 but got", code)
+	}
+}
+
+func TestRequestWithDuplicateOutputs(t *testing.T) {
+	setupJSONTest()
+	v := getTestValues()
+	v.Add("uploaded_filename", v.Get("uploaded_filename"))
+	if code, body := requestAndWait(t, formPost("/request", v)); code != http.StatusBadRequest {
+		t.Error("Two images with the same uploaded_filename should have got a 400 but got", code, body)
+	}
 }
 
 func testStartWebserver(t *testing.T) {
@@ -73,7 +113,18 @@ func testRequestingNewJob(t *testing.T) {
 	resp, err := postToRequest(getTestValuesWithDebug())
 	assertGotStatusCode(200, resp, err, t)
 
-	debug_output := `core.JobRequest{Local_filename:"/tmp/upload.gif", Crop_to:image.Rectangle{Min:image.Point{X:0, Y:0}, Max:image.Point{X:200, Y:200}}, Resize_width:0x64, Resize_height:0x0, Uploaded_filename:"uploaded.gif"}`
+	debug_output := `core.JobRequest{Local_filename:"/tmp/upload.gif", Spooled_input:"", Source_url:"", Crop_to:image.Rectangle{Min:image.Point{X:0, Y:0}, Max:image.Point{X:200, Y:200}}, Resize_width:0x64, Resize_height:0x0, Format:"", Uploaded_filename:"uploaded.gif", Outputs:[]core.Output(nil), Callback_url:"", Client:"", Upload_options:entities.UploadOptions{Cache_control:"", Content_disposition:"", Content_encoding:"", Metadata:map[string]string(nil), Tags:map[string]string(nil)}}`
+	assertBodyContains(debug_output, resp, err, t)
+}
+
+func testRequestingSeveralOutputs(t *testing.T) {
+	v := getTestValuesWithDebug()
+	v.Add("uploaded_filename", "small.gif")
+	v.Add("resize_width", "20")
+	resp, err := postToRequest(v)
+	assertGotStatusCode(200, resp, err, t)
+
+	debug_output := `Outputs:[]core.Output{core.Output{Crop_to:image.Rectangle{Min:image.Point{X:0, Y:0}, Max:image.Point{X:200, Y:200}}, Resize_width:0x64, Resize_height:0x0, Format:"", Uploaded_filename:"uploaded.gif"}, core.Output{Crop_to:image.Rectangle{Min:image.Point{X:0, Y:0}, Max:image.Point{X:200, Y:200}}, Resize_width:0x14, Resize_height:0x0, Format:"", Uploaded_filename:"small.gif"}}`
 	assertBodyContains(debug_output, resp, err, t)
 }
 
@@ -97,11 +148,55 @@ func testStatsReturnsJSON(t *testing.T) {
 	assertContentTypeWas("application/json", resp, t)
 }
 
+func testCancelNeedsPost(t *testing.T) {
+	resp, err := http.Get(fmt.Sprintf("http://localhost:%d/cancel?jobid=0", portnum))
+	assertGotStatusCode(405, resp, err, t)
+}
+
+func testCancelOfBadJob(t *testing.T) {
+	resp, err := postToCancel(10)
+	assertGotStatusCode(410, resp, err, t)
+}
+
+func testCancelOfFinishedJob(t *testing.T) {
+	resp, err := postToCancel(0)
+	assertGotStatusCode(409, resp, err, t)
+}
+
+func testDeleteNeedsPost(t *testing.T) {
+	resp, err := http.Get(fmt.Sprintf("http://localhost:%d/delete?uploaded_filename=uploaded.gif", portnum))
+	assertGotStatusCode(405, resp, err, t)
+	resp, err = postToDelete("")
+	assertGotStatusCode(400, resp, err, t)
+}
+
+func testDeleteUploadedImage(t *testing.T) {
+	resp, err := postToDelete("uploaded.gif")
+	assertGotStatusCode(200, resp, err, t)
+	assertBodyContains("Deleted\nuploaded.gif", resp, err, t)
+	if mock.DeletedName != "uploaded.gif" {
+		t.Error("Should have deleted uploaded.gif but deleted", mock.DeletedName)
+	}
+	resp, err = http.Get(fmt.Sprintf("http://localhost:%d/status?jobid=0", portnum))
+	assertBodyContains("Deleted", resp, err, t)
+}
+
+func testRequestWhenQueueIsFull(t *testing.T) {
+	core.StartWorkers(0, 0)
+	defer core.StartWorkers(2, 10)
+	resp, err := postToRequest(getTestValues())
+	assertGotStatusCode(503, resp, err, t)
+	if resp.Header.Get("Retry-After") == "" {
+		t.Error("A 503 because the queue is full should say when to retry")
+	}
+}
+
 func assertContentTypeWas(mime string, resp *http.Response, t *testing.T) {
 	headers := resp.Header
 	if !strings.Contains(headers.Get("Content-Type"), mime) {
 		t.Errorf(
 			"Content-Type should be '%s' but was '%s'",
+			mime,
 			headers.Get("Content-Type"),
 		)
 	}
@@ -149,6 +244,18 @@ func postToRequest(v url.Values) (*http.Response, error) {
 	return http.PostForm(fmt.Sprintf("http://localhost:%d/request", portnum), v)
 }
 
+func postToCancel(jobid int) (*http.Response, error) {
+	v := url.Values{}
+	v.Set("jobid", strconv.Itoa(jobid))
+	return http.PostForm(fmt.Sprintf("http://localhost:%d/cancel", portnum), v)
+}
+
+func postToDelete(name string) (*http.Response, error) {
+	v := url.Values{}
+	v.Set("uploaded_filename", name)
+	return http.PostForm(fmt.Sprintf("http://localhost:%d/delete", portnum), v)
+}
+
 func getIdFromResponse(resp *http.Response) (int, error) {
 	stringid, err := getBody(resp)
 	if err != nil {
@@ -182,7 +289,7 @@ func getTestValuesWithDebug() url.Values {
 }
 
 func MakeGrayFile(w int, h int, filename string) error {
-	image := entities.Image{getGrayImage(w, h), extension(filename)}
+	image := entities.Image{Img: getGrayImage(w, h), Format: extension(filename)}
 	outputfile, err := os.Create(filename)
 	if err != nil {
 		return err
@@ -0,0 +1,420 @@
+/*
+Copyright 2014 Helix Digital
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package presentation
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/helixdigital/imageserver/core"
+	"github.com/helixdigital/imageserver/entities"
+)
+
+// The JSON API lives under `/v2/`. Unlike the form-based endpoints it
+// takes and returns JSON documents and reports bad input field by field.
+// - `POST /v2/jobs` starts a new job
+// - `GET /v2/jobs` lists every job
+// - `GET /v2/jobs/{id}` returns one job
+func setupJSONHandlers() {
+	http.HandleFunc("/v2/jobs", v2JobsHandler)
+	http.HandleFunc("/v2/jobs/", guard("status", v2JobHandler))
+}
+
+// The body of a `POST /v2/jobs`
+type jsonJobRequest struct {
+	Local_filename    string       `json:"local_filename"`
+	Image_base64      string       `json:"image_base64"`
+	Source_url        string       `json:"source_url"`
+	Crop              *jsonCrop    `json:"crop"`
+	Resize_width      int          `json:"resize_width"`
+	Resize_height     int          `json:"resize_height"`
+	Format            string       `json:"format"`
+	Uploaded_filename string       `json:"uploaded_filename"`
+	Outputs           []jsonOutput `json:"outputs"`
+	Callback_url      string       `json:"callback_url"`
+	// How the images are to be served
+	Cache_control       string            `json:"cache_control"`
+	Content_disposition string            `json:"content_disposition"`
+	Content_encoding    string            `json:"content_encoding"`
+	Metadata            map[string]string `json:"metadata"`
+	Tags                map[string]string `json:"tags"`
+}
+
+type jsonOutput struct {
+	Crop              *jsonCrop `json:"crop"`
+	Resize_width      int       `json:"resize_width"`
+	Resize_height     int       `json:"resize_height"`
+	Format            string    `json:"format"`
+	Uploaded_filename string    `json:"uploaded_filename"`
+}
+
+type jsonCrop struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+	W int `json:"w"`
+	H int `json:"h"`
+}
+
+// The representation of a job in every response
+type jsonJob struct {
+	Id       int                `json:"id"`
+	Status   string             `json:"status"`
+	Error    string             `json:"error,omitempty"`
+	Created  time.Time          `json:"created"`
+	Modified time.Time          `json:"modified"`
+	URL      string             `json:"url,omitempty"`
+	Outputs  []jsonOutputStatus `json:"outputs"`
+	Client   string             `json:"client,omitempty"`
+	// only given once the input has been decoded
+	Source *jsonSource `json:"source,omitempty"`
+}
+
+type jsonSource struct {
+	Format string `json:"format"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+type jsonOutputStatus struct {
+	Uploaded_filename string `json:"uploaded_filename"`
+	Status            string `json:"status"`
+	Error             string `json:"error,omitempty"`
+	URL               string `json:"url,omitempty"`
+	Upload_attempts   int    `json:"upload_attempts,omitempty"`
+	// only given when images are sent to more than one backend
+	Destinations []jsonDestination `json:"destinations,omitempty"`
+}
+
+type jsonDestination struct {
+	Destination string `json:"destination"`
+	Stored      bool   `json:"stored"`
+	Error       string `json:"error,omitempty"`
+}
+
+// The body of every response that is not a job. Fields holds one
+// message for each field of the request that was not valid.
+type jsonError struct {
+	Error  string            `json:"error"`
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+func v2JobsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		guard("request", v2CreateJob)(w, r)
+	case "GET":
+		guard("status", v2ListJobs)(w, r)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "Use GET or POST", nil)
+	}
+}
+
+func v2JobHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Use GET", nil)
+		return
+	}
+	jobid, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/v2/jobs/"))
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, "Jobs are identified by a number", nil)
+		return
+	}
+	job, err := core.GetJob(jobid)
+	if err == nil && !mayAccessJob(r, job.Client) {
+		err = fmt.Errorf("No job found with id %d", jobid)
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, err.Error(), nil)
+		return
+	}
+	writeJSON(w, http.StatusOK, toJSONJob(job))
+}
+
+// Calls the core.NewJob use-case with the JSON document in the body
+func v2CreateJob(w http.ResponseWriter, r *http.Request) {
+	var body jsonJobRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize()))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&body); err != nil {
+		if tooLarge(err) == core.ErrInputTooLarge {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, core.ErrInputTooLarge.Error(), nil)
+			return
+		}
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Body is not a valid job request: %s", err), nil)
+		return
+	}
+	if fields := body.validate(); len(fields) > 0 {
+		writeJSONError(w, http.StatusBadRequest, "Job request has invalid fields", fields)
+		return
+	}
+	jobreq := body.toJobRequest()
+	if body.Image_base64 != "" {
+		spooled, err := spoolBase64(body.Image_base64)
+		if err == core.ErrInputTooLarge {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, err.Error(), nil)
+			return
+		}
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "Job request has invalid fields", map[string]string{"image_base64": err.Error()})
+			return
+		}
+		jobreq.Spooled_input = spooled
+	}
+	if err := authorizeJob(r, &jobreq); err != nil {
+		core.DiscardSpooled(jobreq.Spooled_input)
+		writeJSONError(w, http.StatusForbidden, err.Error(), nil)
+		return
+	}
+	newid, err := core.NewJob(jobreq)
+	if err == core.ErrQueueFull {
+		w.Header().Set("Retry-After", retryAfter)
+		writeJSONError(w, http.StatusServiceUnavailable, err.Error(), nil)
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Cannot start the job: %s", err), nil)
+		return
+	}
+	job, err := core.GetJob(newid)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+	fmt.Printf("New job requested %#v -> id:%d\n", jobreq, newid)
+	w.Header().Set("Location", fmt.Sprintf("/v2/jobs/%d", newid))
+	writeJSON(w, http.StatusCreated, toJSONJob(job))
+}
+
+// Calls the core.ListJobs use-case. A request made with an API key
+// only lists the jobs of that key.
+func v2ListJobs(w http.ResponseWriter, r *http.Request) {
+	jobs := core.ListJobs()
+	output := make([]jsonJob, 0, len(jobs))
+	for _, job := range jobs {
+		if mayAccessJob(r, job.Client) {
+			output = append(output, toJSONJob(job))
+		}
+	}
+	writeJSON(w, http.StatusOK, output)
+}
+
+// Returns a message for each invalid field, keyed by the path to the field
+func (self jsonJobRequest) validate() map[string]string {
+	fields := make(map[string]string)
+	inputs := 0
+	for _, input := range []string{self.Local_filename, self.Image_base64, self.Source_url} {
+		if input != "" {
+			inputs++
+		}
+	}
+	if inputs == 0 {
+		fields["local_filename"] = "or image_base64 or source_url is required"
+	}
+	if inputs > 1 {
+		fields["local_filename"] = "cannot be given with image_base64 or source_url"
+	}
+	if self.Source_url != "" && !isWebURL(self.Source_url) {
+		fields["source_url"] = "must be an http or https URL"
+	}
+	if self.Callback_url != "" && !isWebURL(self.Callback_url) {
+		fields["callback_url"] = "must be an http or https URL"
+	} else if err := checkCallback(self.Callback_url); err != nil {
+		fields["callback_url"] = err.Error()
+	}
+	var bad entities.UploadOptionsError
+	if errors.As(self.uploadOptions().Check(), &bad) {
+		fields[bad.Field] = bad.Reason
+	}
+	if len(self.Outputs) == 0 {
+		validateOutput(fields, "", self.output())
+		return fields
+	}
+	// the first output with each uploaded_filename
+	first := make(map[string]int)
+	for i, out := range self.Outputs {
+		prefix := fmt.Sprintf("outputs[%d].", i)
+		validateOutput(fields, prefix, out)
+		if j, ok := first[out.Uploaded_filename]; ok && out.Uploaded_filename != "" {
+			fields[prefix+"uploaded_filename"] = fmt.Sprintf("is the same as outputs[%d]", j)
+		} else if !ok {
+			first[out.Uploaded_filename] = i
+		}
+	}
+	return fields
+}
+
+func validateOutput(fields map[string]string, prefix string, out jsonOutput) {
+	if out.Uploaded_filename == "" {
+		fields[prefix+"uploaded_filename"] = "is required"
+	}
+	if out.Crop == nil {
+		fields[prefix+"crop"] = "is required"
+	} else {
+		if out.Crop.X < 0 {
+			fields[prefix+"crop.x"] = "must not be negative"
+		}
+		if out.Crop.Y < 0 {
+			fields[prefix+"crop.y"] = "must not be negative"
+		}
+		if out.Crop.W <= 0 {
+			fields[prefix+"crop.w"] = "must be greater than 0"
+		}
+		if out.Crop.H <= 0 {
+			fields[prefix+"crop.h"] = "must be greater than 0"
+		}
+	}
+	if out.Resize_width < 0 {
+		fields[prefix+"resize_width"] = "must not be negative"
+	}
+	if out.Resize_height < 0 {
+		fields[prefix+"resize_height"] = "must not be negative"
+	}
+	switch strings.ToLower(out.Format) {
+	case "", "jpg", "jpeg", "png", "gif":
+	default:
+		fields[prefix+"format"] = "must be one of jpg, png or gif"
+	}
+}
+
+// The single output described by the top-level fields
+func (self jsonJobRequest) output() jsonOutput {
+	return jsonOutput{
+		Crop:              self.Crop,
+		Resize_width:      self.Resize_width,
+		Resize_height:     self.Resize_height,
+		Format:            self.Format,
+		Uploaded_filename: self.Uploaded_filename,
+	}
+}
+
+func (self jsonJobRequest) toJobRequest() core.JobRequest {
+	outputs := self.Outputs
+	if len(outputs) == 0 {
+		outputs = []jsonOutput{self.output()}
+	}
+	jobreq := core.JobRequest{
+		Local_filename: self.Local_filename,
+		Source_url:     self.Source_url,
+		Callback_url:   self.Callback_url,
+		Upload_options: self.uploadOptions(),
+	}
+	for _, out := range outputs {
+		jobreq.Outputs = append(jobreq.Outputs, out.toOutput())
+	}
+	return jobreq
+}
+
+func (self jsonJobRequest) uploadOptions() entities.UploadOptions {
+	return entities.UploadOptions{
+		Cache_control:       self.Cache_control,
+		Content_disposition: self.Content_disposition,
+		Content_encoding:    self.Content_encoding,
+		Metadata:            self.Metadata,
+		Tags:                self.Tags,
+	}
+}
+
+func (self jsonOutput) toOutput() core.Output {
+	return core.Output{
+		Crop_to:           image.Rect(self.Crop.X, self.Crop.Y, self.Crop.X+self.Crop.W, self.Crop.Y+self.Crop.H),
+		Resize_width:      uint(self.Resize_width),
+		Resize_height:     uint(self.Resize_height),
+		Format:            self.Format,
+		Uploaded_filename: self.Uploaded_filename,
+	}
+}
+
+// Refuses a callback_url that the server will not notify. No
+// callback_url is fine.
+func checkCallback(raw string) error {
+	if raw == "" {
+		return nil
+	}
+	return core.CheckCallbackURL(raw)
+}
+
+func isWebURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+func toJSONJob(job entities.Job) jsonJob {
+	output := jsonJob{
+		Id:       job.Id,
+		Status:   job.Status,
+		Error:    errorText(job.Err),
+		Created:  job.Created,
+		Modified: job.Modified,
+		Client:   job.Client,
+		Outputs:  make([]jsonOutputStatus, 0, len(job.Outputs)),
+	}
+	if job.Source.Format != "" {
+		output.Source = &jsonSource{job.Source.Format, job.Source.Width, job.Source.Height}
+	}
+	for _, out := range job.Outputs {
+		status := jsonOutputStatus{
+			Uploaded_filename: out.Uploaded_filename,
+			Status:            out.Status,
+			Error:             errorText(out.Err),
+			Upload_attempts:   out.Upload_attempts,
+		}
+		if out.Status == "Done" {
+			status.URL = core.OutputURL(out.Uploaded_filename)
+		}
+		for _, dest := range out.Destinations {
+			status.Destinations = append(status.Destinations, jsonDestination{
+				Destination: dest.Destination,
+				Stored:      dest.Err == nil,
+				Error:       errorText(dest.Err),
+			})
+		}
+		output.Outputs = append(output.Outputs, status)
+	}
+	if len(output.Outputs) == 1 {
+		output.URL = output.Outputs[0].URL
+	}
+	return output
+}
+
+func errorText(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func writeJSONError(w http.ResponseWriter, statuscode int, message string, fields map[string]string) {
+	writeJSON(w, statuscode, jsonError{Error: message, Fields: fields})
+}
+
+func writeJSON(w http.ResponseWriter, statuscode int, data interface{}) {
+	b, err := json.Marshal(data)
+	if err != nil {
+		http.Error(w, "Error marshalling JSON", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(statuscode)
+	w.Write(b)
+}
@@ -0,0 +1,301 @@
+/*
+Copyright 2014 Helix Digital
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package presentation
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/helixdigital/imageserver/core"
+	"github.com/helixdigital/imageserver/entities"
+	"github.com/helixdigital/imageserver/plugin/fetch"
+	"github.com/helixdigital/imageserver/plugin/notify"
+	"github.com/helixdigital/imageserver/plugin/storage"
+	"github.com/helixdigital/imageserver/plugin/upload"
+)
+
+// Waits for the jobs of earlier tests to stop before swapping the
+// plugins they use
+func setupJSONTest() {
+	waitForJobs()
+	core.InjectUploader(upload.NewMock())
+	injectNewJobstore()
+}
+
+// The jobstore that the tests injected last
+var teststore entities.JobStore
+
+// Injects an empty jobstore, which is also the StorageReporter. The jobs
+// of earlier tests must have stopped.
+func injectNewJobstore() {
+	store := storage.NewJobStore()
+	teststore = &store
+	core.InjectJobstore(&store)
+	core.InjectStorageReporter(&store)
+}
+
+func TestV2CreateAndGetJob(t *testing.T) {
+	setupJSONTest()
+	MakeGrayFile(300, 300, "/tmp/v2.gif")
+	defer os.Remove("/tmp/v2.gif")
+
+	resp := callJSON("POST", "/v2/jobs", `{
+		"local_filename": "/tmp/v2.gif",
+		"crop": {"x": 0, "y": 0, "w": 200, "h": 200},
+		"resize_width": 100,
+		"uploaded_filename": "v2.gif"
+	}`)
+	if resp.Code != http.StatusCreated {
+		t.Fatal("POST /v2/jobs should have returned 201 but returned", resp.Code, resp.Body.String())
+	}
+	var created jsonJob
+	json.Unmarshal(resp.Body.Bytes(), &created)
+	if resp.Header().Get("Location") != "/v2/jobs/0" {
+		t.Error("Location should have been '/v2/jobs/0' but was", resp.Header().Get("Location"))
+	}
+
+	var job jsonJob
+	for i := 0; i < 200 && job.Status != "Done"; i++ {
+		time.Sleep(10 * time.Millisecond)
+		resp = callJSON("GET", "/v2/jobs/0", "")
+		json.Unmarshal(resp.Body.Bytes(), &job)
+	}
+	if job.Status != "Done" {
+		t.Fatal("Job should have been 'Done' but was", job.Status)
+	}
+	if job.URL != "mock://v2.gif" {
+		t.Error("URL of a done job should have been 'mock://v2.gif' but was", job.URL)
+	}
+	if job.Outputs[0].Upload_attempts != 1 {
+		t.Error("A done job should have been uploaded in 1 attempt but took", job.Outputs[0].Upload_attempts)
+	}
+	if job.Source == nil || *job.Source != (jsonSource{"gif", 300, 300}) {
+		t.Error("A done job should have described its 300x300 gif input but described", job.Source)
+	}
+	if job.Created.IsZero() || job.Modified.Before(job.Created) {
+		t.Error("Job should have sensible created and modified times but had", job.Created, job.Modified)
+	}
+}
+
+func TestV2CreateJobWithOutputs(t *testing.T) {
+	setupJSONTest()
+	resp := callJSON("POST", "/v2/jobs", `{
+		"local_filename": "/tmp/v2.gif",
+		"outputs": [
+			{"crop": {"x": 0, "y": 0, "w": 200, "h": 200}, "resize_width": 100, "uploaded_filename": "large.gif"},
+			{"crop": {"x": 0, "y": 0, "w": 200, "h": 200}, "resize_width": 20, "format": "png", "uploaded_filename": "small.png"}
+		]
+	}`)
+	if resp.Code != http.StatusCreated {
+		t.Fatal("POST /v2/jobs should have returned 201 but returned", resp.Code, resp.Body.String())
+	}
+	var created jsonJob
+	json.Unmarshal(resp.Body.Bytes(), &created)
+	if len(created.Outputs) != 2 {
+		t.Error("The new job should have had 2 outputs but had", created.Outputs)
+	}
+}
+
+func TestV2ValidationErrors(t *testing.T) {
+	setupJSONTest()
+	resp := callJSON("POST", "/v2/jobs", `{
+		"crop": {"x": -1, "y": 0, "w": 0, "h": 10},
+		"resize_width": -5,
+		"format": "bmp",
+		"callback_url": "ftp://webapp/done"
+	}`)
+	if resp.Code != http.StatusBadRequest {
+		t.Fatal("An invalid job request should have returned 400 but returned", resp.Code)
+	}
+	var body jsonError
+	json.Unmarshal(resp.Body.Bytes(), &body)
+	for _, field := range []string{"local_filename", "uploaded_filename", "crop.x", "crop.w", "resize_width", "format", "callback_url"} {
+		if body.Fields[field] == "" {
+			t.Errorf("Field '%s' should have been reported as invalid in %v", field, body.Fields)
+		}
+	}
+	if _, ok := body.Fields["crop.h"]; ok {
+		t.Error("Field 'crop.h' is valid and should not have been reported")
+	}
+}
+
+func TestInternalCallbackURLsAreRefused(t *testing.T) {
+	setupJSONTest()
+	guard, _ := fetch.NewGuard(nil)
+	core.InjectNotifier(notify.NewWebhook("s3cr3t", guard))
+	defer core.InjectNotifier(nil)
+
+	for _, callback := range []string{"http://127.0.0.1:8080/done", "http://169.254.169.254/latest", "http://localhost/done"} {
+		resp := callJSON("POST", "/v2/jobs", `{
+			"local_filename": "/tmp/v2.gif",
+			"crop": {"x": 0, "y": 0, "w": 200, "h": 200},
+			"uploaded_filename": "v2.gif",
+			"callback_url": "`+callback+`"
+		}`)
+		var body jsonError
+		json.Unmarshal(resp.Body.Bytes(), &body)
+		if resp.Code != http.StatusBadRequest || body.Fields["callback_url"] == "" {
+			t.Error("POST /v2/jobs with callback_url", callback, "should have been a 400 but got", resp.Code, body.Fields)
+		}
+		v := getTestValues()
+		v.Set("callback_url", callback)
+		if code, _ := requestAndWait(t, formPost("/request", v)); code != http.StatusBadRequest {
+			t.Error("POST /request with callback_url", callback, "should have been a 400 but got", code)
+		}
+	}
+}
+
+func TestV2ValidatesSourceURL(t *testing.T) {
+	setupJSONTest()
+	resp := callJSON("POST", "/v2/jobs", `{
+		"source_url": "file:///etc/passwd",
+		"crop": {"x": 0, "y": 0, "w": 10, "h": 10},
+		"uploaded_filename": "a.png"
+	}`)
+	var body jsonError
+	json.Unmarshal(resp.Body.Bytes(), &body)
+	if resp.Code != http.StatusBadRequest || body.Fields["source_url"] == "" {
+		t.Error("A source_url that is not http should have been reported but got", resp.Code, body.Fields)
+	}
+	if _, ok := body.Fields["local_filename"]; ok {
+		t.Error("A source_url should stand in for local_filename but got", body.Fields)
+	}
+}
+
+func TestV2UploadOptions(t *testing.T) {
+	setupJSONTest()
+	mock := upload.NewMock()
+	core.InjectUploader(mock)
+	MakeGrayFile(300, 300, "/tmp/v2options.gif")
+	defer os.Remove("/tmp/v2options.gif")
+
+	resp := callJSON("POST", "/v2/jobs", `{
+		"local_filename": "/tmp/v2options.gif",
+		"crop": {"x": 0, "y": 0, "w": 200, "h": 200},
+		"uploaded_filename": "v2options.gif",
+		"cache_control": "public, max-age=60",
+		"content_disposition": "inline",
+		"metadata": {"user-id": "7"},
+		"tags": {"kind": "avatar"}
+	}`)
+	if resp.Code != http.StatusCreated {
+		t.Fatal("POST /v2/jobs with upload options should have returned 201 but returned", resp.Code, resp.Body.String())
+	}
+	var created jsonJob
+	json.Unmarshal(resp.Body.Bytes(), &created)
+	waitForJobToFinish(created.Id)
+	options := mock.CalledOptions
+	if options.Cache_control != "public, max-age=60" || options.Content_disposition != "inline" ||
+		options.Metadata["user-id"] != "7" || options.Tags["kind"] != "avatar" {
+		t.Error("The upload should have had the options of the request but had", options)
+	}
+
+	resp = callJSON("POST", "/v2/jobs", `{
+		"local_filename": "/tmp/v2options.gif",
+		"crop": {"x": 0, "y": 0, "w": 200, "h": 200},
+		"uploaded_filename": "v2options.gif",
+		"tags": {"kind": "<avatar>"}
+	}`)
+	var body jsonError
+	json.Unmarshal(resp.Body.Bytes(), &body)
+	if resp.Code != http.StatusBadRequest || body.Fields["tags"] == "" {
+		t.Error("A bad tag should have been reported but got", resp.Code, body.Fields)
+	}
+}
+
+func TestV2ValidationErrorsInOutputs(t *testing.T) {
+	setupJSONTest()
+	resp := callJSON("POST", "/v2/jobs", `{
+		"local_filename": "/tmp/v2.gif",
+		"outputs": [
+			{"crop": {"x": 0, "y": 0, "w": 200, "h": 200}, "uploaded_filename": "large.gif"},
+			{"crop": {"x": 0, "y": 0, "w": 200, "h": 200}}
+		]
+	}`)
+	var body jsonError
+	json.Unmarshal(resp.Body.Bytes(), &body)
+	if body.Fields["outputs[1].uploaded_filename"] == "" {
+		t.Error("The missing name of the second output should have been reported but was", body.Fields)
+	}
+
+	resp = callJSON("POST", "/v2/jobs", `{
+		"local_filename": "/tmp/v2.gif",
+		"outputs": [
+			{"crop": {"x": 0, "y": 0, "w": 200, "h": 200}, "uploaded_filename": "large.gif"},
+			{"crop": {"x": 0, "y": 0, "w": 100, "h": 100}, "uploaded_filename": "large.gif"}
+		]
+	}`)
+	body = jsonError{}
+	json.Unmarshal(resp.Body.Bytes(), &body)
+	if resp.Code != http.StatusBadRequest || body.Fields["outputs[1].uploaded_filename"] != "is the same as outputs[0]" {
+		t.Error("Two outputs with the same name should have been reported but got", resp.Code, body.Fields)
+	}
+}
+
+func TestV2RejectsMalformedJSON(t *testing.T) {
+	setupJSONTest()
+	resp := callJSON("POST", "/v2/jobs", `{"local_filename": 12}`)
+	if resp.Code != http.StatusBadRequest {
+		t.Error("Malformed JSON should have returned 400 but returned", resp.Code)
+	}
+	resp = callJSON("POST", "/v2/jobs", `{"local_file": "/tmp/v2.gif"}`)
+	if resp.Code != http.StatusBadRequest {
+		t.Error("An unknown field should have returned 400 but returned", resp.Code)
+	}
+}
+
+func TestV2GetMissingJob(t *testing.T) {
+	setupJSONTest()
+	for _, path := range []string{"/v2/jobs/10", "/v2/jobs/ten"} {
+		resp := callJSON("GET", path, "")
+		if resp.Code != http.StatusNotFound {
+			t.Errorf("GET %s should have returned 404 but returned %d", path, resp.Code)
+		}
+	}
+}
+
+func TestV2ListJobs(t *testing.T) {
+	setupJSONTest()
+	for i := 0; i < 3; i++ {
+		core.NewJob(core.JobRequest{Local_filename: "/tmp/missing.gif", Uploaded_filename: "missing.gif"})
+	}
+	resp := callJSON("GET", "/v2/jobs", "")
+	var jobs []jsonJob
+	json.Unmarshal(resp.Body.Bytes(), &jobs)
+	if len(jobs) != 3 {
+		t.Fatal("GET /v2/jobs should have listed 3 jobs but listed", len(jobs))
+	}
+	if jobs[2].Id != 2 {
+		t.Error("Jobs should be listed in order of id but the last was", jobs[2].Id)
+	}
+}
+
+func callJSON(method string, path string, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	if path == "/v2/jobs" {
+		v2JobsHandler(w, r)
+	} else {
+		v2JobHandler(w, r)
+	}
+	return w
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2014 Helix Digital
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package presentation
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/helixdigital/imageserver/signedurl"
+)
+
+var urlsecret []byte
+
+// The setter for the secret that URLs must be signed with. While it is
+// empty no signature is needed.
+func InjectURLSecret(secret string) {
+	urlsecret = []byte(secret)
+}
+
+// Wraps a handler so that it is only called for requests that carry a
+// valid signature made by the signedurl package. Others get a 403. The
+// method is signed, and so is every body but a urlencoded form, whose
+// fields are signed as parameters. The fields of a multipart body cannot
+// be checked before the image in it is spooled, so multipart requests
+// are refused too.
+func signed(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(urlsecret) == 0 {
+			handler(w, r)
+			return
+		}
+		contenttype := r.Header.Get("Content-Type")
+		if strings.HasPrefix(contenttype, "multipart/") {
+			http.Error(w, "A multipart request cannot be signed, send the image in image_base64", http.StatusForbidden)
+			return
+		}
+		var body []byte
+		if !strings.HasPrefix(contenttype, "application/x-www-form-urlencoded") {
+			var err error
+			body, err = ioutil.ReadAll(io.LimitReader(r.Body, maxRequestSize()+1))
+			if err != nil {
+				http.Error(w, "Cannot read the body", http.StatusBadRequest)
+				return
+			}
+			if int64(len(body)) > maxRequestSize() {
+				http.Error(w, "The body is too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		r.ParseForm()
+		method := r.Method
+		if method == "HEAD" {
+			// A HEAD asks about the GET it was signed as
+			method = "GET"
+		}
+		if err := signedurl.Verify(urlsecret, method, r.URL.Path, r.Form, body, time.Now()); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		handler(w, r)
+	}
+}
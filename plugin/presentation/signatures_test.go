@@ -0,0 +1,160 @@
+/*
+Copyright 2014 Helix Digital
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package presentation
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/helixdigital/imageserver/signedurl"
+)
+
+// A handler that only records that it was called
+type calledHandler struct {
+	called bool
+}
+
+func (self *calledHandler) handle(w http.ResponseWriter, r *http.Request) {
+	self.called = true
+}
+
+func callSigned(req *http.Request) (*httptest.ResponseRecorder, bool) {
+	handler := &calledHandler{}
+	resp := httptest.NewRecorder()
+	signed(handler.handle)(resp, req)
+	return resp, handler.called
+}
+
+func TestSignedAcceptsGoodSignatures(t *testing.T) {
+	InjectURLSecret("s3cr3t")
+	defer InjectURLSecret("")
+	expires := time.Now().Add(time.Minute)
+
+	get := httptest.NewRequest("GET", signedurl.URL([]byte("s3cr3t"), "/status", url.Values{"jobid": {"3"}}, expires), nil)
+	if resp, called := callSigned(get); !called {
+		t.Error("A signed GET should have been let through but got", resp.Code, resp.Body.String())
+	}
+
+	form := signedurl.Sign([]byte("s3cr3t"), "POST", "/cancel", url.Values{"jobid": {"3"}}, nil, expires)
+	post := httptest.NewRequest("POST", "/cancel", strings.NewReader(form.Encode()))
+	post.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if resp, called := callSigned(post); !called {
+		t.Error("A signed form POST should have been let through but got", resp.Code, resp.Body.String())
+	}
+
+	body := `{"local_filename": "/tmp/a.png"}`
+	query := signedurl.Sign([]byte("s3cr3t"), "POST", "/v2/jobs", nil, []byte(body), expires)
+	jsonpost := httptest.NewRequest("POST", "/v2/jobs?"+query.Encode(), strings.NewReader(body))
+	jsonpost.Header.Set("Content-Type", "application/json")
+	if resp, called := callSigned(jsonpost); !called {
+		t.Error("A signed JSON POST should have been let through but got", resp.Code, resp.Body.String())
+	}
+}
+
+func TestSignedRejectsBadSignatures(t *testing.T) {
+	InjectURLSecret("s3cr3t")
+	defer InjectURLSecret("")
+	expires := time.Now().Add(time.Minute)
+
+	unsigned := httptest.NewRequest("GET", "/status?jobid=3", nil)
+	if resp, called := callSigned(unsigned); called || resp.Code != http.StatusForbidden {
+		t.Error("An unsigned request should have got a 403 but got", resp.Code)
+	}
+
+	other := signedurl.URL([]byte("s3cr3t"), "/status", url.Values{"jobid": {"3"}}, expires)
+	other = strings.Replace(other, "jobid=3", "jobid=4", 1)
+	if resp, called := callSigned(httptest.NewRequest("GET", other, nil)); called || resp.Code != http.StatusForbidden {
+		t.Error("A request with changed parameters should have got a 403 but got", resp.Code)
+	}
+
+	expired := signedurl.URL([]byte("s3cr3t"), "/status", url.Values{"jobid": {"3"}}, time.Now().Add(-time.Minute))
+	resp, called := callSigned(httptest.NewRequest("GET", expired, nil))
+	if called || resp.Code != http.StatusForbidden || !strings.Contains(resp.Body.String(), "expired") {
+		t.Error("An expired request should have got a 403 saying so but got", resp.Code, resp.Body.String())
+	}
+
+	query := signedurl.Sign([]byte("s3cr3t"), "POST", "/v2/jobs", nil, []byte(`{}`), expires)
+	jsonpost := httptest.NewRequest("POST", "/v2/jobs?"+query.Encode(), strings.NewReader(`{"local_filename": "/etc/passwd"}`))
+	jsonpost.Header.Set("Content-Type", "application/json")
+	if resp, called := callSigned(jsonpost); called || resp.Code != http.StatusForbidden {
+		t.Error("A JSON POST with a changed body should have got a 403 but got", resp.Code)
+	}
+}
+
+func TestSignedCoversMethodAndBody(t *testing.T) {
+	InjectURLSecret("s3cr3t")
+	defer InjectURLSecret("")
+	expires := time.Now().Add(time.Minute)
+	body := `{"local_filename": "/etc/hostname", "uploaded_filename": "a.png"}`
+
+	link := signedurl.URL([]byte("s3cr3t"), "/v2/jobs", nil, expires)
+	reused := httptest.NewRequest("POST", link, strings.NewReader(body))
+	reused.Header.Set("Content-Type", "application/json")
+	if resp, called := callSigned(reused); called || resp.Code != http.StatusForbidden {
+		t.Error("A signed GET reused as a POST should have got a 403 but got", resp.Code)
+	}
+
+	query := signedurl.Sign([]byte("s3cr3t"), "POST", "/v2/jobs", nil, nil, expires)
+	plain := httptest.NewRequest("POST", "/v2/jobs?"+query.Encode(), strings.NewReader(body))
+	plain.Header.Set("Content-Type", "text/plain")
+	if resp, called := callSigned(plain); called || resp.Code != http.StatusForbidden {
+		t.Error("An unsigned text/plain body should have got a 403 but got", resp.Code)
+	}
+
+	query = signedurl.Sign([]byte("s3cr3t"), "POST", "/v2/jobs", nil, []byte(body), expires)
+	plain = httptest.NewRequest("POST", "/v2/jobs?"+query.Encode(), strings.NewReader(body))
+	plain.Header.Set("Content-Type", "text/plain")
+	if resp, called := callSigned(plain); !called {
+		t.Error("A signed text/plain body should have been let through but got", resp.Code, resp.Body.String())
+	}
+
+	head := httptest.NewRequest("HEAD", signedurl.URL([]byte("s3cr3t"), "/img/w:100/cat.png", nil, expires), nil)
+	if resp, called := callSigned(head); !called {
+		t.Error("A HEAD of a signed GET should have been let through but got", resp.Code, resp.Body.String())
+	}
+}
+
+func TestSignedRejectsMultipart(t *testing.T) {
+	InjectURLSecret("s3cr3t")
+	defer InjectURLSecret("")
+
+	// Signed without fields, which would be all that is checked
+	query := signedurl.Sign([]byte("s3cr3t"), "POST", "/request", nil, nil, time.Now().Add(time.Minute))
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("local_filename", "/etc/passwd")
+	form.WriteField("uploaded_filename", "b.png")
+	form.Close()
+	req := httptest.NewRequest("POST", "/request?"+query.Encode(), &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	if resp, called := callSigned(req); called || resp.Code != http.StatusForbidden {
+		t.Error("A multipart request with unsigned fields should have got a 403 but got", resp.Code)
+	}
+}
+
+func TestSignedWithoutSecret(t *testing.T) {
+	InjectURLSecret("")
+	if _, called := callSigned(httptest.NewRequest("GET", "/status?jobid=3", nil)); !called {
+		t.Error("Without a secret no signature should be needed")
+	}
+}
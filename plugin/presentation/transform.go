@@ -0,0 +1,157 @@
+/*
+Copyright 2014 Helix Digital
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package presentation
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/helixdigital/imageserver/core"
+	"github.com/helixdigital/imageserver/entities"
+)
+
+// The Cache-Control header sent with every transformed image
+var imgCacheControl = "public, max-age=86400"
+
+// Serves `GET /img/{ops}/{path}`: the source image at path, transformed
+// while the client waits. ops is `_` for no change, or a comma separated
+// list of
+// - `crop:x:y:w:h` crop to the w by h rectangle at x,y
+// - `w:n` resize to n pixels wide
+// - `h:n` resize to n pixels high
+// - `f:format` encode as jpg, png or gif
+// for example `/img/crop:0:0:400:300,w:200/photos/cat.jpg`
+func imgHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Use GET", http.StatusMethodNotAllowed)
+		return
+	}
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/img/"), "/", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		http.Error(w, "Use /img/{ops}/{path}", http.StatusNotFound)
+		return
+	}
+	req, err := parseOps(parts[0])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Source = parts[1]
+
+	etag, err := core.TransformETag(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", imgCacheControl)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	result, err := core.Transform(req)
+	if err == core.ErrNoSource {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err == core.ErrTransformBusy {
+		w.Header().Del("ETag")
+		w.Header().Del("Cache-Control")
+		w.Header().Set("Retry-After", retryAfter)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		w.Header().Del("ETag")
+		w.Header().Del("Cache-Control")
+		http.Error(w, err.Error(), transformErrorCode(err))
+		return
+	}
+	w.Header().Set("Content-Type", result.Mime)
+	w.Header().Set("Content-Length", strconv.Itoa(len(result.Data)))
+	w.Write(result.Data)
+}
+
+// The response code for a Transform that failed with err
+func transformErrorCode(err error) int {
+	if errors.Is(err, entities.ErrUnsupportedFormat) {
+		return http.StatusUnsupportedMediaType
+	}
+	return http.StatusBadRequest
+}
+
+// Converts the ops part of an `/img/` URL into a TransformRequest
+func parseOps(ops string) (core.TransformRequest, error) {
+	var req core.TransformRequest
+	if ops == "_" {
+		return req, nil
+	}
+	for _, op := range strings.Split(ops, ",") {
+		args := strings.Split(op, ":")
+		switch {
+		case args[0] == "crop" && len(args) == 5:
+			n, err := toInts(args[1:])
+			if err != nil {
+				return req, fmt.Errorf("Bad op %s: %s", op, err)
+			}
+			req.Crop_to = image.Rect(n[0], n[1], n[0]+n[2], n[1]+n[3])
+		case args[0] == "w" && len(args) == 2:
+			n, err := strconv.ParseUint(args[1], 10, 32)
+			if err != nil {
+				return req, fmt.Errorf("Bad op %s: %s", op, err)
+			}
+			req.Resize_width = uint(n)
+		case args[0] == "h" && len(args) == 2:
+			n, err := strconv.ParseUint(args[1], 10, 32)
+			if err != nil {
+				return req, fmt.Errorf("Bad op %s: %s", op, err)
+			}
+			req.Resize_height = uint(n)
+		case args[0] == "f" && len(args) == 2:
+			req.Format = args[1]
+		default:
+			return req, fmt.Errorf("Unknown op %s", op)
+		}
+	}
+	return req, nil
+}
+
+func toInts(args []string) ([]int, error) {
+	n := make([]int, len(args))
+	for i, arg := range args {
+		var err error
+		if n[i], err = strconv.Atoi(arg); err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+// Whether an If-None-Match header names the etag
+func etagMatches(header string, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
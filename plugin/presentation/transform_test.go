@@ -0,0 +1,121 @@
+/*
+Copyright 2014 Helix Digital
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package presentation
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/helixdigital/imageserver/core"
+)
+
+func setupImgTest(t *testing.T) string {
+	root, err := ioutil.TempDir("", "img")
+	if err != nil {
+		t.Fatal("Cannot make the source root", err)
+	}
+	core.InjectSourceRoot(root)
+	os.Mkdir(filepath.Join(root, "photos"), 0755)
+	MakeGrayFile(400, 300, filepath.Join(root, "photos", "gray.png"))
+	ioutil.WriteFile(filepath.Join(root, "photos", "notes.txt"), []byte("not an image"), 0644)
+	return root
+}
+
+func getImg(path string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", path, nil)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp := httptest.NewRecorder()
+	imgHandler(resp, req)
+	return resp
+}
+
+func TestImgTransforms(t *testing.T) {
+	root := setupImgTest(t)
+	defer os.RemoveAll(root)
+
+	resp := getImg("/img/crop:0:0:200:100,w:100,f:jpg/photos/gray.png", nil)
+	if resp.Code != http.StatusOK {
+		t.Fatal("Should have returned 200 but returned", resp.Code, resp.Body.String())
+	}
+	if resp.Header().Get("Content-Type") != "image/jpeg" {
+		t.Error("Content-Type should have been image/jpeg but was", resp.Header().Get("Content-Type"))
+	}
+	if resp.Header().Get("ETag") == "" || resp.Header().Get("Cache-Control") != imgCacheControl {
+		t.Error("Should have sent an ETag and Cache-Control but sent", resp.Header())
+	}
+	img, err := jpeg.Decode(bytes.NewReader(resp.Body.Bytes()))
+	if err != nil {
+		t.Fatal("The body should have been a jpeg", err)
+	}
+	if img.Bounds() != image.Rect(0, 0, 100, 50) {
+		t.Error("The image should have been 100x50 but was", img.Bounds())
+	}
+}
+
+func TestImgNotModified(t *testing.T) {
+	root := setupImgTest(t)
+	defer os.RemoveAll(root)
+
+	first := getImg("/img/w:50/photos/gray.png", nil)
+	second := getImg("/img/w:50/photos/gray.png", http.Header{"If-None-Match": {first.Header().Get("ETag")}})
+	if second.Code != http.StatusNotModified || second.Body.Len() != 0 {
+		t.Error("A matching If-None-Match should have returned an empty 304 but returned", second.Code)
+	}
+}
+
+func TestImgWhenBusy(t *testing.T) {
+	root := setupImgTest(t)
+	defer os.RemoveAll(root)
+	waitForJobs()
+	core.StartWorkers(0, 0)
+	defer core.StartWorkers(2, 10)
+
+	resp := getImg("/img/w:100/photos/gray.png", nil)
+	if resp.Code != http.StatusServiceUnavailable || resp.Header().Get("Retry-After") == "" {
+		t.Error("A transform with no free slot should have been a 503 with Retry-After but was", resp.Code, resp.Header())
+	}
+}
+
+func TestImgErrors(t *testing.T) {
+	root := setupImgTest(t)
+	defer os.RemoveAll(root)
+
+	tests := map[string]int{
+		"/img/_/photos/missing.png":             http.StatusNotFound,
+		"/img/_/../../../etc/passwd":            http.StatusNotFound,
+		"/img/w:50":                             http.StatusNotFound,
+		"/img/rotate:90/photos/gray.png":        http.StatusBadRequest,
+		"/img/w:wide/photos/gray.png":           http.StatusBadRequest,
+		"/img/crop:0:0:900:900/photos/gray.png": http.StatusBadRequest,
+		"/img/f:bmp/photos/gray.png":            http.StatusBadRequest,
+		"/img/_/photos/notes.txt":               http.StatusUnsupportedMediaType,
+	}
+	for path, expected := range tests {
+		if resp := getImg(path, nil); resp.Code != expected {
+			t.Error("GET", path, "should have returned", expected, "but returned", resp.Code)
+		}
+	}
+}
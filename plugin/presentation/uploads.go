@@ -0,0 +1,115 @@
+/*
+Copyright 2014 Helix Digital
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package presentation
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/helixdigital/imageserver/core"
+)
+
+// The most bytes of a form field other than the image that are read
+const maxFieldSize = 64 << 10
+
+// The largest request body that can carry an image: a base64 encoded
+// image of the largest size, plus room for the other fields
+func maxRequestSize() int64 {
+	return core.MaxInputSize()/3*4 + 4 + 1<<20
+}
+
+// Spools the image sent with a `/request`, if any, and returns the name
+// it was spooled as. A multipart request has the image in its `image`
+// part. Any other request may have it base64 encoded in the
+// `image_base64` field. The other fields of the form are left in r.Form.
+func spoolRequestInput(w http.ResponseWriter, r *http.Request) (string, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize())
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		return spoolMultipart(r)
+	}
+	if err := r.ParseForm(); err != nil {
+		return "", tooLarge(err)
+	}
+	encoded := r.Form.Get("image_base64")
+	r.Form.Del("image_base64")
+	r.PostForm.Del("image_base64")
+	if encoded == "" {
+		return "", nil
+	}
+	return spoolBase64(encoded)
+}
+
+// Reads the parts of a multipart form one by one, so that the image is
+// streamed into the spool rather than held in memory
+func spoolMultipart(r *http.Request) (string, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return "", err
+	}
+	form := r.URL.Query()
+	spooled := ""
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err == nil && part.FormName() == "image" && spooled == "" {
+			spooled, err = core.SpoolInput(part, part.FileName())
+			if err == nil {
+				continue
+			}
+		}
+		var value []byte
+		if err == nil {
+			value, err = ioutil.ReadAll(io.LimitReader(part, maxFieldSize))
+		}
+		if err != nil {
+			core.DiscardSpooled(spooled)
+			return "", tooLarge(err)
+		}
+		form.Add(part.FormName(), string(value))
+	}
+	r.Form = form
+	r.PostForm = url.Values{}
+	return spooled, nil
+}
+
+func spoolBase64(encoded string) (string, error) {
+	return core.SpoolInput(base64.NewDecoder(base64.StdEncoding, strings.NewReader(encoded)), "")
+}
+
+// Turns the error of a request body that was cut off into ErrInputTooLarge
+func tooLarge(err error) error {
+	var maxbytes *http.MaxBytesError
+	if errors.As(err, &maxbytes) {
+		return core.ErrInputTooLarge
+	}
+	return err
+}
+
+// The status code of an error from spoolRequestInput
+func spoolErrorCode(err error) int {
+	if err == core.ErrInputTooLarge {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
@@ -0,0 +1,162 @@
+/*
+Copyright 2014 Helix Digital
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package presentation
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/helixdigital/imageserver/core"
+	"github.com/helixdigital/imageserver/entities"
+)
+
+func setupUploadTest(t *testing.T, maxsize int64) string {
+	setupJSONTest()
+	dir := t.TempDir()
+	core.InjectSpool(dir, maxsize)
+	return dir
+}
+
+func grayGIF() []byte {
+	var buf bytes.Buffer
+	buf.ReadFrom(entities.Image{Img: getGrayImage(300, 300), Format: entities.Gif}.Reader())
+	return buf.Bytes()
+}
+
+func multipartRequest(image []byte) *http.Request {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for key, values := range getTestValues() {
+		if key != "local_filename" {
+			form.WriteField(key, values[0])
+		}
+	}
+	part, _ := form.CreateFormFile("image", "photo.gif")
+	part.Write(image)
+	form.Close()
+	req := httptest.NewRequest("POST", "/request", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	return req
+}
+
+// Posts to `/request` and waits for the job to finish and its spooled
+// input to be discarded
+func requestAndWait(t *testing.T, req *http.Request) (int, string) {
+	resp := httptest.NewRecorder()
+	requestHandler(resp, req)
+	if resp.Code != http.StatusOK {
+		return resp.Code, resp.Body.String()
+	}
+	jobid := toInt(resp.Body.String())
+	waitForJobToFinish(jobid)
+	waitForJobs()
+	job, _ := core.GetJob(jobid)
+	return resp.Code, job.Status
+}
+
+func assertSpoolIsEmpty(t *testing.T, dir string) {
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Error("The spool should have been emptied but held", len(files), "files")
+	}
+}
+
+func TestRequestWithMultipartImage(t *testing.T) {
+	dir := setupUploadTest(t, 1<<20)
+	defer core.InjectSpool(os.TempDir(), 32<<20)
+
+	code, status := requestAndWait(t, multipartRequest(grayGIF()))
+	if code != http.StatusOK || status != "Done" {
+		t.Error("A multipart request should have made a 'Done' job but got", code, status)
+	}
+	assertSpoolIsEmpty(t, dir)
+}
+
+func TestRequestWithBase64Image(t *testing.T) {
+	dir := setupUploadTest(t, 1<<20)
+	defer core.InjectSpool(os.TempDir(), 32<<20)
+
+	v := getTestValues()
+	v.Del("local_filename")
+	v.Set("image_base64", base64.StdEncoding.EncodeToString(grayGIF()))
+	code, status := requestAndWait(t, formPost("/request", v))
+	if code != http.StatusOK || status != "Done" {
+		t.Error("A request with a base64 image should have made a 'Done' job but got", code, status)
+	}
+	assertSpoolIsEmpty(t, dir)
+
+	v.Set("image_base64", "not base64!")
+	if code, _ := requestAndWait(t, formPost("/request", v)); code != http.StatusBadRequest {
+		t.Error("Bad base64 should have got a 400 but got", code)
+	}
+	assertSpoolIsEmpty(t, dir)
+}
+
+func TestRequestWithTooLargeImage(t *testing.T) {
+	dir := setupUploadTest(t, 100)
+	defer core.InjectSpool(os.TempDir(), 32<<20)
+
+	if code, _ := requestAndWait(t, multipartRequest(grayGIF())); code != http.StatusRequestEntityTooLarge {
+		t.Error("A multipart image over the limit should have got a 413 but got", code)
+	}
+	v := getTestValues()
+	v.Set("image_base64", base64.StdEncoding.EncodeToString(grayGIF()))
+	if code, _ := requestAndWait(t, formPost("/request", v)); code != http.StatusRequestEntityTooLarge {
+		t.Error("A base64 image over the limit should have got a 413 but got", code)
+	}
+	assertSpoolIsEmpty(t, dir)
+}
+
+func TestV2CreateJobWithBase64Image(t *testing.T) {
+	dir := setupUploadTest(t, 1<<20)
+	defer core.InjectSpool(os.TempDir(), 32<<20)
+
+	body := fmt.Sprintf(`{
+		"image_base64": %q,
+		"crop": {"x": 0, "y": 0, "w": 200, "h": 200},
+		"uploaded_filename": "v2upload.gif"
+	}`, base64.StdEncoding.EncodeToString(grayGIF()))
+	resp := callJSON("POST", "/v2/jobs", body)
+	if resp.Code != http.StatusCreated {
+		t.Fatal("POST /v2/jobs with image_base64 should have returned 201 but returned", resp.Code, resp.Body.String())
+	}
+	var created jsonJob
+	json.Unmarshal(resp.Body.Bytes(), &created)
+	waitForJobToFinish(created.Id)
+	waitForJobs()
+	if job, _ := core.GetJob(created.Id); job.Status != "Done" {
+		t.Error("The job should have been 'Done' but was", job.Status)
+	}
+	assertSpoolIsEmpty(t, dir)
+
+	resp = callJSON("POST", "/v2/jobs", `{
+		"local_filename": "/tmp/a.gif",
+		"image_base64": "R0lG",
+		"crop": {"x": 0, "y": 0, "w": 200, "h": 200},
+		"uploaded_filename": "v2upload.gif"
+	}`)
+	if resp.Code != http.StatusBadRequest {
+		t.Error("Giving both local_filename and image_base64 should have got a 400 but got", resp.Code)
+	}
+}
@@ -0,0 +1,462 @@
+/*
+Copyright 2014 Helix Digital
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/helixdigital/imageserver/entities"
+)
+
+// Implements both entities.JobStore and core.StorageReporter
+//
+// Every change is appended to a log file as one JSON record per line.
+// When the log is opened the records are replayed into memory, so the
+// job history and the jobid counter both survive a restart. The log is
+// compacted when it is opened and after every purge that removes jobs.
+//
+// Records are synced to disk at most once every syncInterval, rather
+// than on every change, so that jobs do not queue up behind the disk.
+// A crash can lose the changes of the last syncInterval.
+type fileJobs struct {
+	mem      jobs
+	lock     sync.Mutex
+	filename string
+	file     *os.File
+	enc      *json.Encoder
+	// whether records have been appended since the last sync
+	dirty bool
+	done  chan struct{}
+}
+
+// How often appended records are synced to disk
+const syncInterval = time.Second
+
+// One line of the log file
+type logRecord struct {
+	// "assign" when a jobid is handed out, "put" when a job is stored,
+	// "delete" when it is purged
+	Op  string
+	Id  int
+	Job *storedJob `json:",omitempty"`
+}
+
+// The parts of an entities.Job that can be written to disk
+type storedJob struct {
+	Status   string
+	Err      string `json:",omitempty"`
+	Created  time.Time
+	Modified time.Time
+	Outputs  []storedOutput `json:",omitempty"`
+	Client   string         `json:",omitempty"`
+	Source   *storedSource  `json:",omitempty"`
+}
+
+// The parts of an entities.SourceImage that can be written to disk
+type storedSource struct {
+	Format string
+	Width  int
+	Height int
+}
+
+// The parts of an entities.OutputStatus that can be written to disk
+type storedOutput struct {
+	Uploaded_filename string
+	Status            string
+	Err               string              `json:",omitempty"`
+	Upload_attempts   int                 `json:",omitempty"`
+	Destinations      []storedDestination `json:",omitempty"`
+}
+
+// The parts of an entities.DestinationStatus that can be written to disk
+type storedDestination struct {
+	Destination string
+	Err         string `json:",omitempty"`
+}
+
+// The status given to jobs that were still running when the server
+// stopped. Nothing is running them any more.
+const InterruptedStatus = "Error interrupted by restart"
+
+var errInterrupted = errors.New("The server stopped while the job was running")
+
+// NewFileJobStore is a factory for a collection of jobs that is kept in
+// the given file. If the file already exists the jobs in it are loaded
+// and new jobids carry on from the highest one ever assigned. Jobs that
+// had not finished are loaded with InterruptedStatus.
+func NewFileJobStore(filename string) (*fileJobs, error) {
+	store := &fileJobs{mem: NewJobStore(), filename: filename, done: make(chan struct{})}
+	if err := store.replay(filename); err != nil {
+		return nil, err
+	}
+	store.interruptUnfinished(time.Now())
+	if err := store.compact(filename); err != nil {
+		return nil, err
+	}
+	if err := store.open(); err != nil {
+		return nil, err
+	}
+	go store.syncEvery(syncInterval)
+	return store, nil
+}
+
+// Opens the log for appending
+func (self *fileJobs) open() error {
+	file, err := os.OpenFile(self.filename, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	self.file = file
+	self.enc = json.NewEncoder(file)
+	return nil
+}
+
+func (self *fileJobs) AddJob(newjob entities.Job) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.mem.AddJob(newjob)
+	self.appendPut(newjob)
+}
+
+// Update existing job
+func (self *fileJobs) Replace(id int, newversion entities.Job) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.mem.Replace(id, newversion)
+	job, _ := self.mem.GetJob(id)
+	self.appendPut(job)
+}
+
+func (self *fileJobs) AssignFreeId() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	next := self.mem.AssignFreeId()
+	self.append(logRecord{Op: "assign", Id: next})
+	return next
+}
+
+func (self *fileJobs) GetJob(id int) (entities.Job, bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.mem.GetJob(id)
+}
+
+func (self *fileJobs) AllJobs() []entities.Job {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.mem.AllJobs()
+}
+
+func (self *fileJobs) TotalCount() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.mem.TotalCount()
+}
+
+func (self *fileJobs) CountByStatus() map[string]int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.mem.CountByStatus()
+}
+
+func (self *fileJobs) CountByClient() map[string]int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.mem.CountByClient()
+}
+
+func (self *fileJobs) PurgedCount() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.mem.PurgedCount()
+}
+
+// Purge removes finished jobs according to the retention policy and
+// returns how many were removed. The log is then compacted, so that it
+// only grows with the jobs that are kept. If it cannot be compacted the
+// purge is appended to it instead.
+func (self *fileJobs) Purge(policy Retention, now time.Time) int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	removed := self.mem.purge(policy, now)
+	if len(removed) == 0 {
+		return 0
+	}
+	if err := self.recompact(); err != nil {
+		for _, id := range removed {
+			self.append(logRecord{Op: "delete", Id: id})
+		}
+	}
+	return len(removed)
+}
+
+// Replaces the open log with a compacted one. The old log stays open
+// for appending until the new one has been renamed over it and opened.
+func (self *fileJobs) recompact() error {
+	if err := self.compact(self.filename); err != nil {
+		return err
+	}
+	old := self.file
+	if err := self.open(); err != nil {
+		return err
+	}
+	old.Close()
+	return nil
+}
+
+// Close syncs and closes the underlying log file
+func (self *fileJobs) Close() error {
+	close(self.done)
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if err := self.file.Sync(); err != nil {
+		self.file.Close()
+		return err
+	}
+	return self.file.Close()
+}
+
+// Syncs the log until the store is closed
+func (self *fileJobs) syncEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-self.done:
+			return
+		case <-ticker.C:
+			self.sync()
+		}
+	}
+}
+
+// Syncs the log if records have been appended to it since the last
+// sync. The store is not locked while the disk catches up. A log that
+// was replaced by a compacted one in the meantime is already closed,
+// and the compacted one was synced when it was written.
+func (self *fileJobs) sync() {
+	self.lock.Lock()
+	file, dirty := self.file, self.dirty
+	self.dirty = false
+	self.lock.Unlock()
+	if !dirty {
+		return
+	}
+	if err := file.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+		fmt.Printf("Cannot sync the job log %s: %s\n", self.filename, err)
+	}
+}
+
+func (self *fileJobs) appendPut(job entities.Job) {
+	self.append(logRecord{Op: "put", Id: job.Id, Job: toStored(job)})
+}
+
+// A failed write is not fatal: the job is still held in memory and is
+// only at risk of being lost on the next restart.
+func (self *fileJobs) append(rec logRecord) {
+	if err := self.enc.Encode(rec); err != nil {
+		fmt.Printf("Cannot write job %d to the job log %s: %s\n", rec.Id, self.filename, err)
+		return
+	}
+	self.dirty = true
+}
+
+// Reads every record in the log into memory. A missing file is an
+// empty store. A bad last line, as left by a crash mid-write, is
+// ignored, but a bad line followed by others is a corrupt log.
+func (self *fileJobs) replay(filename string) error {
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	var bad error
+	for lineno := 1; ; lineno++ {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			if bad != nil {
+				return bad
+			}
+			var rec logRecord
+			if jsonerr := json.Unmarshal(line, &rec); jsonerr != nil {
+				bad = fmt.Errorf("Line %d of the job log %s is corrupt: %s", lineno, filename, jsonerr)
+			} else {
+				self.apply(rec)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if bad != nil {
+		fmt.Printf("Ignoring the last line of the job log %s: %s\n", filename, bad)
+	}
+	return nil
+}
+
+// Marks the jobs that the replayed log left running as interrupted, so
+// that they can be purged, cancelled and deleted like any finished job
+func (self *fileJobs) interruptUnfinished(now time.Time) {
+	for id, job := range self.mem.store {
+		if job.Finished() {
+			continue
+		}
+		job.Status = InterruptedStatus
+		job.Err = errInterrupted
+		job.Modified = now
+		self.mem.store[id] = job
+	}
+}
+
+func (self *fileJobs) apply(rec logRecord) {
+	if rec.Id >= self.mem.next_id {
+		self.mem.next_id = rec.Id + 1
+	}
+	switch {
+	case rec.Op == "put" && rec.Job != nil:
+		self.mem.store[rec.Id] = fromStored(rec.Id, *rec.Job)
+	case rec.Op == "delete":
+		delete(self.mem.store, rec.Id)
+	}
+}
+
+// Rewrites the log so that it holds one record per job, plus one
+// record that preserves the jobid counter. The new log is written
+// alongside the old one and renamed over it.
+func (self *fileJobs) compact(filename string) error {
+	tmpname := filename + ".tmp"
+	tmp, err := os.OpenFile(tmpname, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(tmp)
+	if self.mem.next_id > 0 {
+		enc.Encode(logRecord{Op: "assign", Id: self.mem.next_id - 1})
+	}
+	for id, job := range self.mem.store {
+		if err := enc.Encode(logRecord{Op: "put", Id: id, Job: toStored(job)}); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpname, filename)
+}
+
+func toStored(job entities.Job) *storedJob {
+	stored := storedJob{
+		Status:   job.Status,
+		Created:  job.Created,
+		Modified: job.Modified,
+		Client:   job.Client,
+	}
+	stored.Err = errorString(job.Err)
+	if job.Source.Format != "" {
+		stored.Source = &storedSource{job.Source.Format, job.Source.Width, job.Source.Height}
+	}
+	for _, out := range job.Outputs {
+		stored.Outputs = append(stored.Outputs, storedOutput{
+			Uploaded_filename: out.Uploaded_filename,
+			Status:            out.Status,
+			Err:               errorString(out.Err),
+			Upload_attempts:   out.Upload_attempts,
+			Destinations:      toStoredDestinations(out.Destinations),
+		})
+	}
+	return &stored
+}
+
+// Jobs read back from disk have no Statuschan: nothing is running them
+// any more.
+func fromStored(id int, stored storedJob) entities.Job {
+	job := entities.Job{
+		Id:       id,
+		Status:   stored.Status,
+		Created:  stored.Created,
+		Modified: stored.Modified,
+		Client:   stored.Client,
+	}
+	job.Err = stringError(stored.Err)
+	if stored.Source != nil {
+		job.Source = entities.SourceImage{
+			Format: stored.Source.Format,
+			Width:  stored.Source.Width,
+			Height: stored.Source.Height,
+		}
+	}
+	for _, out := range stored.Outputs {
+		job.Outputs = append(job.Outputs, entities.OutputStatus{
+			Uploaded_filename: out.Uploaded_filename,
+			Status:            out.Status,
+			Err:               stringError(out.Err),
+			Upload_attempts:   out.Upload_attempts,
+			Destinations:      fromStoredDestinations(out.Destinations),
+		})
+	}
+	return job
+}
+
+func toStoredDestinations(destinations []entities.DestinationStatus) []storedDestination {
+	var stored []storedDestination
+	for _, dest := range destinations {
+		stored = append(stored, storedDestination{dest.Destination, errorString(dest.Err)})
+	}
+	return stored
+}
+
+func fromStoredDestinations(stored []storedDestination) []entities.DestinationStatus {
+	var destinations []entities.DestinationStatus
+	for _, dest := range stored {
+		destinations = append(destinations, entities.DestinationStatus{Destination: dest.Destination, Err: stringError(dest.Err)})
+	}
+	return destinations
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func stringError(s string) error {
+	if s == "" {
+		return nil
+	}
+	return errors.New(s)
+}
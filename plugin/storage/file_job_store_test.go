@@ -0,0 +1,250 @@
+/*
+Copyright 2014 Helix Digital
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/helixdigital/imageserver/entities"
+)
+
+func TestFileStoreSurvivesRestart(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "jobs.log")
+	jobstore, err := NewFileJobStore(filename)
+	if err != nil {
+		t.Fatal("Opening a new file store unexpectedly threw an error", err)
+	}
+	id := addOneJob(jobstore)
+	editJob(jobstore, id)
+	jobstore.Close()
+
+	reopened, err := NewFileJobStore(filename)
+	if err != nil {
+		t.Fatal("Reopening the file store unexpectedly threw an error", err)
+	}
+	defer reopened.Close()
+	job, ok := reopened.GetJob(id)
+	if !ok {
+		t.Fatal("Job should have survived the restart but was not found")
+	}
+	if job.Status != "Done" {
+		t.Error("Status after restart should have been 'Done' but was", job.Status)
+	}
+	if reopened.TotalCount() != 1 {
+		t.Error("Reopened store should have total count of 1 but was", reopened.TotalCount())
+	}
+}
+
+func TestFileStoreIdsAreMonotonicAcrossRestarts(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "jobs.log")
+	jobstore, _ := NewFileJobStore(filename)
+	addOneJob(jobstore)
+	// assigned but never added, as when the server dies mid-request
+	jobstore.AssignFreeId()
+	jobstore.Close()
+
+	reopened, _ := NewFileJobStore(filename)
+	defer reopened.Close()
+	result := reopened.AssignFreeId()
+	if result != 2 {
+		t.Error("AssignFreeId after restart should have returned 2 but returned", result)
+	}
+}
+
+func TestFileStoreKeepsErrors(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "jobs.log")
+	jobstore, _ := NewFileJobStore(filename)
+	id := addOneJob(jobstore)
+	job, _ := jobstore.GetJob(id)
+	job.Status = "Error reading the file"
+	job.Err = errors.New("no such file")
+	jobstore.Replace(id, job)
+	jobstore.Close()
+
+	reopened, _ := NewFileJobStore(filename)
+	defer reopened.Close()
+	job, _ = reopened.GetJob(id)
+	if job.Err == nil || job.Err.Error() != "no such file" {
+		t.Error("Error after restart should have been 'no such file' but was", job.Err)
+	}
+}
+
+func TestFileStoreInterruptsJobsRunningAtRestart(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "jobs.log")
+	jobstore, _ := NewFileJobStore(filename)
+	id := addOneJob(jobstore)
+	job, _ := jobstore.GetJob(id)
+	job.Status = "Uploading"
+	jobstore.Replace(id, job)
+	jobstore.Close()
+
+	reopened, _ := NewFileJobStore(filename)
+	job, _ = reopened.GetJob(id)
+	if job.Status != InterruptedStatus || job.Err == nil || !job.Finished() {
+		t.Error("A job saved mid-pipeline should have been interrupted by the restart but was", job.Status, job.Err)
+	}
+	if purged := reopened.Purge(Retention{MaxAge: time.Minute}, time.Now().Add(time.Hour)); purged != 1 {
+		t.Error("An interrupted job should be purged like a finished one but purge removed", purged)
+	}
+	reopened.Close()
+}
+
+func TestFileStoreIgnoresTruncatedRecord(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "jobs.log")
+	jobstore, _ := NewFileJobStore(filename)
+	addOneJob(jobstore)
+	jobstore.Close()
+
+	file, _ := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0644)
+	file.WriteString(`{"Op":"put","Id":7,"Jo`)
+	file.Close()
+
+	reopened, err := NewFileJobStore(filename)
+	if err != nil {
+		t.Fatal("A truncated last record should not stop the store opening but got", err)
+	}
+	defer reopened.Close()
+	if reopened.TotalCount() != 1 {
+		t.Error("Reopened store should have total count of 1 but was", reopened.TotalCount())
+	}
+}
+
+func TestFileStoreRefusesCorruptRecord(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "jobs.log")
+	jobstore, _ := NewFileJobStore(filename)
+	addOneJob(jobstore)
+	jobstore.Close()
+
+	file, _ := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0644)
+	file.WriteString(`{"Op":"put","Id":7,"Jo` + "\n" + `{"Op":"assign","Id":8}` + "\n")
+	file.Close()
+
+	if _, err := NewFileJobStore(filename); err == nil {
+		t.Error("A corrupt record before the last line should have stopped the store opening")
+	}
+}
+
+func TestFileStoreKeepsLargeRecords(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "jobs.log")
+	jobstore, _ := NewFileJobStore(filename)
+	id := jobstore.AssignFreeId()
+	large := strings.Repeat("x", 2<<20)
+	jobstore.AddJob(entities.Job{Id: id, Status: "Error uploading", Err: errors.New(large)})
+	jobstore.Close()
+
+	reopened, err := NewFileJobStore(filename)
+	if err != nil {
+		t.Fatal("A large record should not stop the store opening but got", err)
+	}
+	defer reopened.Close()
+	if job, ok := reopened.GetJob(id); !ok || job.Err == nil || job.Err.Error() != large {
+		t.Error("The large record should have survived the restart")
+	}
+}
+
+func TestFileStorePurgeSurvivesRestart(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "jobs.log")
+	jobstore, _ := NewFileJobStore(filename)
+	id := addOneJob(jobstore)
+	editJob(jobstore, id)
+	purged := jobstore.Purge(Retention{MaxAge: time.Hour}, time.Now().Add(2*time.Hour))
+	if purged != 1 {
+		t.Error("Purge should have removed 1 job but removed", purged)
+	}
+	jobstore.Close()
+
+	reopened, _ := NewFileJobStore(filename)
+	defer reopened.Close()
+	if _, ok := reopened.GetJob(id); ok {
+		t.Error("A purged job should not come back after a restart")
+	}
+}
+
+func TestFileStorePurgeShrinksTheLog(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "jobs.log")
+	jobstore, _ := NewFileJobStore(filename)
+	for i := 0; i < 20; i++ {
+		editJob(jobstore, addOneJob(jobstore))
+	}
+	before, _ := os.Stat(filename)
+	jobstore.Purge(Retention{MaxJobs: 1}, time.Now())
+	after, _ := os.Stat(filename)
+	if after.Size() >= before.Size()/10 {
+		t.Error("Purging all but one job should have compacted the log but it went from", before.Size(), "to", after.Size(), "bytes")
+	}
+
+	id := addOneJob(jobstore)
+	jobstore.Close()
+	reopened, _ := NewFileJobStore(filename)
+	defer reopened.Close()
+	if _, ok := reopened.GetJob(id); !ok || reopened.TotalCount() != 2 {
+		t.Error("Jobs added after the log was compacted should survive a restart but total count was", reopened.TotalCount())
+	}
+}
+
+func TestFileStoreKeepsOutputs(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "jobs.log")
+	jobstore, _ := NewFileJobStore(filename)
+	id := addOneJob(jobstore)
+	job, _ := jobstore.GetJob(id)
+	job.Outputs = []entities.OutputStatus{
+		{Uploaded_filename: "large.jpg", Status: "Done"},
+		{Uploaded_filename: "avatar.jpg", Status: "Error in uploading", Err: errors.New("S3 is down"), Upload_attempts: 3,
+			Destinations: []entities.DestinationStatus{{Destination: "s3", Err: errors.New("S3 is down")}, {Destination: "fs"}}},
+	}
+	jobstore.Replace(id, job)
+	jobstore.Close()
+
+	reopened, _ := NewFileJobStore(filename)
+	defer reopened.Close()
+	job, _ = reopened.GetJob(id)
+	if len(job.Outputs) != 2 {
+		t.Fatal("Job after restart should have had 2 outputs but had", len(job.Outputs))
+	}
+	if job.Outputs[1].Status != "Error in uploading" || job.Outputs[1].Err.Error() != "S3 is down" || job.Outputs[1].Upload_attempts != 3 {
+		t.Error("Second output after restart was", job.Outputs[1])
+	}
+	destinations := job.Outputs[1].Destinations
+	if len(destinations) != 2 || destinations[0].Err.Error() != "S3 is down" || destinations[1].Destination != "fs" || destinations[1].Err != nil {
+		t.Error("Destinations of the second output after restart were", destinations)
+	}
+}
+
+func TestFileStoreKeepsClientAndSource(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "jobs.log")
+	jobstore, _ := NewFileJobStore(filename)
+	id := addOneJob(jobstore)
+	job, _ := jobstore.GetJob(id)
+	job.Client = "billing"
+	job.Source = entities.SourceImage{Format: "gif", Width: 40, Height: 30}
+	jobstore.Replace(id, job)
+	jobstore.Close()
+
+	reopened, _ := NewFileJobStore(filename)
+	defer reopened.Close()
+	if job, _ = reopened.GetJob(id); job.Client != "billing" {
+		t.Error("Client after restart should have been 'billing' but was", job.Client)
+	}
+	if job.Source != (entities.SourceImage{Format: "gif", Width: 40, Height: 30}) {
+		t.Error("Source after restart should have been a 40x30 gif but was", job.Source)
+	}
+}
@@ -19,6 +19,7 @@ limitations under the License.
 package storage
 
 import (
+	"sort"
 	"sync"
 	"time"
 
@@ -27,18 +28,24 @@ import (
 
 // Implements both entities.JobStore and core.StorageReporter
 type jobs struct {
-	store   map[int]entities.Job
-	id_lock sync.Mutex
-	next_id int
+	store      map[int]entities.Job
+	store_lock sync.RWMutex
+	id_lock    sync.Mutex
+	next_id    int
+	purged     int
 }
 
 func (self *jobs) AddJob(newjob entities.Job) {
+	(*self).store_lock.Lock()
+	defer (*self).store_lock.Unlock()
 	(*self).store[newjob.Id] = newjob
 }
 
 // Update existing job
 func (self *jobs) Replace(id int, newversion entities.Job) {
 	newversion.Modified = time.Now()
+	(*self).store_lock.Lock()
+	defer (*self).store_lock.Unlock()
 	(*self).store[id] = newversion
 }
 
@@ -51,6 +58,8 @@ func (self *jobs) AssignFreeId() (next int) {
 }
 
 func (self *jobs) GetJob(id int) (entities.Job, bool) {
+	(*self).store_lock.RLock()
+	defer (*self).store_lock.RUnlock()
 	job, ok := (*self).store[id]
 	return job, ok
 }
@@ -60,11 +69,27 @@ func NewJobStore() jobs {
 	return jobs{store: make(map[int]entities.Job, 0)}
 }
 
+// AllJobs returns every stored job, in order of jobid
+func (self *jobs) AllJobs() []entities.Job {
+	(*self).store_lock.RLock()
+	defer (*self).store_lock.RUnlock()
+	output := make([]entities.Job, 0, len((*self).store))
+	for _, job := range (*self).store {
+		output = append(output, job)
+	}
+	sort.Sort(byId(output))
+	return output
+}
+
 func (self *jobs) TotalCount() int {
+	(*self).store_lock.RLock()
+	defer (*self).store_lock.RUnlock()
 	return len((*self).store)
 }
 
 func (self *jobs) CountByStatus() map[string]int {
+	(*self).store_lock.RLock()
+	defer (*self).store_lock.RUnlock()
 	output := make(map[string]int)
 	for _, job := range self.store {
 		key := job.Status
@@ -76,3 +101,74 @@ func (self *jobs) CountByStatus() map[string]int {
 	}
 	return output
 }
+
+// CountByClient is the number of jobs requested with each API key id.
+// Jobs requested without a key and purged jobs are left out.
+func (self *jobs) CountByClient() map[string]int {
+	(*self).store_lock.RLock()
+	defer (*self).store_lock.RUnlock()
+	output := make(map[string]int)
+	for _, job := range self.store {
+		if job.Client != "" {
+			output[job.Client]++
+		}
+	}
+	return output
+}
+
+// PurgedCount is the number of jobs that have been purged since the
+// server started
+func (self *jobs) PurgedCount() int {
+	(*self).store_lock.RLock()
+	defer (*self).store_lock.RUnlock()
+	return (*self).purged
+}
+
+// Purge removes finished jobs according to the retention policy and
+// returns how many were removed
+func (self *jobs) Purge(policy Retention, now time.Time) int {
+	return len(self.purge(policy, now))
+}
+
+// Removes the jobs to be purged and returns their ids. Finished jobs
+// older than policy.MaxAge go first, then, if there are still more than
+// policy.MaxJobs, the least-recently modified finished jobs. Jobs that
+// are still running are never purged.
+func (self *jobs) purge(policy Retention, now time.Time) []int {
+	(*self).store_lock.Lock()
+	defer (*self).store_lock.Unlock()
+	finished := make([]entities.Job, 0)
+	for _, job := range (*self).store {
+		if job.Finished() {
+			finished = append(finished, job)
+		}
+	}
+	sort.Sort(byModified(finished))
+
+	removed := make([]int, 0)
+	for _, job := range finished {
+		expired := policy.MaxAge > 0 && now.Sub(job.Modified) > policy.MaxAge
+		overfull := policy.MaxJobs > 0 && len((*self).store) > policy.MaxJobs
+		if !expired && !overfull {
+			break
+		}
+		delete((*self).store, job.Id)
+		removed = append(removed, job.Id)
+	}
+	(*self).purged = (*self).purged + len(removed)
+	return removed
+}
+
+// Sorts jobs by jobid
+type byId []entities.Job
+
+func (self byId) Len() int           { return len(self) }
+func (self byId) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+func (self byId) Less(i, j int) bool { return self[i].Id < self[j].Id }
+
+// Sorts jobs from least- to most-recently modified
+type byModified []entities.Job
+
+func (self byModified) Len() int           { return len(self) }
+func (self byModified) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+func (self byModified) Less(i, j int) bool { return self[i].Modified.Before(self[j].Modified) }
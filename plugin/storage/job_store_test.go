@@ -17,7 +17,9 @@ limitations under the License.
 package storage
 
 import (
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/helixdigital/imageserver/entities"
 )
@@ -56,7 +58,7 @@ func TestAdd(t *testing.T) {
 		t.Error("Getting an ID after adding something to it should have been OK")
 	}
 
-	if outjob != job {
+	if !reflect.DeepEqual(outjob, job) {
 		t.Error("Was supposed to get the same job from jobstore but didn't")
 	}
 }
@@ -135,6 +137,22 @@ func TestCountByStatus(t *testing.T) {
 	}
 }
 
+func TestCountByClient(t *testing.T) {
+	jobstore := NewJobStore()
+	addOneJob(&jobstore)
+	for _, client := range []string{"billing", "billing", "avatars"} {
+		id := addOneJob(&jobstore)
+		job, _ := jobstore.GetJob(id)
+		job.Client = client
+		jobstore.Replace(id, job)
+	}
+	by_client := jobstore.CountByClient()
+	expected := map[string]int{"billing": 2, "avatars": 1}
+	if !reflect.DeepEqual(by_client, expected) {
+		t.Error("Should have counted", expected, "but counted", by_client)
+	}
+}
+
 func addOneJob(jobstore entities.JobStore) int {
 	id := jobstore.AssignFreeId()
 	c := make(<-chan entities.StatusMsg)
@@ -148,3 +166,84 @@ func editJob(jobstore entities.JobStore, id int) {
 	job.Status = "Done"
 	jobstore.Replace(id, job)
 }
+
+func TestPurgeExpiredFinishedJobs(t *testing.T) {
+	jobstore := NewJobStore()
+	done := addOneJob(&jobstore)
+	editJob(&jobstore, done)
+	running := addOneJob(&jobstore)
+
+	later := time.Now().Add(2 * time.Hour)
+	purged := jobstore.Purge(Retention{MaxAge: time.Hour}, later)
+	if purged != 1 {
+		t.Error("Purge should have removed 1 job but removed", purged)
+	}
+	if _, ok := jobstore.GetJob(done); ok {
+		t.Error("The finished job should have been purged")
+	}
+	if _, ok := jobstore.GetJob(running); !ok {
+		t.Error("The running job should not have been purged")
+	}
+	if jobstore.PurgedCount() != 1 {
+		t.Error("PurgedCount should have been 1 but was", jobstore.PurgedCount())
+	}
+}
+
+func TestPurgeKeepsRecentFinishedJobs(t *testing.T) {
+	jobstore := NewJobStore()
+	id := addOneJob(&jobstore)
+	editJob(&jobstore, id)
+	purged := jobstore.Purge(Retention{MaxAge: time.Hour}, time.Now())
+	if purged != 0 {
+		t.Error("Purge should not have removed a recent job but removed", purged)
+	}
+}
+
+func TestPurgeOldestWhenOverMaxJobs(t *testing.T) {
+	jobstore := NewJobStore()
+	oldest := addOneJob(&jobstore)
+	editJob(&jobstore, oldest)
+	time.Sleep(time.Millisecond)
+	newer := addOneJob(&jobstore)
+	editJob(&jobstore, newer)
+	addOneJob(&jobstore)
+
+	purged := jobstore.Purge(Retention{MaxJobs: 2}, time.Now())
+	if purged != 1 {
+		t.Error("Purge should have removed 1 job but removed", purged)
+	}
+	if _, ok := jobstore.GetJob(oldest); ok {
+		t.Error("The oldest finished job should have been purged")
+	}
+	if _, ok := jobstore.GetJob(newer); !ok {
+		t.Error("The newer finished job should not have been purged")
+	}
+}
+
+func TestReaperPurges(t *testing.T) {
+	jobstore := NewJobStore()
+	id := addOneJob(&jobstore)
+	editJob(&jobstore, id)
+	stop := StartReaper(&jobstore, Retention{MaxAge: time.Nanosecond}, time.Millisecond)
+	defer close(stop)
+	time.Sleep(20 * time.Millisecond)
+	if jobstore.TotalCount() != 0 {
+		t.Error("Reaper should have purged the finished job but total count was", jobstore.TotalCount())
+	}
+}
+
+func TestAllJobs(t *testing.T) {
+	jobstore := NewJobStore()
+	for i := 0; i < 5; i++ {
+		addOneJob(&jobstore)
+	}
+	all := jobstore.AllJobs()
+	if len(all) != 5 {
+		t.Fatal("AllJobs should have returned 5 jobs but returned", len(all))
+	}
+	for i, job := range all {
+		if job.Id != i {
+			t.Errorf("Job %d of AllJobs should have had id %d but had %d", i, i, job.Id)
+		}
+	}
+}
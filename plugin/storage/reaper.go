@@ -0,0 +1,52 @@
+/*
+Copyright 2014 Helix Digital
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import "time"
+
+// Retention describes which finished jobs a store may throw away.
+// A zero value for either field means no limit of that kind.
+type Retention struct {
+	// finished jobs not modified for longer than this are purged
+	MaxAge time.Duration
+	// when more jobs than this are stored, the oldest finished ones are purged
+	MaxJobs int
+}
+
+// Purger is implemented by the job stores in this package
+type Purger interface {
+	Purge(Retention, time.Time) int
+}
+
+// StartReaper purges the store according to the policy every interval
+// until a value is sent on, or the caller closes, the returned channel.
+func StartReaper(store Purger, policy Retention, every time.Duration) chan<- bool {
+	stop := make(chan bool)
+	go func() {
+		ticker := time.NewTicker(every)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				store.Purge(policy, now)
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return stop
+}
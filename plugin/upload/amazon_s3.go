@@ -17,53 +17,361 @@ limitations under the License.
 package upload
 
 import (
-	"log"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"sync"
 
-	"launchpad.net/goamz/aws"
-	"launchpad.net/goamz/s3"
+	"github.com/helixdigital/imageserver/entities"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
 )
 
+// ErrMissingCredentials is returned when the account or bucket is not given
+var ErrMissingCredentials = errors.New(`
+        Amazon credentials must be declared.
+        Use environment variables:
+        IMAGESERVER_S3_ACCESS_KEY
+        IMAGESERVER_S3_SECRET_KEY
+        IMAGESERVER_S3_BUCKET_NAME
+        Or use --backend=fs to upload to a directory instead.
+        `)
+
+// The canned ACLs S3 understands
+var cannedACLs = map[string]bool{
+	"private":                   true,
+	"public-read":               true,
+	"public-read-write":         true,
+	"authenticated-read":        true,
+	"bucket-owner-read":         true,
+	"bucket-owner-full-control": true,
+}
+
+// What an AWS region name looks like, such as "ap-southeast-2"
+var awsRegion = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-[0-9]+$`)
+
+// S3Config is where, and how, an AmazonS3Upload stores images
+type S3Config struct {
+	// the AWS region of the bucket, such as "ap-southeast-2"
+	Region string
+	// the URL of an S3-compatible store, such as MinIO, to use instead of
+	// AWS. The region may then be any name the store accepts.
+	Endpoint string
+	// address the bucket as endpoint/bucket rather than bucket.endpoint
+	PathStyle bool
+	// the canned ACL stored objects get, such as "private"
+	ACL string
+	// such as "STANDARD_IA". Blank is the bucket's default.
+	StorageClass string
+	// "AES256" or "aws:kms". Blank is the bucket's default.
+	ServerSideEncryption string
+	// the KMS key to encrypt with when ServerSideEncryption is "aws:kms"
+	SSEKMSKeyId string
+	// images larger than this many bytes are uploaded in parts of this
+	// size, which must be at least 5MiB. 0 is the default of 16MiB.
+	PartSize int64
+	// how many parts are uploaded at once. 0 is the default of 4.
+	PartThreads int
+}
+
+// S3 refuses parts smaller than this, but for the last
+const minPartSize = 5 << 20
+
+// DefaultS3Config is how images were always stored: publicly readable
+// in Sydney, with the bucket in the path
+var DefaultS3Config = S3Config{
+	Region:      "ap-southeast-2",
+	PathStyle:   true,
+	ACL:         "public-read",
+	PartSize:    16 << 20,
+	PartThreads: 4,
+}
+
 // AmazonS3Upload implements github.com/helixdigital/imageserver/core/Uploader
 //
-// It
+// It stores images in an S3 bucket, or a store that speaks the S3 API,
+// signing requests with AWS Signature Version 4.
 type AmazonS3Upload struct {
-	accesskey  string
-	secretkey  string
-	bucketname string
+	client      *minio.Client
+	bucketname  string
+	endpoint    *url.URL
+	pathstyle   bool
+	options     minio.PutObjectOptions
+	partsize    int64
+	partthreads int
 }
 
 // NewAmazonS3Upload is a factory that creates  an uploader.
 // The parameters describe the account and bucket to upload files to.
 // Note that the bucketname is set. To upload to different buckets, create
 // new AmazonS3Uploads for each one.
-func NewAmazonS3Upload(accesskey string, secretkey string, bucketname string) AmazonS3Upload {
+func NewAmazonS3Upload(accesskey string, secretkey string, bucketname string, config S3Config) (*AmazonS3Upload, error) {
 	if accesskey == "" || secretkey == "" || bucketname == "" {
-		log.Fatal(`
-        Amazon credentials must be declared.
-        Use environment variables:
-        IMAGESERVER_S3_ACCESS_KEY
-        IMAGESERVER_S3_SECRET_KEY
-        IMAGESERVER_S3_BUCKET_NAME
-        `)
+		return nil, ErrMissingCredentials
+	}
+	endpoint, region, err := config.endpoint()
+	if err != nil {
+		return nil, err
+	}
+	options, err := config.putOptions()
+	if err != nil {
+		return nil, err
+	}
+	lookup := minio.BucketLookupDNS
+	if config.PathStyle {
+		lookup = minio.BucketLookupPath
 	}
-	return AmazonS3Upload{accesskey, secretkey, bucketname}
+	client, err := minio.New(endpoint.Host, &minio.Options{
+		Creds:        credentials.NewStaticV4(accesskey, secretkey, ""),
+		Secure:       endpoint.Scheme == "https",
+		Region:       region,
+		BucketLookup: lookup,
+		// failed uploads are tried again by core, as its RetryPolicy says
+		MaxRetries: 1,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &AmazonS3Upload{
+		client:      client,
+		bucketname:  bucketname,
+		endpoint:    endpoint,
+		pathstyle:   config.PathStyle,
+		options:     options,
+		partsize:    int64(options.PartSize),
+		partthreads: int(options.NumThreads),
+	}, nil
 }
 
 // Upload implements github.com/helixdigital/imageserver/core/Uploader interface.
-// Saves the data in the io.Reader parameter on Amazon S3
-func (self AmazonS3Upload) Upload(data []byte, mime string, uplname string) error {
-	bucket := self.getbucket()
-	return bucket.Put(uplname, data, mime, s3.PublicRead)
+// Saves the data on Amazon S3. An image larger than PartSize is sent as a
+// multipart upload, PartThreads parts at a time, which is aborted if any
+// part fails. One of unknown size is read until it is known to be
+// larger than PartSize or has ended.
+//
+// An error from S3 is returned as an entities.UploadError that says
+// whether S3 might accept the image if it were sent again.
+func (self *AmazonS3Upload) Upload(rdr io.Reader, size int64, mime string, uplname string, upload entities.UploadOptions) error {
+	return classify(self.put(rdr, size, uplname, self.objectOptions(mime, upload)))
 }
 
-// Delete removes the path from Amazon S3.
-func (self AmazonS3Upload) Delete(uplname string) error {
-	bucket := self.getbucket()
-	return bucket.Del(uplname)
+// The options of one upload: those of the uploader, and those the
+// image is to be served with
+func (self *AmazonS3Upload) objectOptions(mime string, upload entities.UploadOptions) minio.PutObjectOptions {
+	options := self.options
+	options.ContentType = mime
+	options.CacheControl = upload.Cache_control
+	options.ContentDisposition = upload.Content_disposition
+	options.ContentEncoding = upload.Content_encoding
+	options.UserTags = upload.Tags
+	options.UserMetadata = make(map[string]string, len(self.options.UserMetadata)+len(upload.Metadata))
+	for name, value := range self.options.UserMetadata {
+		options.UserMetadata[name] = value
+	}
+	for name, value := range upload.Metadata {
+		options.UserMetadata["x-amz-meta-"+name] = value
+	}
+	return options
 }
 
-func (self AmazonS3Upload) getbucket() *s3.Bucket {
-	auth := aws.Auth{self.accesskey, self.secretkey}
-	s := s3.New(auth, aws.APSoutheast2)
-	return s.Bucket(self.bucketname)
+func (self *AmazonS3Upload) put(rdr io.Reader, size int64, uplname string, options minio.PutObjectOptions) error {
+	if size < 0 {
+		// reads just enough to know whether it needs more than one part
+		var head bytes.Buffer
+		if _, err := io.CopyN(&head, rdr, self.partsize+1); err == io.EOF {
+			rdr, size = &head, int64(head.Len())
+		} else if err != nil {
+			return err
+		} else {
+			rdr = io.MultiReader(&head, rdr)
+		}
+	}
+	if size >= 0 && size <= self.partsize {
+		options.DisableMultipart = true
+		_, err := self.client.PutObject(context.Background(), self.bucketname, uplname, rdr, size, options)
+		return err
+	}
+	return self.uploadParts(rdr, uplname, options)
+}
+
+// Says which errors from S3 are worth trying again: those where S3 was
+// busy or failed itself. Errors that did not come from S3, such as from
+// the network or from reading the image, are left unclassified.
+func classify(err error) error {
+	if err == nil {
+		return nil
+	}
+	resp := minio.ToErrorResponse(err)
+	switch {
+	case resp.StatusCode == 0:
+		return err
+	case resp.StatusCode >= 500,
+		resp.StatusCode == http.StatusRequestTimeout,
+		resp.StatusCode == http.StatusTooManyRequests,
+		resp.Code == "RequestTimeout",
+		resp.Code == "SlowDown":
+		return entities.TemporaryUploadError(err)
+	}
+	return entities.PermanentUploadError(err)
+}
+
+// Sends the image as a multipart upload, reading each part while up to
+// partthreads others are sent. If reading or sending any part fails the
+// upload is aborted, so that S3 does not keep the parts.
+func (self *AmazonS3Upload) uploadParts(rdr io.Reader, uplname string, options minio.PutObjectOptions) (err error) {
+	core := minio.Core{Client: self.client}
+	uploadid, err := core.NewMultipartUpload(context.Background(), self.bucketname, uplname, options)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			core.AbortMultipartUpload(context.Background(), self.bucketname, uplname, uploadid)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var lock sync.Mutex
+	var failed error
+	fail := func(err error) {
+		lock.Lock()
+		defer lock.Unlock()
+		if failed == nil {
+			failed = err
+			cancel()
+		}
+	}
+	var parts []minio.CompletePart
+	var sending sync.WaitGroup
+	threads := make(chan struct{}, self.partthreads)
+	for number := 1; ; number++ {
+		part := make([]byte, self.partsize)
+		length, rerr := io.ReadFull(rdr, part)
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil && rerr != io.ErrUnexpectedEOF {
+			fail(rerr)
+			break
+		}
+		select {
+		case threads <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		sending.Add(1)
+		go func(number int, part []byte) {
+			defer sending.Done()
+			defer func() { <-threads }()
+			sent, err := core.PutObjectPart(ctx, self.bucketname, uplname, uploadid, number,
+				bytes.NewReader(part), int64(len(part)), minio.PutObjectPartOptions{})
+			if err != nil {
+				fail(err)
+				return
+			}
+			lock.Lock()
+			parts = append(parts, minio.CompletePart{PartNumber: number, ETag: sent.ETag})
+			lock.Unlock()
+		}(number, part[:length])
+		if rerr == io.ErrUnexpectedEOF {
+			break
+		}
+	}
+	sending.Wait()
+	if failed != nil {
+		return failed
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].PartNumber < parts[j].PartNumber })
+	_, err = core.CompleteMultipartUpload(context.Background(), self.bucketname, uplname, uploadid, parts, options)
+	return err
+}
+
+// Delete implements github.com/helixdigital/imageserver/core/Deleter interface.
+// Removes the path from Amazon S3.
+func (self *AmazonS3Upload) Delete(uplname string) error {
+	return self.client.RemoveObject(context.Background(), self.bucketname, uplname, minio.RemoveObjectOptions{})
+}
+
+// URL implements github.com/helixdigital/imageserver/core/URLer.
+// It is where the uploaded file can be fetched from.
+func (self *AmazonS3Upload) URL(uplname string) string {
+	u := url.URL{Scheme: self.endpoint.Scheme, Host: self.endpoint.Host, Path: "/" + uplname}
+	if self.pathstyle {
+		u.Path = "/" + self.bucketname + u.Path
+	} else {
+		u.Host = self.bucketname + "." + u.Host
+	}
+	return u.String()
+}
+
+// The URL requests go to, and the region they are signed for
+func (self S3Config) endpoint() (*url.URL, string, error) {
+	if self.Endpoint == "" {
+		if !awsRegion.MatchString(self.Region) {
+			return nil, "", fmt.Errorf("%q is not an AWS region. Give an endpoint for other stores", self.Region)
+		}
+		return &url.URL{Scheme: "https", Host: "s3." + self.Region + ".amazonaws.com"}, self.Region, nil
+	}
+	endpoint, err := url.Parse(self.Endpoint)
+	if err != nil || endpoint.Host == "" || (endpoint.Scheme != "http" && endpoint.Scheme != "https") {
+		return nil, "", fmt.Errorf("%q is not an http(s) S3 endpoint", self.Endpoint)
+	}
+	region := self.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	return &url.URL{Scheme: endpoint.Scheme, Host: endpoint.Host}, region, nil
+}
+
+// The options that every upload is made with
+func (self S3Config) putOptions() (minio.PutObjectOptions, error) {
+	if !cannedACLs[self.ACL] {
+		return minio.PutObjectOptions{}, fmt.Errorf("%q is not a canned S3 ACL", self.ACL)
+	}
+	if self.PartSize == 0 {
+		self.PartSize = DefaultS3Config.PartSize
+	}
+	if self.PartThreads == 0 {
+		self.PartThreads = DefaultS3Config.PartThreads
+	}
+	if self.PartSize < minPartSize {
+		return minio.PutObjectOptions{}, fmt.Errorf("Parts must be at least %d bytes", minPartSize)
+	}
+	if self.PartThreads < 1 {
+		return minio.PutObjectOptions{}, errors.New("At least one part must be uploaded at a time")
+	}
+	options := minio.PutObjectOptions{
+		// headers starting x-amz- are sent as they are
+		UserMetadata: map[string]string{"x-amz-acl": self.ACL},
+		StorageClass: self.StorageClass,
+		PartSize:     uint64(self.PartSize),
+		NumThreads:   uint(self.PartThreads),
+	}
+	if self.SSEKMSKeyId != "" && self.ServerSideEncryption != "aws:kms" {
+		return minio.PutObjectOptions{}, errors.New("A KMS key can only be given with aws:kms server side encryption")
+	}
+	switch self.ServerSideEncryption {
+	case "":
+	case "AES256":
+		options.ServerSideEncryption = encrypt.NewSSE()
+	case "aws:kms":
+		sse, err := encrypt.NewSSEKMS(self.SSEKMSKeyId, nil)
+		if err != nil {
+			return minio.PutObjectOptions{}, err
+		}
+		options.ServerSideEncryption = sse
+	default:
+		return minio.PutObjectOptions{}, fmt.Errorf("%q is not a server side encryption S3 knows. Use AES256 or aws:kms", self.ServerSideEncryption)
+	}
+	return options, nil
 }
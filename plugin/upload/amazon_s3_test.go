@@ -17,53 +17,305 @@ limitations under the License.
 package upload
 
 import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
 	"net/http"
+	"strings"
 	"testing"
+	"testing/iotest"
+
+	"github.com/helixdigital/imageserver/entities"
 )
 
-var RUNNING_AGAINST_PRODUCTION bool = false
+// An uploader for the bucket "comet.is" on a fake S3
+func newTestS3(t *testing.T, config S3Config) (*fakeS3, *AmazonS3Upload) {
+	fake := newFakeS3("AKIDTEST", "s3cr3t", "ap-southeast-2")
+	t.Cleanup(fake.Close)
+	config.Endpoint = fake.URL
+	config.PathStyle = true
+	s3, err := NewAmazonS3Upload("AKIDTEST", "s3cr3t", "comet.is", config)
+	if err != nil {
+		t.Fatal("NewAmazonS3Upload unexpectedly threw an error", err)
+	}
+	return fake, s3
+}
 
-// Rename back to TestS3Upload when you want to run against live S3
 func TestS3Upload(t *testing.T) {
-	if !RUNNING_AGAINST_PRODUCTION {
-		return
-	}
-	s3 := NewAmazonS3Upload("", "", "")
-	err := s3.Upload([]byte("one two three four five"), "plain/text", "test.txt")
+	_, s3 := newTestS3(t, DefaultS3Config)
+	options := entities.UploadOptions{Cache_control: "public, max-age=86400"}
+	err := s3.Upload(strings.NewReader("one two three four five"), -1, "plain/text", "test.txt", options)
 	if err != nil {
-		t.Error("S3 upload failed with error", err)
+		t.Fatal("S3 upload failed with error", err)
 	}
-	defer s3.Delete("test.txt")
-	resp, err := http.Get("http://s3-ap-southeast-2.amazonaws.com/comet.is/test.txt")
+	resp, err := http.Get(s3.URL("test.txt"))
 	if err != nil {
-		t.Error("Getting test file from S3 production failed with error: ", err)
+		t.Fatal("Getting test file from S3 failed with error: ", err)
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
 		t.Error("Expected status code to be 200 but was", resp.StatusCode)
 	}
 	if resp.ContentLength != 23 {
 		t.Error("Expected content length to be 23 but was", resp.ContentLength)
 	}
+	if mime := resp.Header.Get("Content-Type"); mime != "plain/text" {
+		t.Error("Expected the content type to be plain/text but was", mime)
+	}
+	if cache := resp.Header.Get("Cache-Control"); cache != "public, max-age=86400" {
+		t.Error("Expected the image to be served with its Cache-Control but was", cache)
+	}
+	if data, _ := ioutil.ReadAll(resp.Body); string(data) != "one two three four five" {
+		t.Error("Expected the data that was uploaded but got", string(data))
+	}
 }
 
 func TestS3Delete(t *testing.T) {
-	if !RUNNING_AGAINST_PRODUCTION {
-		return
-	}
-	s3 := NewAmazonS3Upload("", "", "")
-	err := s3.Upload([]byte("one two three four five"), "plain/text", "test.txt")
+	_, s3 := newTestS3(t, DefaultS3Config)
+	err := s3.Upload(strings.NewReader("one two three four five"), -1, "plain/text", "test.txt", entities.UploadOptions{})
 	if err != nil {
-		t.Error("S3 upload failed with error", err)
+		t.Fatal("S3 upload failed with error", err)
 	}
-	s3.Delete("test.txt")
-	if err != nil {
+	if err := s3.Delete("test.txt"); err != nil {
 		t.Error("S3 delete failed with error", err)
 	}
-	resp, err := http.Get("http://s3-ap-southeast-2.amazonaws.com/comet.is/test.txt")
+	resp, err := http.Get(s3.URL("test.txt"))
 	if err != nil {
-		t.Error("Getting test file from S3 production failed with error: ", err)
+		t.Fatal("Getting test file from S3 failed with error: ", err)
 	}
+	resp.Body.Close()
 	if resp.StatusCode != 404 {
 		t.Error("Expected status code to be 404 but was", resp.StatusCode)
 	}
 }
+
+// Data that does not compress, of n bytes
+func randomData(n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(data)
+	return data
+}
+
+func TestS3UploadsLargeImagesInParts(t *testing.T) {
+	config := DefaultS3Config
+	config.PartSize = 5 << 20
+	config.PartThreads = 3
+	fake, s3 := newTestS3(t, config)
+	data := randomData(12 << 20)
+
+	for i, size := range []int64{-1, int64(len(data))} {
+		if err := s3.Upload(bytes.NewReader(data), size, "image/png", "large.png", entities.UploadOptions{}); err != nil {
+			t.Fatal("A large upload of size", size, "failed with error", err)
+		}
+		if fake.completed != i+1 {
+			t.Error("A large upload of size", size, "should have been a multipart upload")
+		}
+		object, _ := fake.object("/comet.is/large.png")
+		if !bytes.Equal(object.data, data) {
+			t.Error("The parts of the upload of size", size, "should have made up the image but made", len(object.data), "bytes")
+		}
+		if object.header.Get("Content-Type") != "image/png" {
+			t.Error("The upload should have kept its content type but had", object.header.Get("Content-Type"))
+		}
+	}
+}
+
+func TestS3UploadsSmallImagesWhole(t *testing.T) {
+	config := DefaultS3Config
+	config.PartSize = 5 << 20
+	fake, s3 := newTestS3(t, config)
+	data := randomData(5 << 20)
+
+	if err := s3.Upload(bytes.NewReader(data), -1, "image/png", "small.png", entities.UploadOptions{}); err != nil {
+		t.Fatal("An upload of one part failed with error", err)
+	}
+	if fake.completed != 0 {
+		t.Error("An image no larger than a part should have been put whole")
+	}
+	if object, _ := fake.object("/comet.is/small.png"); !bytes.Equal(object.data, data) {
+		t.Error("The image should have been stored but", len(object.data), "bytes were")
+	}
+}
+
+func TestS3AbortsFailedMultipartUploads(t *testing.T) {
+	config := DefaultS3Config
+	config.PartSize = 5 << 20
+	config.PartThreads = 1
+	fake, s3 := newTestS3(t, config)
+	fake.failPart = 2
+
+	if err := s3.Upload(bytes.NewReader(randomData(12<<20)), -1, "image/png", "failed.png", entities.UploadOptions{}); err == nil {
+		t.Error("An upload with a refused part should have failed")
+	}
+	if fake.aborted != 1 || len(fake.uploads) != 0 {
+		t.Error("The multipart upload should have been aborted but", fake.aborted, "were, and", len(fake.uploads), "are left")
+	}
+	if _, ok := fake.object("/comet.is/failed.png"); ok {
+		t.Error("A failed upload should not have been stored")
+	}
+}
+
+func TestS3ErrorsSayWhetherToRetry(t *testing.T) {
+	config := DefaultS3Config
+	config.PartSize = 5 << 20
+	config.PartThreads = 1
+	fake, s3 := newTestS3(t, config)
+
+	var uplerr entities.UploadError
+	fake.busy = true
+	err := s3.Upload(io.MultiReader(strings.NewReader("image")), -1, "image/png", "busy.png", entities.UploadOptions{})
+	if !errors.As(err, &uplerr) || !uplerr.Temporary {
+		t.Error("An upload S3 was too busy for should have been temporary but threw", err)
+	}
+	fake.busy = false
+	fake.failPart = 2
+	err = s3.Upload(bytes.NewReader(randomData(12<<20)), -1, "image/png", "refused.png", entities.UploadOptions{})
+	if !errors.As(err, &uplerr) || uplerr.Temporary {
+		t.Error("An upload S3 refused should have been permanent but threw", err)
+	}
+	if err := s3.Upload(iotest.ErrReader(errors.New("encoding failed")), -1, "image/png", "unread.png", entities.UploadOptions{}); errors.As(err, &uplerr) {
+		t.Error("An image that cannot be read should have been left unclassified but was", uplerr)
+	}
+}
+
+func TestS3UploadFailsWhenTheImageCannotBeRead(t *testing.T) {
+	config := DefaultS3Config
+	config.PartSize = 5 << 20
+	fake, s3 := newTestS3(t, config)
+	failing := errors.New("encoding failed")
+
+	small := iotest.ErrReader(failing)
+	if err := s3.Upload(small, -1, "image/png", "small.png", entities.UploadOptions{}); err == nil {
+		t.Error("An image that cannot be read should have failed")
+	}
+	large := io.MultiReader(bytes.NewReader(randomData(11<<20)), iotest.ErrReader(failing))
+	if err := s3.Upload(large, -1, "image/png", "large.png", entities.UploadOptions{}); err == nil {
+		t.Error("A large image that cannot be read to the end should have failed")
+	}
+	if len(fake.objects) != 0 || len(fake.uploads) != 0 {
+		t.Error("Nothing should have been stored but found", len(fake.objects), "objects and", len(fake.uploads), "uploads")
+	}
+}
+
+func TestS3UploadIsSigned(t *testing.T) {
+	fake := newFakeS3("AKIDTEST", "s3cr3t", "ap-southeast-2")
+	defer fake.Close()
+	config := S3Config{Region: "ap-southeast-2", Endpoint: fake.URL, PathStyle: true, ACL: "private"}
+
+	s3, _ := NewAmazonS3Upload("AKIDTEST", "wrong", "comet.is", config)
+	if err := s3.Upload(strings.NewReader("x"), -1, "plain/text", "test.txt", entities.UploadOptions{}); err == nil {
+		t.Error("An upload signed with the wrong secret should have failed")
+	}
+	config.Region = "us-east-1"
+	s3, _ = NewAmazonS3Upload("AKIDTEST", "s3cr3t", "comet.is", config)
+	if err := s3.Upload(strings.NewReader("x"), -1, "plain/text", "test.txt", entities.UploadOptions{}); err == nil {
+		t.Error("An upload signed for the wrong region should have failed")
+	}
+	if _, ok := fake.object("/comet.is/test.txt"); ok {
+		t.Error("A badly signed upload should not have been stored")
+	}
+}
+
+func TestS3UploadSendsConfig(t *testing.T) {
+	config := S3Config{
+		Region:               "ap-southeast-2",
+		ACL:                  "private",
+		StorageClass:         "STANDARD_IA",
+		ServerSideEncryption: "aws:kms",
+		SSEKMSKeyId:          "alias/images",
+	}
+	fake, s3 := newTestS3(t, config)
+	options := entities.UploadOptions{
+		Cache_control:       "private, max-age=60",
+		Content_disposition: "inline",
+		Content_encoding:    "identity",
+		Metadata:            map[string]string{"user-id": "1"},
+		Tags:                map[string]string{"kind": "avatar"},
+	}
+	if err := s3.Upload(strings.NewReader("private"), -1, "image/png", "users/1/avatar.png", options); err != nil {
+		t.Fatal("S3 upload failed with error", err)
+	}
+	object, ok := fake.object("/comet.is/users/1/avatar.png")
+	if !ok {
+		t.Fatal("The image should have been stored")
+	}
+	expected := map[string]string{
+		"X-Amz-Acl":                                   "private",
+		"X-Amz-Storage-Class":                         "STANDARD_IA",
+		"X-Amz-Server-Side-Encryption":                "aws:kms",
+		"X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id": "alias/images",
+		"Cache-Control":                               "private, max-age=60",
+		"Content-Disposition":                         "inline",
+		"Content-Encoding":                            "identity",
+		"X-Amz-Meta-User-Id":                          "1",
+		"X-Amz-Tagging":                               "kind=avatar",
+	}
+	for name, value := range expected {
+		if object.header.Get(name) != value {
+			t.Error("The header", name, "should have been", value, "but was", object.header.Get(name))
+		}
+	}
+	resp, _ := http.Get(s3.URL("users/1/avatar.png"))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Error("A private image should not have been public but got", resp.StatusCode)
+	}
+}
+
+func TestNewAmazonS3UploadNeedsCredentials(t *testing.T) {
+	if _, err := NewAmazonS3Upload("key", "", "bucket", DefaultS3Config); err != ErrMissingCredentials {
+		t.Error("A missing secret key should have thrown ErrMissingCredentials but threw", err)
+	}
+}
+
+func TestS3ConfigRegion(t *testing.T) {
+	s3, err := NewAmazonS3Upload("key", "secret", "comet.is", DefaultS3Config)
+	if err != nil {
+		t.Fatal("The default config unexpectedly threw an error", err)
+	}
+	if url := s3.URL("a.png"); url != "https://s3.ap-southeast-2.amazonaws.com/comet.is/a.png" {
+		t.Error("The default config should have been path style in ap-southeast-2 but the URL was", url)
+	}
+
+	s3, _ = NewAmazonS3Upload("key", "secret", "bucket", S3Config{Region: "eu-west-1", ACL: "private"})
+	if url := s3.URL("a b.png"); url != "https://bucket.s3.eu-west-1.amazonaws.com/a%20b.png" {
+		t.Error("Without PathStyle the bucket should have been in the host but the URL was", url)
+	}
+
+	if _, err := NewAmazonS3Upload("key", "secret", "bucket", S3Config{Region: "Sydney", ACL: "private"}); err == nil {
+		t.Error("A bad region without an endpoint should have thrown an error")
+	}
+}
+
+func TestS3ConfigEndpoint(t *testing.T) {
+	config := S3Config{Endpoint: "http://minio.local:9000/", PathStyle: true, ACL: "private"}
+	s3, err := NewAmazonS3Upload("key", "secret", "bucket", config)
+	if err != nil {
+		t.Fatal("An endpoint unexpectedly threw an error", err)
+	}
+	if url := s3.URL("a.png"); url != "http://minio.local:9000/bucket/a.png" {
+		t.Error("The URL should have been on the endpoint but was", url)
+	}
+
+	config.Endpoint = "minio.local:9000"
+	if _, err := NewAmazonS3Upload("key", "secret", "bucket", config); err == nil {
+		t.Error("An endpoint that is not an http(s) URL should have thrown an error")
+	}
+}
+
+func TestS3ConfigErrors(t *testing.T) {
+	bad := []S3Config{
+		{Region: "ap-southeast-2", ACL: "everyone"},
+		{Region: "ap-southeast-2", ACL: "private", ServerSideEncryption: "rot13"},
+		{Region: "ap-southeast-2", ACL: "private", SSEKMSKeyId: "alias/images"},
+		{Region: "ap-southeast-2", ACL: "private", PartSize: 1 << 20},
+		{Region: "ap-southeast-2", ACL: "private", PartThreads: -1},
+	}
+	for _, config := range bad {
+		if _, err := NewAmazonS3Upload("key", "secret", "bucket", config); err == nil {
+			t.Error("The config should have thrown an error", config)
+		}
+	}
+}
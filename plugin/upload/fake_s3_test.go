@@ -0,0 +1,385 @@
+/*
+Copyright 2014 Helix Digital
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package upload
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// fakeS3 is an S3 server in the test process. It keeps objects in memory,
+// addressed by path, and refuses requests that are not signed with AWS
+// Signature Version 4 by its one account. Objects stored with a public
+// ACL can be fetched without a signature. Objects can be put whole or
+// in parts with a multipart upload.
+type fakeS3 struct {
+	*httptest.Server
+	accesskey string
+	secretkey string
+	region    string
+	lock      sync.Mutex
+	objects   map[string]fakeObject
+	uploads   map[string]*fakeUpload
+	// how many multipart uploads were completed and aborted
+	completed int
+	aborted   int
+	// a part with this number is refused
+	failPart int
+	// if set, every PUT is answered as if S3 were too busy
+	busy bool
+}
+
+type fakeObject struct {
+	data   []byte
+	header http.Header
+}
+
+// A multipart upload that is under way
+type fakeUpload struct {
+	path   string
+	header http.Header
+	parts  map[int][]byte
+}
+
+func newFakeS3(accesskey string, secretkey string, region string) *fakeS3 {
+	self := &fakeS3{
+		accesskey: accesskey,
+		secretkey: secretkey,
+		region:    region,
+		objects:   map[string]fakeObject{},
+		uploads:   map[string]*fakeUpload{},
+	}
+	self.Server = httptest.NewServer(self)
+	return self
+}
+
+func (self *fakeS3) object(path string) (fakeObject, bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	object, ok := self.objects[path]
+	return object, ok
+}
+
+func (self *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.Count(r.URL.Path, "/") < 2 {
+		s3Error(w, http.StatusNotImplemented, "NotImplemented", "Only objects are faked")
+		return
+	}
+	signed := r.Header.Get("Authorization") != ""
+	if signed {
+		if err := self.verify(r); err != nil {
+			s3Error(w, http.StatusForbidden, "SignatureDoesNotMatch", err.Error())
+			return
+		}
+	}
+	if self.busy && r.Method == "PUT" {
+		s3Error(w, http.StatusServiceUnavailable, "SlowDown", "Please reduce your request rate")
+		return
+	}
+	if _, multipart := r.URL.Query()["uploads"]; multipart || r.URL.Query().Get("uploadId") != "" {
+		if !signed {
+			s3Error(w, http.StatusForbidden, "AccessDenied", "Anonymous uploads are not allowed")
+			return
+		}
+		self.serveMultipart(w, r)
+		return
+	}
+	switch r.Method {
+	case "PUT":
+		if !signed {
+			s3Error(w, http.StatusForbidden, "AccessDenied", "Anonymous uploads are not allowed")
+			return
+		}
+		data, err := readPayload(r)
+		if err != nil {
+			s3Error(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+			return
+		}
+		self.lock.Lock()
+		self.objects[r.URL.Path] = fakeObject{data, storedHeader(r)}
+		self.lock.Unlock()
+		sum := sha256.Sum256(data)
+		w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	case "GET", "HEAD":
+		object, ok := self.object(r.URL.Path)
+		if !ok {
+			s3Error(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+			return
+		}
+		if acl := object.header.Get("X-Amz-Acl"); !signed && acl != "public-read" && acl != "public-read-write" {
+			s3Error(w, http.StatusForbidden, "AccessDenied", "Access Denied")
+			return
+		}
+		for name, values := range object.header {
+			switch {
+			case name == "Content-Type", name == "Cache-Control", name == "Content-Disposition",
+				name == "Content-Encoding", strings.HasPrefix(name, "X-Amz-Meta-"):
+				w.Header()[name] = values
+			}
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(object.data)))
+		w.Write(object.data)
+	case "DELETE":
+		if !signed {
+			s3Error(w, http.StatusForbidden, "AccessDenied", "Anonymous deletes are not allowed")
+			return
+		}
+		self.lock.Lock()
+		delete(self.objects, r.URL.Path)
+		self.lock.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s3Error(w, http.StatusMethodNotAllowed, "MethodNotAllowed", r.Method+" is not faked")
+	}
+}
+
+// Starts, adds parts to, completes and aborts multipart uploads
+func (self *fakeS3) serveMultipart(w http.ResponseWriter, r *http.Request) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	id := r.URL.Query().Get("uploadId")
+	if id == "" {
+		id = strconv.Itoa(len(self.uploads) + self.completed + self.aborted + 1)
+		self.uploads[id] = &fakeUpload{path: r.URL.Path, header: storedHeader(r), parts: map[int][]byte{}}
+		w.Header().Set("Content-Type", "application/xml")
+		bucket, key := splitPath(r.URL.Path)
+		fmt.Fprintf(w, `<InitiateMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>`, bucket, key, id)
+		return
+	}
+	upload, ok := self.uploads[id]
+	if !ok || upload.path != r.URL.Path {
+		s3Error(w, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist.")
+		return
+	}
+	switch r.Method {
+	case "PUT":
+		number, _ := strconv.Atoi(r.URL.Query().Get("partNumber"))
+		if number == self.failPart {
+			s3Error(w, http.StatusForbidden, "AccessDenied", "Part refused")
+			return
+		}
+		data, err := readPayload(r)
+		if err != nil {
+			s3Error(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+			return
+		}
+		upload.parts[number] = data
+		w.Header().Set("ETag", fmt.Sprintf(`"part%d"`, number))
+	case "POST":
+		var complete struct {
+			Parts []struct{ PartNumber int } `xml:"Part"`
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&complete); err != nil {
+			s3Error(w, http.StatusBadRequest, "MalformedXML", err.Error())
+			return
+		}
+		var data []byte
+		for i, part := range complete.Parts {
+			if part.PartNumber != i+1 || upload.parts[i+1] == nil {
+				s3Error(w, http.StatusBadRequest, "InvalidPartOrder", "Parts must be complete and in order")
+				return
+			}
+			if i < len(complete.Parts)-1 && len(upload.parts[i+1]) < 5<<20 {
+				s3Error(w, http.StatusBadRequest, "EntityTooSmall", "Only the last part may be under 5MiB")
+				return
+			}
+			data = append(data, upload.parts[i+1]...)
+		}
+		self.objects[upload.path] = fakeObject{data, upload.header}
+		delete(self.uploads, id)
+		self.completed++
+		w.Header().Set("Content-Type", "application/xml")
+		bucket, key := splitPath(upload.path)
+		fmt.Fprintf(w, `<CompleteMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><ETag>"multipart-%d"</ETag></CompleteMultipartUploadResult>`, bucket, key, len(complete.Parts))
+	case "DELETE":
+		delete(self.uploads, id)
+		self.aborted++
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s3Error(w, http.StatusMethodNotAllowed, "MethodNotAllowed", r.Method+" is not faked")
+	}
+}
+
+// The bucket and key of a path-style path
+func splitPath(path string) (string, string) {
+	parts := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)
+	return parts[0], parts[1]
+}
+
+func s3Error(w http.ResponseWriter, status int, code string, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>%s</Code><Message>%s</Message></Error>`, code, message)
+}
+
+// Checks the Authorization header the way S3 does
+func (self *fakeS3) verify(r *http.Request) error {
+	const algorithm = "AWS4-HMAC-SHA256 "
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, algorithm) {
+		return fmt.Errorf("Only Signature Version 4 is accepted, not %q", auth)
+	}
+	fields := map[string]string{}
+	for _, field := range strings.Split(strings.TrimPrefix(auth, algorithm), ",") {
+		parts := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(parts) == 2 {
+			fields[parts[0]] = parts[1]
+		}
+	}
+	credential := strings.Split(fields["Credential"], "/")
+	if len(credential) != 5 || credential[0] != self.accesskey {
+		return fmt.Errorf("Unknown credential %q", fields["Credential"])
+	}
+	date, region, service := credential[1], credential[2], credential[3]
+	if region != self.region || service != "s3" || credential[4] != "aws4_request" {
+		return fmt.Errorf("The scope %q is wrong", fields["Credential"])
+	}
+	amzdate := r.Header.Get("X-Amz-Date")
+	if !strings.HasPrefix(amzdate, date) {
+		return fmt.Errorf("X-Amz-Date %q does not match the scope", amzdate)
+	}
+
+	signedHeaders := strings.Split(fields["SignedHeaders"], ";")
+	var headers strings.Builder
+	for _, name := range signedHeaders {
+		value := strings.Join(r.Header.Values(name), ",")
+		if name == "host" {
+			value = r.Host
+		}
+		headers.WriteString(name + ":" + strings.Join(strings.Fields(value), " ") + "\n")
+	}
+	canonical := strings.Join([]string{
+		r.Method,
+		encodePath(r.URL.Path),
+		strings.ReplaceAll(r.URL.Query().Encode(), "+", "%20"),
+		headers.String(),
+		fields["SignedHeaders"],
+		r.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+	hashed := sha256.Sum256([]byte(canonical))
+	scope := strings.Join(credential[1:], "/")
+	tosign := "AWS4-HMAC-SHA256\n" + amzdate + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+
+	key := []byte("AWS4" + self.secretkey)
+	for _, part := range credential[1:] {
+		key = hmacSHA256(key, part)
+	}
+	if expected := hex.EncodeToString(hmacSHA256(key, tosign)); !hmac.Equal([]byte(expected), []byte(fields["Signature"])) {
+		return fmt.Errorf("The signature does not match")
+	}
+	return nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// Escapes everything in the path but unreserved characters and slashes
+func encodePath(path string) string {
+	var encoded strings.Builder
+	for _, c := range []byte(path) {
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~/", c) >= 0 {
+			encoded.WriteByte(c)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", c)
+		}
+	}
+	return encoded.String()
+}
+
+// Reads the body, which may be in aws-chunked streaming encoding, and
+// checks it against the length and hash that were signed
+func readPayload(r *http.Request) ([]byte, error) {
+	hash := r.Header.Get("X-Amz-Content-Sha256")
+	if strings.HasPrefix(hash, "STREAMING-") {
+		data, err := readChunked(bufio.NewReader(r.Body))
+		if err != nil {
+			return nil, err
+		}
+		if decoded := r.Header.Get("X-Amz-Decoded-Content-Length"); decoded != strconv.Itoa(len(data)) {
+			return nil, fmt.Errorf("Read %d bytes but X-Amz-Decoded-Content-Length was %s", len(data), decoded)
+		}
+		return data, nil
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	if hash != "UNSIGNED-PAYLOAD" {
+		if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != hash {
+			return nil, fmt.Errorf("The body does not match X-Amz-Content-Sha256")
+		}
+	}
+	return data, nil
+}
+
+// The headers kept with an object. As S3 does, aws-chunked is taken off
+// Content-Encoding, since it only describes how the payload was sent.
+func storedHeader(r *http.Request) http.Header {
+	header := r.Header.Clone()
+	var encodings []string
+	for _, encoding := range strings.Split(header.Get("Content-Encoding"), ",") {
+		if encoding = strings.TrimSpace(encoding); encoding != "" && encoding != "aws-chunked" {
+			encodings = append(encodings, encoding)
+		}
+	}
+	if len(encodings) == 0 {
+		header.Del("Content-Encoding")
+	} else {
+		header.Set("Content-Encoding", strings.Join(encodings, ","))
+	}
+	return header
+}
+
+// Each chunk is "<hex size>;chunk-signature=<sig>\r\n<data>\r\n" and the
+// last one is empty
+func readChunked(rdr *bufio.Reader) ([]byte, error) {
+	var data bytes.Buffer
+	for {
+		line, err := rdr.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.ParseInt(strings.SplitN(strings.TrimSpace(line), ";", 2)[0], 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.CopyN(&data, rdr, size); err != nil {
+			return nil, err
+		}
+		if crlf, err := rdr.ReadString('\n'); err != nil || crlf != "\r\n" {
+			return nil, fmt.Errorf("A chunk was not followed by CRLF")
+		}
+		if size == 0 {
+			return data.Bytes(), nil
+		}
+	}
+}
@@ -0,0 +1,223 @@
+/*
+Copyright 2014 Helix Digital
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package upload
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/helixdigital/imageserver/entities"
+)
+
+// Backend is anything FanOutUpload can send an image to. It is the
+// github.com/helixdigital/imageserver/core/Uploader interface.
+type Backend interface {
+	Upload(io.Reader, int64, string, string, entities.UploadOptions) error
+}
+
+// Destination is one of the backends a FanOutUpload sends images to
+type Destination struct {
+	// such as "s3" or "fs", to say which destination a result is from
+	Name    string
+	Backend Backend
+}
+
+// FanOutPolicy says when a FanOutUpload has succeeded
+type FanOutPolicy int
+
+const (
+	// AllMustSucceed fails the upload if any destination fails, and
+	// stops sending the image to the others when one does
+	AllMustSucceed FanOutPolicy = iota
+	// BestEffort succeeds if any destination stores the image
+	BestEffort
+)
+
+// FanOutPolicyNamed converts "all" or "best" into a FanOutPolicy
+func FanOutPolicyNamed(name string) (FanOutPolicy, error) {
+	switch name {
+	case "all":
+		return AllMustSucceed, nil
+	case "best":
+		return BestEffort, nil
+	}
+	return AllMustSucceed, fmt.Errorf("Unknown fan out policy %s", name)
+}
+
+// The error of a destination that was stopped because another failed
+var errStopped = errors.New("Stopped because another destination failed")
+
+// FanOutUpload implements github.com/helixdigital/imageserver/core/Uploader
+//
+// It sends each image to several destinations at once, as it is read.
+// The image is read as fast as the slowest destination takes it.
+type FanOutUpload struct {
+	policy       FanOutPolicy
+	destinations []Destination
+}
+
+// NewFanOutUpload is a factory that creates an uploader that sends each
+// image to every one of destinations. They must have different names.
+func NewFanOutUpload(policy FanOutPolicy, destinations ...Destination) (*FanOutUpload, error) {
+	if len(destinations) == 0 {
+		return nil, errors.New("There must be at least one destination")
+	}
+	names := map[string]bool{}
+	for _, dest := range destinations {
+		if dest.Name == "" || names[dest.Name] {
+			return nil, fmt.Errorf("Destination names must be given and different, not %q", dest.Name)
+		}
+		names[dest.Name] = true
+	}
+	return &FanOutUpload{policy, destinations}, nil
+}
+
+// Upload implements github.com/helixdigital/imageserver/core/Uploader interface.
+func (self *FanOutUpload) Upload(rdr io.Reader, size int64, mime string, uplname string, options entities.UploadOptions) error {
+	_, err := self.UploadToEach(rdr, size, mime, uplname, options)
+	return err
+}
+
+// UploadToEach sends the image to every destination in parallel, and
+// returns how each fared as well as whether the upload succeeded by the
+// policy. A failure is permanent if any destination's failure was.
+func (self *FanOutUpload) UploadToEach(rdr io.Reader, size int64, mime string, uplname string, options entities.UploadOptions) ([]entities.DestinationStatus, error) {
+	results := make([]entities.DestinationStatus, len(self.destinations))
+	writers := make([]*io.PipeWriter, len(self.destinations))
+	failed := make(chan struct{})
+	var failOnce sync.Once
+	var sending sync.WaitGroup
+	for i, dest := range self.destinations {
+		prdr, pwtr := io.Pipe()
+		writers[i] = pwtr
+		sending.Add(1)
+		go func(i int, dest Destination) {
+			defer sending.Done()
+			err := dest.Backend.Upload(prdr, size, mime, uplname, options)
+			// stops the copy to a destination that gave up before reading it all
+			prdr.CloseWithError(errStopped)
+			results[i] = entities.DestinationStatus{Destination: dest.Name, Err: err}
+			if err != nil && self.policy == AllMustSucceed {
+				failOnce.Do(func() { close(failed) })
+			}
+		}(i, dest)
+	}
+	copyToEach(rdr, writers, failed)
+	sending.Wait()
+	return results, self.outcome(results)
+}
+
+// Copies rdr to every writer until it ends, fails, or failed is
+// closed. A writer whose destination has stopped reading is skipped.
+func copyToEach(rdr io.Reader, writers []*io.PipeWriter, failed <-chan struct{}) {
+	live := append([]*io.PipeWriter(nil), writers...)
+	buf := make([]byte, 32<<10)
+	for len(live) > 0 {
+		select {
+		case <-failed:
+			closeAll(live, errStopped)
+			return
+		default:
+		}
+		n, err := rdr.Read(buf)
+		if n > 0 {
+			written := live[:0]
+			for _, wtr := range live {
+				if _, werr := wtr.Write(buf[:n]); werr == nil {
+					written = append(written, wtr)
+				}
+			}
+			live = written
+		}
+		if err == io.EOF {
+			closeAll(live, nil)
+			return
+		}
+		if err != nil {
+			closeAll(live, err)
+			return
+		}
+	}
+}
+
+func closeAll(writers []*io.PipeWriter, err error) {
+	for _, wtr := range writers {
+		wtr.CloseWithError(err)
+	}
+}
+
+// Whether the upload succeeded by the policy and, if not, why
+func (self *FanOutUpload) outcome(results []entities.DestinationStatus) error {
+	var reasons []string
+	succeeded, permanent := 0, false
+	for _, result := range results {
+		if result.Err == nil {
+			succeeded++
+			continue
+		}
+		if errors.Is(result.Err, errStopped) {
+			continue
+		}
+		reasons = append(reasons, result.Destination+": "+result.Err.Error())
+		var uplerr entities.UploadError
+		if errors.As(result.Err, &uplerr) && !uplerr.Temporary {
+			permanent = true
+		}
+	}
+	if succeeded == len(results) || (self.policy == BestEffort && succeeded > 0) {
+		return nil
+	}
+	err := errors.New(strings.Join(reasons, "; "))
+	if permanent {
+		return entities.PermanentUploadError(err)
+	}
+	return err
+}
+
+// Delete implements github.com/helixdigital/imageserver/core/Deleter interface.
+// Removes the image from every destination that can delete, and
+// returns the errors of those that could not
+func (self *FanOutUpload) Delete(uplname string) error {
+	var reasons []string
+	for _, dest := range self.destinations {
+		deleter, ok := dest.Backend.(interface{ Delete(string) error })
+		if !ok {
+			continue
+		}
+		if err := deleter.Delete(uplname); err != nil {
+			reasons = append(reasons, dest.Name+": "+err.Error())
+		}
+	}
+	if len(reasons) > 0 {
+		return errors.New(strings.Join(reasons, "; "))
+	}
+	return nil
+}
+
+// URL is where the image can be fetched from the first destination that
+// can say, or empty if none can
+func (self *FanOutUpload) URL(uplname string) string {
+	for _, dest := range self.destinations {
+		if urler, ok := dest.Backend.(interface{ URL(string) string }); ok {
+			return urler.URL(uplname)
+		}
+	}
+	return ""
+}
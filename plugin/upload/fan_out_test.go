@@ -0,0 +1,150 @@
+/*
+Copyright 2014 Helix Digital
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package upload
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/helixdigital/imageserver/entities"
+)
+
+// A backend that fails without reading the image
+type brokenBackend struct {
+	err error
+}
+
+func (self brokenBackend) Upload(rdr io.Reader, size int64, mime string, uplname string, options entities.UploadOptions) error {
+	return self.err
+}
+
+func TestFanOutSendsToEveryDestination(t *testing.T) {
+	first, second := NewMock(), NewMock()
+	fanout, _ := NewFanOutUpload(AllMustSucceed, Destination{"s3", first}, Destination{"fs", second})
+	data := string(randomData(100 << 10))
+
+	results, err := fanout.UploadToEach(strings.NewReader(data), int64(len(data)), "image/png", "both.png", entities.UploadOptions{Cache_control: "no-cache"})
+	if err != nil {
+		t.Fatal("Uploading to both destinations unexpectedly threw", err)
+	}
+	for _, mock := range []*MockUpload{first, second} {
+		if mock.CalledData != data || mock.CalledSize != int64(len(data)) || mock.CalledUplname != "both.png" || mock.CalledOptions.Cache_control != "no-cache" {
+			t.Error("Each destination should have been sent the whole image but got", len(mock.CalledData), "bytes as", mock.CalledUplname)
+		}
+	}
+	if len(results) != 2 || results[0] != (entities.DestinationStatus{Destination: "s3"}) || results[1] != (entities.DestinationStatus{Destination: "fs"}) {
+		t.Error("Both destinations should have succeeded but results were", results)
+	}
+}
+
+func TestFanOutAllMustSucceed(t *testing.T) {
+	fanout, _ := NewFanOutUpload(AllMustSucceed, Destination{"s3", NewMock()}, Destination{"fs", brokenBackend{errors.New("disk full")}})
+
+	results, err := fanout.UploadToEach(bytes.NewReader(randomData(1<<20)), -1, "image/png", "one.png", entities.UploadOptions{})
+	if err == nil || err.Error() != "fs: disk full" {
+		t.Error("A failing destination should have failed the upload but threw", err)
+	}
+	if results[0].Err != nil && !errors.Is(results[0].Err, errStopped) {
+		t.Error("The other destination should have succeeded or been stopped but threw", results[0].Err)
+	}
+	if results[1].Err == nil || results[1].Err.Error() != "disk full" {
+		t.Error("The failing destination should have had its error but had", results[1].Err)
+	}
+}
+
+func TestFanOutBestEffort(t *testing.T) {
+	mock := NewMock()
+	fanout, _ := NewFanOutUpload(BestEffort, Destination{"s3", brokenBackend{errors.New("SlowDown")}}, Destination{"fs", mock})
+
+	results, err := fanout.UploadToEach(strings.NewReader("image"), -1, "image/png", "one.png", entities.UploadOptions{})
+	if err != nil {
+		t.Error("One destination storing the image should have been enough but threw", err)
+	}
+	if mock.CalledData != "image" || results[0].Err == nil || results[1].Err != nil {
+		t.Error("The results should have shown which destination failed but were", results)
+	}
+
+	fanout, _ = NewFanOutUpload(BestEffort, Destination{"s3", brokenBackend{errors.New("SlowDown")}}, Destination{"dr", brokenBackend{errors.New("no route to host")}})
+	if _, err := fanout.UploadToEach(strings.NewReader("image"), -1, "image/png", "one.png", entities.UploadOptions{}); err == nil || err.Error() != "s3: SlowDown; dr: no route to host" {
+		t.Error("Every destination failing should have failed the upload but threw", err)
+	}
+}
+
+func TestFanOutFailureIsPermanentIfAnyIs(t *testing.T) {
+	var uplerr entities.UploadError
+	fanout, _ := NewFanOutUpload(BestEffort,
+		Destination{"s3", brokenBackend{entities.TemporaryUploadError(errors.New("SlowDown"))}},
+		Destination{"fs", brokenBackend{ErrBadName}})
+	err := fanout.Upload(strings.NewReader("image"), -1, "image/png", "../one.png", entities.UploadOptions{})
+	if !errors.As(err, &uplerr) || uplerr.Temporary {
+		t.Error("A destination refusing the image should have made the failure permanent but threw", err)
+	}
+
+	fanout, _ = NewFanOutUpload(BestEffort,
+		Destination{"s3", brokenBackend{entities.TemporaryUploadError(errors.New("SlowDown"))}},
+		Destination{"fs", brokenBackend{errors.New("disk full")}})
+	err = fanout.Upload(strings.NewReader("image"), -1, "image/png", "one.png", entities.UploadOptions{})
+	if errors.As(err, &uplerr) {
+		t.Error("Failures that may go away should not have made the failure permanent but threw", err)
+	}
+}
+
+func TestFanOutUploadFailsWhenTheImageCannotBeRead(t *testing.T) {
+	first, second := NewMock(), NewMock()
+	fanout, _ := NewFanOutUpload(BestEffort, Destination{"s3", first}, Destination{"fs", second})
+	failing := errors.New("encoding failed")
+
+	results, err := fanout.UploadToEach(io.MultiReader(strings.NewReader("part"), iotest.ErrReader(failing)), -1, "image/png", "one.png", entities.UploadOptions{})
+	if err == nil {
+		t.Error("An image that cannot be read should have failed")
+	}
+	for _, result := range results {
+		if result.Err != failing {
+			t.Error("Each destination should have failed reading the image but threw", result.Err)
+		}
+	}
+}
+
+func TestFanOutDeleteAndURL(t *testing.T) {
+	first, second := NewMock(), NewMock()
+	fanout, _ := NewFanOutUpload(AllMustSucceed, Destination{"s3", brokenBackend{}}, Destination{"fs", first}, Destination{"cdn", second})
+	if err := fanout.Delete("gone.png"); err != nil {
+		t.Error("Deleting unexpectedly threw", err)
+	}
+	if first.DeletedName != "gone.png" || second.DeletedName != "gone.png" {
+		t.Error("Every destination that can delete should have deleted but deleted", first.DeletedName, second.DeletedName)
+	}
+	if url := fanout.URL("here.png"); url != "mock://here.png" {
+		t.Error("The URL should have come from the first destination that has one but was", url)
+	}
+}
+
+func TestNewFanOutUploadErrors(t *testing.T) {
+	if _, err := NewFanOutUpload(BestEffort); err == nil {
+		t.Error("A fan out without destinations should have thrown an error")
+	}
+	if _, err := NewFanOutUpload(BestEffort, Destination{"s3", NewMock()}, Destination{"s3", NewMock()}); err == nil {
+		t.Error("Destinations with the same name should have thrown an error")
+	}
+	if _, err := FanOutPolicyNamed("some"); err == nil {
+		t.Error("An unknown policy should have thrown an error")
+	}
+}
@@ -0,0 +1,215 @@
+/*
+Copyright 2014 Helix Digital
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package upload
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/helixdigital/imageserver/entities"
+)
+
+// ErrBadName is returned for an uploaded name that would be stored
+// outside the root directory. Trying again will not help.
+var ErrBadName = entities.PermanentUploadError(errors.New("The uploaded name must be relative and not contain .."))
+
+// ErrReservedName is returned for an uploaded name that ends like the
+// files kept beside each upload, so that one image cannot overwrite the
+// mime type or options of another
+var ErrReservedName = entities.PermanentUploadError(errors.New("The uploaded name must not end in .mime or .options"))
+
+// The extension of the file beside each upload that holds its mime type
+const mimeSidecar = ".mime"
+
+// The extension of the file beside each upload that holds, as JSON, the
+// UploadOptions it was uploaded with
+const optionsSidecar = ".options"
+
+// FilesystemUpload implements github.com/helixdigital/imageserver/core/Uploader
+//
+// It writes images into a directory tree, so that the server can be run
+// without a cloud account. Each image is written to a temporary file and
+// renamed into place, so a reader never sees half an image. Its mime
+// type is kept beside it in a file with ".mime" added to the name, and
+// the options it was uploaded with in one with ".options" added. Those
+// are written after the image, and removed with it if they cannot be.
+type FilesystemUpload struct {
+	root    string
+	perm    os.FileMode
+	baseurl string
+}
+
+// NewFilesystemUpload is the FilesystemUpload factory. Images are written
+// under root, which is created if need be, with the permissions perm.
+// Directories get the same permissions plus search where there is read.
+// baseurl is where root is served from; if it is blank URL gives file://
+// URLs.
+func NewFilesystemUpload(root string, perm os.FileMode, baseurl string) (*FilesystemUpload, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	self := &FilesystemUpload{root: root, perm: perm.Perm(), baseurl: strings.TrimRight(baseurl, "/")}
+	if err := os.MkdirAll(root, self.dirperm()); err != nil {
+		return nil, err
+	}
+	return self, nil
+}
+
+// Upload implements github.com/helixdigital/imageserver/core/Uploader interface.
+// Saves the data under the root directory as uplname
+func (self *FilesystemUpload) Upload(rdr io.Reader, size int64, mime string, uplname string, options entities.UploadOptions) error {
+	path, err := self.path(uplname)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), self.dirperm()); err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(options)
+	if err != nil {
+		return err
+	}
+	if err := self.writeAtomically(path, rdr, size); err != nil {
+		return err
+	}
+	err = self.writeAtomically(path+mimeSidecar, strings.NewReader(mime), -1)
+	if err == nil {
+		err = self.writeAtomically(path+optionsSidecar, bytes.NewReader(encoded), -1)
+	}
+	if err != nil {
+		self.Delete(uplname)
+	}
+	return err
+}
+
+// Delete implements github.com/helixdigital/imageserver/core/Deleter interface.
+// Removes the file, and its mime type and options, from the root
+// directory. It is not an error if it is already gone.
+func (self *FilesystemUpload) Delete(uplname string) error {
+	path, err := self.path(uplname)
+	if err != nil {
+		return err
+	}
+	for _, name := range []string{path, path + mimeSidecar, path + optionsSidecar} {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// URL implements github.com/helixdigital/imageserver/core/URLer.
+// It is where the uploaded file can be fetched from.
+func (self *FilesystemUpload) URL(uplname string) string {
+	path, err := self.path(uplname)
+	if err != nil {
+		return ""
+	}
+	if self.baseurl == "" {
+		return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+	}
+	rel := (&url.URL{Path: filepath.ToSlash(strings.TrimPrefix(path, self.root+string(filepath.Separator)))}).EscapedPath()
+	return self.baseurl + "/" + rel
+}
+
+// Mime is the mime type the file was uploaded with
+func (self *FilesystemUpload) Mime(uplname string) (string, error) {
+	path, err := self.path(uplname)
+	if err != nil {
+		return "", err
+	}
+	mime, err := ioutil.ReadFile(path + mimeSidecar)
+	return string(mime), err
+}
+
+// Options are the UploadOptions the file was uploaded with
+func (self *FilesystemUpload) Options(uplname string) (entities.UploadOptions, error) {
+	var options entities.UploadOptions
+	path, err := self.path(uplname)
+	if err != nil {
+		return options, err
+	}
+	encoded, err := ioutil.ReadFile(path + optionsSidecar)
+	if err != nil {
+		return options, err
+	}
+	err = json.Unmarshal(encoded, &options)
+	return options, err
+}
+
+// Where uplname is kept. Like S3 keys, names are separated by "/" and
+// a leading "/" is ignored.
+func (self *FilesystemUpload) path(uplname string) (string, error) {
+	name := strings.TrimLeft(uplname, "/")
+	if name == "" {
+		return "", ErrBadName
+	}
+	if strings.HasSuffix(name, mimeSidecar) || strings.HasSuffix(name, optionsSidecar) {
+		return "", ErrReservedName
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." || strings.ContainsRune(part, filepath.Separator) {
+			return "", ErrBadName
+		}
+	}
+	return filepath.Join(self.root, filepath.FromSlash(name)), nil
+}
+
+// Writes to a temporary file in the same directory and renames it over
+// path, so that path holds either the old or the new data. If size is
+// not -1 exactly that many bytes must be read.
+func (self *FilesystemUpload) writeAtomically(path string, rdr io.Reader, size int64) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	written, err := io.Copy(tmp, rdr)
+	if err == nil && size >= 0 && written != size {
+		err = fmt.Errorf("Read %d bytes of an image of %d", written, size)
+	}
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(self.perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// The file permissions with search added wherever there is read
+func (self *FilesystemUpload) dirperm() os.FileMode {
+	return self.perm | (self.perm&0444)>>2 | 0700
+}
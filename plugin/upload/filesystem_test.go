@@ -0,0 +1,178 @@
+/*
+Copyright 2014 Helix Digital
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package upload
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/helixdigital/imageserver/entities"
+)
+
+func newTestFilesystem(t *testing.T, baseurl string) (*FilesystemUpload, string) {
+	root := filepath.Join(t.TempDir(), "images")
+	fs, err := NewFilesystemUpload(root, 0640, baseurl)
+	if err != nil {
+		t.Fatal("NewFilesystemUpload unexpectedly threw an error", err)
+	}
+	return fs, root
+}
+
+func TestFilesystemUpload(t *testing.T) {
+	fs, root := newTestFilesystem(t, "")
+	options := entities.UploadOptions{
+		Cache_control: "public, max-age=60",
+		Metadata:      map[string]string{"user-id": "1"},
+	}
+
+	if err := fs.Upload(strings.NewReader("one two three"), -1, "image/png", "users/1/avatar.png", options); err != nil {
+		t.Fatal("Upload unexpectedly threw an error", err)
+	}
+	path := filepath.Join(root, "users", "1", "avatar.png")
+	data, err := ioutil.ReadFile(path)
+	if err != nil || string(data) != "one two three" {
+		t.Error("The file should have held the data but held", string(data), err)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0640 {
+		t.Error("The file should have had permissions 0640 but had", info.Mode().Perm())
+	}
+	if info, _ := os.Stat(filepath.Dir(path)); info.Mode().Perm() != 0750 {
+		t.Error("The directory should have had permissions 0750 but had", info.Mode().Perm())
+	}
+	if mime, err := fs.Mime("users/1/avatar.png"); mime != "image/png" || err != nil {
+		t.Error("The mime type should have been kept as image/png but was", mime, err)
+	}
+	kept, err := fs.Options("users/1/avatar.png")
+	if err != nil || kept.Cache_control != "public, max-age=60" || kept.Metadata["user-id"] != "1" {
+		t.Error("The options should have been kept but were", kept, err)
+	}
+	files, _ := ioutil.ReadDir(filepath.Dir(path))
+	if len(files) != 3 {
+		t.Error("Only the image, its mime type and its options should have been left but found", files)
+	}
+}
+
+func TestFilesystemUploadReplaces(t *testing.T) {
+	fs, root := newTestFilesystem(t, "")
+
+	fs.Upload(strings.NewReader("old"), -1, "image/gif", "a.png", entities.UploadOptions{})
+	fs.Upload(strings.NewReader("new"), -1, "image/png", "a.png", entities.UploadOptions{})
+	if data, _ := ioutil.ReadFile(filepath.Join(root, "a.png")); string(data) != "new" {
+		t.Error("A second upload should have replaced the first but the file held", string(data))
+	}
+	if mime, _ := fs.Mime("a.png"); mime != "image/png" {
+		t.Error("A second upload should have replaced the mime type but it was", mime)
+	}
+}
+
+func TestFilesystemUploadChecksSize(t *testing.T) {
+	fs, root := newTestFilesystem(t, "")
+
+	if err := fs.Upload(strings.NewReader("short"), 100, "image/png", "short.png", entities.UploadOptions{}); err == nil {
+		t.Error("An image shorter than its size should have thrown an error")
+	}
+	if files, _ := ioutil.ReadDir(root); len(files) != 0 {
+		t.Error("Nothing of an image shorter than its size should have been kept but found", files)
+	}
+	if err := fs.Upload(strings.NewReader("exact"), 5, "image/png", "exact.png", entities.UploadOptions{}); err != nil {
+		t.Error("An image of its size should have been kept but threw", err)
+	}
+}
+
+func TestFilesystemUploadStaysInRoot(t *testing.T) {
+	fs, root := newTestFilesystem(t, "")
+
+	for _, name := range []string{"../escaped.png", "a/../../escaped.png", "", "/"} {
+		if err := fs.Upload(strings.NewReader("x"), -1, "image/png", name, entities.UploadOptions{}); err != ErrBadName {
+			t.Error("Uploading", name, "should have thrown ErrBadName but threw", err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(root), "escaped.png")); err == nil {
+		t.Error("A file should not have been written outside the root")
+	}
+	if err := fs.Upload(strings.NewReader("x"), -1, "image/png", "/leading.png", entities.UploadOptions{}); err != nil {
+		t.Error("A leading / should have been ignored but threw", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "leading.png")); err != nil {
+		t.Error("A name with a leading / should have been written in the root", err)
+	}
+}
+
+func TestFilesystemUploadRefusesSidecarNames(t *testing.T) {
+	fs, root := newTestFilesystem(t, "")
+	fs.Upload(strings.NewReader("x"), -1, "image/png", "a.png", entities.UploadOptions{})
+
+	for _, name := range []string{"a.png.mime", "a.png.options"} {
+		if err := fs.Upload(strings.NewReader("y"), -1, "image/png", name, entities.UploadOptions{}); err != ErrReservedName {
+			t.Error("Uploading", name, "should have thrown ErrReservedName but threw", err)
+		}
+	}
+	if mime, _ := fs.Mime("a.png"); mime != "image/png" {
+		t.Error("The mime type of a.png should not have been overwritten but was", mime)
+	}
+	if files, _ := ioutil.ReadDir(root); len(files) != 3 {
+		t.Error("Only a.png, its mime type and its options should have been left but found", files)
+	}
+}
+
+func TestFilesystemUploadRemovesTheImageIfItsOptionsFail(t *testing.T) {
+	fs, root := newTestFilesystem(t, "")
+	// a directory cannot be renamed over
+	os.MkdirAll(filepath.Join(root, "b.png.options", "full"), 0750)
+
+	if err := fs.Upload(strings.NewReader("x"), -1, "image/png", "b.png", entities.UploadOptions{}); err == nil {
+		t.Error("An upload whose options cannot be written should have thrown an error")
+	}
+	for _, name := range []string{"b.png", "b.png.mime"} {
+		if _, err := os.Stat(filepath.Join(root, name)); err == nil {
+			t.Error(name, "should have been removed when the options could not be written")
+		}
+	}
+}
+
+func TestFilesystemDelete(t *testing.T) {
+	fs, root := newTestFilesystem(t, "")
+
+	fs.Upload(strings.NewReader("x"), -1, "image/png", "gone.png", entities.UploadOptions{})
+	if err := fs.Delete("gone.png"); err != nil {
+		t.Error("Delete unexpectedly threw an error", err)
+	}
+	if files, _ := ioutil.ReadDir(root); len(files) != 0 {
+		t.Error("Delete should have removed the image, its mime type and its options but found", files)
+	}
+	if err := fs.Delete("gone.png"); err != nil {
+		t.Error("Deleting a missing file should not have thrown an error but threw", err)
+	}
+}
+
+func TestFilesystemURL(t *testing.T) {
+	fs, root := newTestFilesystem(t, "")
+	if url := fs.URL("a b.png"); url != "file://"+filepath.ToSlash(root)+"/a%20b.png" {
+		t.Error("Without a base URL the URL should have been a file:// URL but was", url)
+	}
+
+	fs, _ = newTestFilesystem(t, "https://images.example.com/")
+	if url := fs.URL("users/a b.png"); url != "https://images.example.com/users/a%20b.png" {
+		t.Error("The URL should have been under the base URL but was", url)
+	}
+	if url := fs.URL("../x.png"); url != "" {
+		t.Error("A bad name should not have a URL but had", url)
+	}
+}
@@ -16,7 +16,12 @@ limitations under the License.
 
 package upload
 
-import "bytes"
+import (
+	"bytes"
+	"io"
+
+	"github.com/helixdigital/imageserver/entities"
+)
 
 // MockUpload implements github.com/helixdigital/imageserver/core/Uploader
 //
@@ -24,20 +29,42 @@ import "bytes"
 type MockUpload struct {
 	WasCalled     bool
 	CalledData    string
+	CalledSize    int64
 	CalledMime    string
 	CalledUplname string
+	CalledOptions entities.UploadOptions
+	WasDeleted    bool
+	DeletedName   string
 }
 
 // Upload mocks the Upload call and stores the parameters so that tests
 // can calls that were made.
-func (self *MockUpload) Upload(data []byte, mime string, uplname string) error {
+func (self *MockUpload) Upload(rdr io.Reader, size int64, mime string, uplname string, options entities.UploadOptions) error {
+	var data bytes.Buffer
+	if _, err := data.ReadFrom(rdr); err != nil {
+		return err
+	}
 	(*self).WasCalled = true
-	(*self).CalledData = (bytes.NewBuffer(data)).String()
+	(*self).CalledData = data.String()
+	(*self).CalledSize = size
 	(*self).CalledMime = mime
 	(*self).CalledUplname = uplname
+	(*self).CalledOptions = options
+	return nil
+}
+
+// Delete mocks the Delete call and stores the name that was deleted
+func (self *MockUpload) Delete(uplname string) error {
+	(*self).WasDeleted = true
+	(*self).DeletedName = uplname
 	return nil
 }
 
+// URL mocks the URL call
+func (self *MockUpload) URL(uplname string) string {
+	return "mock://" + uplname
+}
+
 // NewMock is the MockUpload factory
 func NewMock() *MockUpload {
 	return new(MockUpload)
@@ -17,16 +17,22 @@ limitations under the License.
 package upload
 
 import (
+	"strings"
 	"testing"
+
+	"github.com/helixdigital/imageserver/entities"
 )
 
 func TestMockUpload(t *testing.T) {
 	mock := NewMock()
-	mock.Upload([]byte("io.Reader"), "string", "string")
+	mock.Upload(strings.NewReader("io.Reader"), 9, "string", "string", entities.UploadOptions{Cache_control: "no-cache"})
 	if !mock.WasCalled {
 		t.Error("Ought to have called the mock")
 	}
 	if mock.CalledData != "io.Reader" {
 		t.Error("Ought to have called the mock with 'io.Reader' but was", mock.CalledData)
 	}
+	if mock.CalledOptions.Cache_control != "no-cache" {
+		t.Error("Ought to have called the mock with the options but was", mock.CalledOptions)
+	}
 }
@@ -0,0 +1,108 @@
+/*
+Copyright 2014 Helix Digital
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package signedurl makes and checks the signed URLs that the
+// imageserver accepts when it is started with a URL secret. A webapp
+// imports it to hand out URLs that a browser can use until they expire.
+// It depends on nothing but the standard library.
+//
+// A signature is the hex HMAC-SHA256, keyed with the shared secret, of
+// the method, a newline, the path, a newline, the parameters (including
+// `expires`, excluding `signature`) encoded as by url.Values.Encode, a
+// newline, and the hex SHA-256 of the request body. The body of a
+// urlencoded form is taken to be empty, since its fields are among the
+// parameters. `expires` is a Unix time in seconds.
+package signedurl
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// ErrBadSignature is returned by Verify when the signature is missing or
+// does not match
+var ErrBadSignature = errors.New("The URL signature is not valid")
+
+// ErrExpired is returned by Verify when the signature was valid but its
+// time is up
+var ErrExpired = errors.New("The URL has expired")
+
+// Sign returns a copy of params with `expires` and `signature` added, so
+// that a request with the method to path with them is accepted until
+// expires. body is the document that will be sent, or nil for a GET or
+// a urlencoded form.
+func Sign(secret []byte, method string, path string, params url.Values, body []byte, expires time.Time) url.Values {
+	signed := url.Values{}
+	for key, values := range params {
+		if key != "signature" {
+			signed[key] = append([]string(nil), values...)
+		}
+	}
+	signed.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	signed.Set("signature", signature(secret, method, path, signed, body))
+	return signed
+}
+
+// URL returns path with a query made by Sign for a GET. It is the usual
+// way to make a URL for a browser.
+func URL(secret []byte, path string, params url.Values, expires time.Time) string {
+	return path + "?" + Sign(secret, "GET", path, params, nil, expires).Encode()
+}
+
+// Verify checks that params carry a valid signature of the method, path,
+// params and body that has not expired at now
+func Verify(secret []byte, method string, path string, params url.Values, body []byte, now time.Time) error {
+	given, err := hex.DecodeString(params.Get("signature"))
+	if err != nil || len(given) == 0 {
+		return ErrBadSignature
+	}
+	expected, _ := hex.DecodeString(signature(secret, method, path, params, body))
+	if !hmac.Equal(given, expected) {
+		return ErrBadSignature
+	}
+	expires, err := strconv.ParseInt(params.Get("expires"), 10, 64)
+	if err != nil {
+		return ErrBadSignature
+	}
+	if now.Unix() > expires {
+		return ErrExpired
+	}
+	return nil
+}
+
+func signature(secret []byte, method string, path string, params url.Values, body []byte) string {
+	unsigned := url.Values{}
+	for key, values := range params {
+		if key != "signature" {
+			unsigned[key] = values
+		}
+	}
+	bodyhash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(method))
+	mac.Write([]byte("\n"))
+	mac.Write([]byte(path))
+	mac.Write([]byte("\n"))
+	mac.Write([]byte(unsigned.Encode()))
+	mac.Write([]byte("\n"))
+	mac.Write([]byte(hex.EncodeToString(bodyhash[:])))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2014 Helix Digital
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package signedurl
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+var secret = []byte("s3cr3t")
+
+func TestSignedURLVerifies(t *testing.T) {
+	now := time.Now()
+	signed := URL(secret, "/status", url.Values{"jobid": {"7"}}, now.Add(time.Minute))
+	u, _ := url.Parse(signed)
+	if u.Path != "/status" || u.Query().Get("jobid") != "7" {
+		t.Error("The signed URL should keep its path and parameters but was", signed)
+	}
+	if err := Verify(secret, "GET", u.Path, u.Query(), nil, now); err != nil {
+		t.Error("A freshly signed URL should verify but threw", err)
+	}
+}
+
+func TestVerifyRejectsChanges(t *testing.T) {
+	now := time.Now()
+	body := []byte(`{"local_filename": "/tmp/a.png"}`)
+	params := Sign(secret, "POST", "/v2/jobs", url.Values{"jobid": {"7"}}, body, now.Add(time.Minute))
+
+	if err := Verify([]byte("guessed"), "POST", "/v2/jobs", params, body, now); err != ErrBadSignature {
+		t.Error("The wrong secret should not verify but got", err)
+	}
+	if err := Verify(secret, "POST", "/v2/jobs/7", params, body, now); err != ErrBadSignature {
+		t.Error("A different path should not verify but got", err)
+	}
+	if err := Verify(secret, "PUT", "/v2/jobs", params, body, now); err != ErrBadSignature {
+		t.Error("A different method should not verify but got", err)
+	}
+	if err := Verify(secret, "POST", "/v2/jobs", params, []byte(`{}`), now); err != ErrBadSignature {
+		t.Error("A different body should not verify but got", err)
+	}
+	changed := Sign(secret, "POST", "/v2/jobs", nil, body, now)
+	changed.Set("jobid", "8")
+	changed.Set("signature", params.Get("signature"))
+	if err := Verify(secret, "POST", "/v2/jobs", changed, body, now); err != ErrBadSignature {
+		t.Error("Different parameters should not verify but got", err)
+	}
+	later := params
+	later.Set("expires", "99999999999")
+	if err := Verify(secret, "POST", "/v2/jobs", later, body, now); err != ErrBadSignature {
+		t.Error("A changed expiry should not verify but got", err)
+	}
+}
+
+func TestVerifyRejectsExpired(t *testing.T) {
+	now := time.Now()
+	params := Sign(secret, "GET", "/img/w:100/cat.png", nil, nil, now.Add(-time.Second))
+	if err := Verify(secret, "GET", "/img/w:100/cat.png", params, nil, now); err != ErrExpired {
+		t.Error("An expired URL should throw ErrExpired but threw", err)
+	}
+}
+
+func TestVerifyRejectsMissingSignature(t *testing.T) {
+	err := Verify(secret, "GET", "/status", url.Values{"jobid": {"7"}, "expires": {"99999999999"}}, nil, time.Now())
+	if err != ErrBadSignature {
+		t.Error("A URL without a signature should not verify but got", err)
+	}
+}
+
+func TestSignDoesNotChangeParams(t *testing.T) {
+	params := url.Values{"jobid": {"7"}}
+	Sign(secret, "GET", "/status", params, nil, time.Now())
+	if len(params) != 1 || !strings.Contains(params.Encode(), "jobid=7") {
+		t.Error("Sign should have left its params alone but they became", params)
+	}
+}